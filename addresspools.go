@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// defaultAddressPools are the pools the Docker engine allocates local networks
+// from when daemon.json sets no default-address-pools.
+var defaultAddressPools = []string{
+	"172.17.0.0/16",
+	"172.18.0.0/16",
+	"172.19.0.0/16",
+	"172.20.0.0/14",
+	"172.24.0.0/14",
+	"172.28.0.0/14",
+	"192.168.0.0/16",
+}
+
+// lanRange is the pool Docker shares with most home and office networks. A
+// LAN or VPN joined after Setup would be shadowed by it, so it is only routed
+// as a whole when addressPools lists it.
+var lanRange = &net.IPNet{IP: net.IPv4(192, 168, 0, 0).To4(), Mask: net.CIDRMask(16, 32)}
+
+// resolveAddressPools returns the address pools to route as a whole: those
+// of the config, else those the engine reports, else Docker's defaults. Pools
+// overlapping a route of another interface, like a WSL switch or the LAN, or
+// 192.168.0.0/16 when it isn't configured are left to the per network routes.
+func (w *Wireguard) resolveAddressPools() ([]*net.IPNet, error) {
+	if !w.routeAddressPools {
+		return nil, nil
+	}
+
+	cidrs := w.addressPools
+	if len(cidrs) == 0 {
+		info, err := w.docker.cli.Info(w.docker.ctx)
+		if err != nil {
+			return nil, errors.New("failed to get docker info: " + err.Error())
+		}
+
+		for _, pool := range info.DefaultAddressPools {
+			cidrs = append(cidrs, pool.Base)
+		}
+	}
+	if len(cidrs) == 0 {
+		cidrs = defaultAddressPools
+	}
+
+	others, err := w.otherRoutes()
+	if err != nil {
+		return nil, err
+	}
+	for _, cidr := range dockerDesktopRanges {
+		_, ipNet, _ := net.ParseCIDR(cidr)
+		others = append(others, ipNet)
+	}
+
+	var pools []*net.IPNet
+	for _, cidr := range cidrs {
+		_, pool, err := net.ParseCIDR(cidr)
+		if err != nil || pool.IP.To4() == nil {
+			continue
+		}
+
+		if len(w.addressPools) == 0 && overlapsAny(pool, []*net.IPNet{lanRange}) {
+			w.log.Info(EventAddressPoolSkipped, "Address pool is inside 192.168.0.0/16 and not configured, its networks are routed one by one", "pool", pool.String())
+			continue
+		}
+
+		if overlapsAny(pool, others) {
+			w.log.Warning(EventAddressPoolSkipped, "Address pool overlaps another route, its networks are routed one by one", "pool", pool.String())
+			continue
+		}
+		pools = append(pools, pool)
+	}
+
+	return pools, nil
+}
+
+// otherRoutes returns the destinations routed through other interfaces,
+// without default, multicast and broadcast routes.
+func (w *Wireguard) otherRoutes() ([]*net.IPNet, error) {
+	routes, err := w.getRoutes()
+	if err != nil {
+		return nil, errors.New("failed to list routes: " + err.Error())
+	}
+
+	var others []*net.IPNet
+	for _, route := range routes {
+		if route[0] == w.interfaceName || strings.HasSuffix(route[1], "/0") {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(route[1])
+		if err == nil && !ipNet.IP.IsMulticast() && !ipNet.IP.Equal(net.IPv4bcast) {
+			others = append(others, ipNet)
+		}
+	}
+
+	return others, nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	defaultPeerPool = "10.20.30.0/24"
+	firstAutoPort   = 2030
+	lastAutoPort    = 2130
+)
+
+// dockerDesktopRanges are used inside the Docker Desktop VM without showing up
+// as Docker networks or Windows routes.
+var dockerDesktopRanges = []string{
+	"192.168.65.0/24",
+	"10.0.75.0/24",
+}
+
+// Allocation is the addressing picked for a profile, remembered across
+// restarts so the tunnel keeps its addresses.
+type Allocation struct {
+	HostPeerIp string `json:"hostPeerIp"`
+	VmPeerIp   string `json:"vmPeerIp"`
+	Port       int    `json:"port"`
+}
+
+type Allocations struct {
+	path     string
+	Profiles map[string]Allocation `json:"profiles"`
+}
+
+// getAllocationsPath returns the allocations file inside the data directory,
+// next to the journal.
+func getAllocationsPath(name string) string {
+	return filepath.Join(getDataDir(name), "allocations.json")
+}
+
+func LoadAllocations(path string) (*Allocations, error) {
+	allocations := &Allocations{
+		path:     path,
+		Profiles: make(map[string]Allocation),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return allocations, nil
+	}
+	if err != nil {
+		return nil, errors.New("failed to read allocations: " + err.Error())
+	}
+
+	err = json.Unmarshal(data, allocations)
+	if err != nil {
+		return nil, errors.New("failed to parse allocations: " + err.Error())
+	}
+	if allocations.Profiles == nil {
+		allocations.Profiles = make(map[string]Allocation)
+	}
+
+	return allocations, nil
+}
+
+func (a *Allocations) Save() error {
+	data, err := json.MarshalIndent(a, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(a.path, data, 0600)
+}
+
+// Allocator picks free peer addresses and listen ports for profiles that don't
+// configure them. Peers get the first and second address of a /30 from the
+// pool that overlaps no Windows route, Docker network or Docker Desktop range.
+type Allocator struct {
+	Utils
+	mu          sync.Mutex
+	pool        *net.IPNet
+	allocations *Allocations
+	profiles    []*Profile
+}
+
+func NewAllocator(pool string, allocations *Allocations, profiles []*Profile) (*Allocator, error) {
+	if pool == "" {
+		pool = defaultPeerPool
+	}
+
+	_, poolNet, err := net.ParseCIDR(pool)
+	if err != nil || poolNet.IP.To4() == nil {
+		return nil, fmt.Errorf("invalid peer pool %s", pool)
+	}
+
+	return &Allocator{
+		pool:        poolNet,
+		allocations: allocations,
+		profiles:    profiles,
+	}, nil
+}
+
+// Allocate returns the profile with its peer addresses and port filled in.
+func (a *Allocator) Allocate(profile *Profile, docker *Docker) (*Profile, error) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	allocated := *profile
+	if allocated.HostPeerIp != "" && allocated.Port != 0 {
+		return &allocated, nil
+	}
+
+	remembered, found := a.allocations.Profiles[profile.Name]
+
+	if allocated.HostPeerIp == "" {
+		used, err := a.usedNetworks(profile, docker)
+		if err != nil {
+			return nil, err
+		}
+
+		if found && a.isFree(remembered.HostPeerIp, used) {
+			allocated.HostPeerIp = remembered.HostPeerIp
+			allocated.VmPeerIp = remembered.VmPeerIp
+		} else {
+			allocated.HostPeerIp, allocated.VmPeerIp, err = a.findPeers(used)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if allocated.Port == 0 {
+		if found && remembered.Port != 0 && !a.isPortReserved(profile, remembered.Port) {
+			// the port may still be held by our own tunnel, so it isn't probed
+			allocated.Port = remembered.Port
+		} else {
+			var err error
+			allocated.Port, err = a.findPort(profile)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	a.allocations.Profiles[profile.Name] = Allocation{
+		HostPeerIp: allocated.HostPeerIp,
+		VmPeerIp:   allocated.VmPeerIp,
+		Port:       allocated.Port,
+	}
+
+	err := a.allocations.Save()
+	if err != nil {
+		return nil, errors.New("failed to save allocations: " + err.Error())
+	}
+
+	return &allocated, nil
+}
+
+func (a *Allocator) usedNetworks(profile *Profile, docker *Docker) ([]*net.IPNet, error) {
+	var cidrs []string
+	cidrs = append(cidrs, dockerDesktopRanges...)
+
+	subnets, err := docker.GetSubnets()
+	if err != nil {
+		return nil, errors.New("failed to get docker subnets: " + err.Error())
+	}
+	cidrs = append(cidrs, subnets...)
+
+	routes, err := a.getWindowsRoutes()
+	if err != nil {
+		return nil, err
+	}
+	cidrs = append(cidrs, routes...)
+
+	for _, other := range a.profiles {
+		if other.Name == profile.Name {
+			continue
+		}
+
+		ips := []string{other.HostPeerIp, other.VmPeerIp}
+		if allocation, ok := a.allocations.Profiles[other.Name]; ok {
+			ips = append(ips, allocation.HostPeerIp, allocation.VmPeerIp)
+		}
+		for _, ip := range ips {
+			if ip != "" {
+				cidrs = append(cidrs, ip+"/32")
+			}
+		}
+	}
+
+	var used []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil || ipNet.IP.To4() == nil {
+			continue
+		}
+		used = append(used, ipNet)
+	}
+
+	return used, nil
+}
+
+// getWindowsRoutes lists the IPv4 route prefixes, leaving out the default
+// route and the routes of our own tunnels.
+func (a *Allocator) getWindowsRoutes() ([]string, error) {
+	output, err := a.runPowerShell("Get-NetRoute -AddressFamily IPv4 | ForEach-Object { $_.InterfaceAlias + '|' + $_.DestinationPrefix }")
+	if err != nil {
+		return nil, errors.New("failed to list routes: " + err.Error())
+	}
+
+	own := make(map[string]bool)
+	for _, profile := range a.profiles {
+		own[profile.InterfaceName] = true
+	}
+
+	var routes []string
+	for _, line := range strings.Split(output, "\n") {
+		alias, prefix, found := strings.Cut(strings.TrimSpace(line), "|")
+		if !found || own[alias] || strings.HasSuffix(prefix, "/0") {
+			continue
+		}
+		routes = append(routes, prefix)
+	}
+
+	return routes, nil
+}
+
+func (a *Allocator) isFree(ip string, used []*net.IPNet) bool {
+	parsed := net.ParseIP(ip).To4()
+	if parsed == nil || !a.pool.Contains(parsed) {
+		return false
+	}
+
+	block := &net.IPNet{IP: parsed.Mask(net.CIDRMask(30, 32)), Mask: net.CIDRMask(30, 32)}
+
+	return !overlapsAny(block, used)
+}
+
+func (a *Allocator) findPeers(used []*net.IPNet) (string, string, error) {
+	ones, _ := a.pool.Mask.Size()
+	if ones > 30 {
+		return "", "", fmt.Errorf("peer pool %s is smaller than a /30", a.pool)
+	}
+
+	first := binary.BigEndian.Uint32(a.pool.IP.To4())
+	count := uint64(1) << (32 - ones)
+	for offset := uint32(0); uint64(offset) < count; offset += 4 {
+		block := &net.IPNet{IP: make(net.IP, 4), Mask: net.CIDRMask(30, 32)}
+		binary.BigEndian.PutUint32(block.IP, first+offset)
+		if overlapsAny(block, used) {
+			continue
+		}
+
+		host := make(net.IP, 4)
+		vm := make(net.IP, 4)
+		binary.BigEndian.PutUint32(host, first+offset+1)
+		binary.BigEndian.PutUint32(vm, first+offset+2)
+
+		return host.String(), vm.String(), nil
+	}
+
+	return "", "", fmt.Errorf("no free peer addresses left in %s", a.pool)
+}
+
+func (a *Allocator) isPortReserved(profile *Profile, port int) bool {
+	for _, other := range a.profiles {
+		if other.Name == profile.Name {
+			continue
+		}
+		if other.Port == port || a.allocations.Profiles[other.Name].Port == port {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *Allocator) findPort(profile *Profile) (int, error) {
+	for port := firstAutoPort; port <= lastAutoPort; port++ {
+		if a.isPortReserved(profile, port) {
+			continue
+		}
+
+		conn, err := net.ListenPacket("udp", ":"+strconv.Itoa(port))
+		if err != nil {
+			continue
+		}
+		_ = conn.Close()
+
+		return port, nil
+	}
+
+	return 0, fmt.Errorf("no free UDP port between %d and %d", firstAutoPort, lastAutoPort)
+}
+
+func overlapsAny(ipNet *net.IPNet, networks []*net.IPNet) bool {
+	for _, other := range networks {
+		if ipNet.Contains(other.IP) || other.Contains(ipNet.IP) {
+			return true
+		}
+	}
+
+	return false
+}
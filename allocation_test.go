@@ -0,0 +1,161 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func parseCIDRs(t *testing.T, cidrs ...string) []*net.IPNet {
+	t.Helper()
+
+	var networks []*net.IPNet
+	for _, cidr := range cidrs {
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		networks = append(networks, ipNet)
+	}
+
+	return networks
+}
+
+func newTestAllocator(t *testing.T, pool string, profiles ...*Profile) *Allocator {
+	t.Helper()
+
+	allocations, err := LoadAllocations(filepath.Join(t.TempDir(), "allocations.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	allocator, err := NewAllocator(pool, allocations, profiles)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return allocator
+}
+
+func TestAllocatorFindPeers(t *testing.T) {
+	tests := []struct {
+		name     string
+		pool     string
+		used     []string
+		wantHost string
+		wantVm   string
+		wantErr  bool
+	}{
+		{name: "empty pool", pool: "10.20.30.0/24", wantHost: "10.20.30.1", wantVm: "10.20.30.2"},
+		{name: "default pool", wantHost: "10.20.30.1", wantVm: "10.20.30.2"},
+		{name: "first block used", pool: "10.20.30.0/24", used: []string{"10.20.30.2/32"}, wantHost: "10.20.30.5", wantVm: "10.20.30.6"},
+		{
+			name:     "network inside the pool",
+			pool:     "10.20.30.0/24",
+			used:     []string{"10.20.30.0/28"},
+			wantHost: "10.20.30.17",
+			wantVm:   "10.20.30.18",
+		},
+		{name: "pool inside a network", pool: "10.20.30.0/24", used: []string{"10.0.0.0/8"}, wantErr: true},
+		{name: "single block", pool: "10.20.30.8/30", wantHost: "10.20.30.9", wantVm: "10.20.30.10"},
+		{name: "single block used", pool: "10.20.30.8/30", used: []string{"10.20.30.9/32"}, wantErr: true},
+		{name: "pool too small", pool: "10.20.30.8/31", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			allocator := newTestAllocator(t, test.pool)
+
+			host, vm, err := allocator.findPeers(parseCIDRs(t, test.used...))
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("findPeers = %s, %s, want an error", host, vm)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("findPeers failed: %v", err)
+			}
+			if host != test.wantHost || vm != test.wantVm {
+				t.Errorf("findPeers = %s, %s, want %s, %s", host, vm, test.wantHost, test.wantVm)
+			}
+		})
+	}
+}
+
+func TestAllocatorIsFree(t *testing.T) {
+	allocator := newTestAllocator(t, "10.20.30.0/24")
+	used := parseCIDRs(t, "10.20.30.4/30", "10.20.30.128/25")
+
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "10.20.30.1", want: true},
+		{ip: "10.20.30.9", want: true},
+		{ip: "10.20.30.5"},
+		{ip: "10.20.30.7"},
+		{ip: "10.20.30.129"},
+		{ip: "10.20.31.1"},
+		{ip: ""},
+		{ip: "fd00::1"},
+	}
+
+	for _, test := range tests {
+		if free := allocator.isFree(test.ip, used); free != test.want {
+			t.Errorf("isFree(%q) = %t, want %t", test.ip, free, test.want)
+		}
+	}
+}
+
+func TestAllocatorIsPortReserved(t *testing.T) {
+	profile := &Profile{Name: defaultProfileName}
+	podman := &Profile{Name: "podman", Port: 2031}
+	devbox := &Profile{Name: "devbox"}
+	allocator := newTestAllocator(t, "", profile, podman, devbox)
+	allocator.allocations.Profiles["devbox"] = Allocation{Port: 2032}
+	allocator.allocations.Profiles[defaultProfileName] = Allocation{Port: 2033}
+
+	tests := []struct {
+		port int
+		want bool
+	}{
+		{port: 2030},
+		{port: 2031, want: true},
+		{port: 2032, want: true},
+		// the profile's own allocation isn't a reservation
+		{port: 2033},
+	}
+
+	for _, test := range tests {
+		if reserved := allocator.isPortReserved(profile, test.port); reserved != test.want {
+			t.Errorf("isPortReserved(%d) = %t, want %t", test.port, reserved, test.want)
+		}
+	}
+}
+
+func TestAllocatorAllocateRemembered(t *testing.T) {
+	profile := &Profile{Name: defaultProfileName, HostPeerIp: "10.20.30.1", VmPeerIp: "10.20.30.2"}
+	allocator := newTestAllocator(t, "", profile)
+	allocator.allocations.Profiles[defaultProfileName] = Allocation{HostPeerIp: "10.20.30.1", VmPeerIp: "10.20.30.2", Port: 2042}
+
+	allocated, err := allocator.Allocate(profile, nil)
+	if err != nil {
+		t.Fatalf("Allocate failed: %v", err)
+	}
+	if allocated.Port != 2042 {
+		t.Errorf("Port = %d, want the remembered 2042", allocated.Port)
+	}
+	if profile.Port != 0 {
+		t.Error("Allocate changed the profile it was given")
+	}
+
+	saved, err := LoadAllocations(allocator.allocations.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Profiles[defaultProfileName].Port != 2042 {
+		t.Errorf("saved allocation = %+v, want port 2042", saved.Profiles[defaultProfileName])
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"crypto/sha256"
+	"embed"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+//go:generate go run ./internal/gendigests
+
+//go:embed bin/wg.exe bin/wireguard.exe bin/digests.json
+var binaries embed.FS
+
+// binaryDigests are the SHA-256 digests of the embedded binaries and the
+// WireGuard version, recorded by internal/gendigests when building.
+type binaryDigests struct {
+	Files            map[string]string `json:"files"`
+	WireguardVersion string            `json:"wireguardVersion"`
+}
+
+// binariesMu keeps profiles from writing the shared binaries at the same time.
+var binariesMu sync.Mutex
+
+func loadBinaryDigests() (*binaryDigests, error) {
+	data, err := binaries.ReadFile("bin/digests.json")
+	if err != nil {
+		return nil, errors.New("failed to read binary digests: " + err.Error())
+	}
+
+	digests := &binaryDigests{}
+	err = json.Unmarshal(data, digests)
+	if err != nil {
+		return nil, errors.New("failed to parse binary digests: " + err.Error())
+	}
+
+	return digests, nil
+}
+
+func fileDigest(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// ensureBinary checks the copy of the embedded binary name at path against the
+// digest recorded at build time and writes it again when it is missing, stale
+// or tampered with. It runs before every execution of the binary.
+func ensureBinary(path, name string) error {
+	binariesMu.Lock()
+	defer binariesMu.Unlock()
+
+	digests, err := loadBinaryDigests()
+	if err != nil {
+		return err
+	}
+
+	expected, ok := digests.Files[name]
+	if !ok {
+		return fmt.Errorf("no digest recorded for %s", name)
+	}
+
+	actual, err := fileDigest(path)
+	if err == nil && actual == expected {
+		return nil
+	}
+	if err == nil {
+		logger.Warning(EventBinaryMismatch, "Binary doesn't match the embedded one, replacing it", "path", path)
+	}
+
+	data, err := binaries.ReadFile("bin/" + name)
+	if err != nil {
+		return fmt.Errorf("failed to open %s: %w", name, err)
+	}
+
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != expected {
+		return fmt.Errorf("embedded %s doesn't match its recorded digest, run go generate before building", name)
+	}
+
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return errors.New("failed to create bin directory: " + err.Error())
+	}
+
+	err = os.WriteFile(path, data, 0700)
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", name, err)
+	}
+
+	return nil
+}
+
+func printVersion() error {
+	digests, err := loadBinaryDigests()
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("WireGuard:      %s\n", digests.WireguardVersion)
+	fmt.Printf("Setup image:    %s\n", version.SetupImage)
+	for _, name := range []string{"wg.exe", "wireguard.exe"} {
+		fmt.Printf("%-15s sha256:%s\n", name+":", digests.Files[name])
+	}
+
+	return nil
+}
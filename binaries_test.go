@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFileDigest(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "wg.exe")
+	err := os.WriteFile(path, []byte("abc"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	digest, err := fileDigest(path)
+	if err != nil {
+		t.Fatalf("fileDigest failed: %v", err)
+	}
+	want := "ba7816bf8f01cfea414140de5dae2223b00361a396177a9cb410ff61f20015ad"
+	if digest != want {
+		t.Errorf("fileDigest = %s, want %s", digest, want)
+	}
+
+	_, err = fileDigest(filepath.Join(t.TempDir(), "missing.exe"))
+	if err == nil {
+		t.Error("fileDigest succeeded for a missing file")
+	}
+}
+
+func TestEnsureBinaryUnknown(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bin", "unknown.exe")
+
+	err := ensureBinary(path, "unknown.exe")
+	if err == nil {
+		t.Fatal("ensureBinary succeeded for a binary without a digest")
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("ensureBinary wrote a binary without a digest")
+	}
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+	"golang.zx2c4.com/wireguard/wgctrl"
+)
+
+// runCheck reports the state of the VM side for the doctor and plan commands,
+// one "CHECK <name> <ok|fail> <detail>" line per check separated by tabs. The
+// policy, routes, shims and hosts entry are compared with ACCESS_POLICY,
+// VM_ROUTES, SHIM_NETWORKS and HOST_NAME when they are set. It never changes
+// anything.
+func runCheck(interfaceName string) {
+	hostPeerIp := os.Getenv("HOST_PEER_IP")
+	vmPeerIp := os.Getenv("VM_PEER_IP")
+	preserveSourceIp, _ := strconv.ParseBool(os.Getenv("PRESERVE_SOURCE_IP"))
+
+	link, err := netlink.LinkByName(interfaceName)
+	if err != nil {
+		report("vm interface", false, fmt.Sprintf("%s is missing", interfaceName))
+		return
+	}
+	report("vm interface", link.Attrs().Flags&net.FlagUp != 0, fmt.Sprintf("%s is %s", interfaceName, link.Attrs().OperState))
+
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	found := false
+	for _, addr := range addrs {
+		if addr.IP.String() == vmPeerIp {
+			found = true
+		}
+	}
+	report("vm address", err == nil && found, fmt.Sprintf("%s on %s", vmPeerIp, interfaceName))
+
+	checkHandshake(interfaceName)
+
+	forward, err := os.ReadFile("/proc/sys/net/ipv4/ip_forward")
+	report("vm forwarding", err == nil && strings.TrimSpace(string(forward)) == "1", "net.ipv4.ip_forward")
+
+	ipt, err := iptables.New()
+	if err != nil {
+		report("vm nat", false, fmt.Sprintf("failed to create iptables client: %v", err))
+		return
+	}
+
+	checkNat(ipt, hostPeerIp, preserveSourceIp)
+
+	if value, ok := os.LookupEnv("ACCESS_POLICY"); ok {
+		policy, err := parseAccessPolicy(value)
+		if err != nil {
+			report("vm policy", false, fmt.Sprintf("ACCESS_POLICY is not valid: %v", err))
+		} else if policy == nil {
+			checkChain(ipt, "vm policy", policyChain, nil)
+		} else {
+			checkChain(ipt, "vm policy", policyChain, policyRules(interfaceName, policy))
+		}
+	}
+
+	if value, ok := os.LookupEnv("VM_ROUTES"); ok {
+		routes, err := parseVMRoutes(value)
+		if err != nil {
+			report("vm routes", false, fmt.Sprintf("VM_ROUTES is not valid: %v", err))
+		} else {
+			checkVMRoutes(routes)
+			checkChain(ipt, "vm route forwarding", routesChain, routeForwardingRules(interfaceName, routes))
+		}
+	}
+
+	if value, ok := os.LookupEnv("SHIM_NETWORKS"); ok {
+		shims, err := parseShimNetworks(value)
+		if err != nil {
+			report("vm shims", false, fmt.Sprintf("SHIM_NETWORKS is not valid: %v", err))
+		} else {
+			checkShims(shims)
+		}
+	}
+
+	if hostName, ok := os.LookupEnv("HOST_NAME"); ok {
+		checkHostsEntry(hostName, hostPeerIp)
+	}
+}
+
+func checkNat(ipt *iptables.IPTables, hostPeerIp string, preserveSourceIp bool) {
+	exists, err := ipt.Exists("nat", "POSTROUTING", "-s", hostPeerIp, "-j", "MASQUERADE")
+	if err != nil {
+		report("vm nat", false, fmt.Sprintf("failed to read nat rules: %v", err))
+		return
+	}
+
+	if preserveSourceIp {
+		report("vm nat", !exists, fmt.Sprintf("no MASQUERADE for %s, source IP preserved", hostPeerIp))
+		return
+	}
+	report("vm nat", exists, fmt.Sprintf("MASQUERADE for %s", hostPeerIp))
+}
+
+// checkChain compares a forwarding chain with the rules it should hold, no
+// rules meaning no chain. The order of the rules isn't compared.
+func checkChain(ipt *iptables.IPTables, name, chain string, rules [][]string) {
+	exists, err := ipt.ChainExists("filter", chain)
+	if err != nil {
+		report(name, false, fmt.Sprintf("failed to read chain %s: %v", chain, err))
+		return
+	}
+
+	if len(rules) == 0 {
+		report(name, !exists, fmt.Sprintf("no %s chain", chain))
+		return
+	}
+	if !exists {
+		report(name, false, fmt.Sprintf("%s chain is missing", chain))
+		return
+	}
+
+	// the first line creates the chain
+	listed, err := ipt.List("filter", chain)
+	if err != nil {
+		report(name, false, fmt.Sprintf("failed to read chain %s: %v", chain, err))
+		return
+	}
+	if len(listed)-1 != len(rules) {
+		report(name, false, fmt.Sprintf("%s has %d rules, expected %d", chain, len(listed)-1, len(rules)))
+		return
+	}
+
+	for _, rule := range rules {
+		ok, err := ipt.Exists("filter", chain, rule...)
+		if err != nil || !ok {
+			report(name, false, fmt.Sprintf("%s lacks %s", chain, strings.Join(rule, " ")))
+			return
+		}
+	}
+
+	jump, err := ipt.Exists("filter", "FORWARD", "-j", chain)
+	if err != nil || !jump {
+		report(name, false, fmt.Sprintf("FORWARD doesn't jump to %s", chain))
+		return
+	}
+
+	report(name, true, fmt.Sprintf("%s has the %d expected rules", chain, len(rules)))
+}
+
+// checkVMRoutes compares the routes added for VM_ROUTES with routes.
+func checkVMRoutes(routes []VMRoute) {
+	local, err := localAddresses()
+	if err != nil {
+		report("vm routes", false, err.Error())
+		return
+	}
+
+	expected := make(map[string]string)
+	for _, route := range routes {
+		gateway := net.ParseIP(route.Via)
+		if gateway == nil || local[gateway.String()] {
+			continue
+		}
+		dst, err := netlink.ParseIPNet(route.Subnet)
+		if err == nil {
+			expected[dst.String()] = gateway.String()
+		}
+	}
+
+	existing, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Protocol: routeProtocol}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		report("vm routes", false, fmt.Sprintf("could not list routes: %v", err))
+		return
+	}
+
+	var problems []string
+	actual := make(map[string]string)
+	for _, route := range existing {
+		if route.Dst == nil {
+			continue
+		}
+		actual[route.Dst.String()] = route.Gw.String()
+		if _, ok := expected[route.Dst.String()]; !ok {
+			problems = append(problems, fmt.Sprintf("stale route for %s", route.Dst))
+		}
+	}
+	for dst, gateway := range expected {
+		if actual[dst] != gateway {
+			problems = append(problems, fmt.Sprintf("no route for %s via %s", dst, gateway))
+		}
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		report("vm routes", false, strings.Join(problems, ", "))
+		return
+	}
+	report("vm routes", true, fmt.Sprintf("%d routes through gateways in the VM", len(expected)))
+}
+
+// checkShims compares the shim links with shims.
+func checkShims(shims []ShimNetwork) {
+	var problems []string
+	wanted := make(map[string]bool)
+	for _, shim := range shims {
+		name := shim.linkName()
+		wanted[name] = true
+
+		link, err := netlink.LinkByName(name)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("no shim %s for %s", name, shim.Name))
+			continue
+		}
+		if link.Attrs().Flags&net.FlagUp == 0 {
+			problems = append(problems, fmt.Sprintf("shim %s is down", name))
+		}
+
+		parent, err := netlink.LinkByName(shim.Parent)
+		if err == nil {
+			wantedLink, err := newShimLink(shim, name, parent.Attrs().Index)
+			if err == nil && !shimLinkMatches(link, wantedLink) {
+				problems = append(problems, fmt.Sprintf("shim %s has another parent or mode than %s", name, shim.Name))
+			}
+		}
+
+		addrs, _ := netlink.AddrList(link, netlink.FAMILY_V4)
+		found := false
+		for _, addr := range addrs {
+			if addr.IP.String() == shim.Address {
+				found = true
+			} else {
+				problems = append(problems, fmt.Sprintf("shim %s keeps stale address %s", name, addr.IP))
+			}
+		}
+		if !found {
+			problems = append(problems, fmt.Sprintf("shim %s lacks %s", name, shim.Address))
+		}
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		report("vm shims", false, fmt.Sprintf("could not list links: %v", err))
+		return
+	}
+	for _, link := range links {
+		name := link.Attrs().Name
+		if strings.HasPrefix(name, shimPrefix) && !wanted[name] {
+			problems = append(problems, fmt.Sprintf("stale shim %s", name))
+		}
+	}
+
+	if len(problems) > 0 {
+		report("vm shims", false, strings.Join(problems, ", "))
+		return
+	}
+	report("vm shims", true, fmt.Sprintf("%d macvlan and ipvlan shims", len(shims)))
+}
+
+// checkHostsEntry compares the entry in the VM's hosts file with hostname.
+func checkHostsEntry(hostname, ip string) {
+	data, err := os.ReadFile(hostsPath)
+	if err != nil {
+		report("vm hosts entry", hostname == "", fmt.Sprintf("%s is not readable: %v", hostsPath, err))
+		return
+	}
+
+	entry := ""
+	for _, line := range strings.Split(string(data), "\n") {
+		if strings.HasSuffix(line, hostsMarker) {
+			entry = line
+		}
+	}
+
+	if hostname == "" {
+		report("vm hosts entry", entry == "", "no entry for the host")
+		return
+	}
+	report("vm hosts entry", entry == fmt.Sprintf("%s\t%s %s", ip, hostname, hostsMarker), fmt.Sprintf("%s for %s", hostname, ip))
+}
+
+func checkHandshake(interfaceName string) {
+	c, err := wgctrl.New()
+	if err != nil {
+		report("vm handshake", false, fmt.Sprintf("failed to create wgctrl client: %v", err))
+		return
+	}
+	defer c.Close()
+
+	device, err := c.Device(interfaceName)
+	if err != nil || len(device.Peers) == 0 {
+		report("vm handshake", false, "no WireGuard peer configured")
+		return
+	}
+
+	handshake := device.Peers[0].LastHandshakeTime
+	if handshake.IsZero() {
+		report("vm handshake", false, "no handshake with the host yet")
+		return
+	}
+
+	age := time.Since(handshake).Round(time.Second)
+	// WireGuard renews the session every two minutes while traffic flows
+	report("vm handshake", age < 3*time.Minute, fmt.Sprintf("latest handshake %s ago", age))
+}
+
+func report(name string, ok bool, detail string) {
+	result := "fail"
+	if ok {
+		result = "ok"
+	}
+
+	fmt.Printf("CHECK\t%s\t%s\t%s\n", name, result, detail)
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	hostsPath   = "/host/etc/hosts"
+	hostsMarker = "# docker-win-net-connect"
+)
+
+// updateHostsEntry publishes hostname for the host tunnel address in the VM's
+// hosts file, which the host side bind mounts only when host services are
+// configured. Only the VM and host network containers read it, Docker's DNS
+// doesn't. An empty hostname only removes the entry written by an earlier run.
+func updateHostsEntry(hostname, ip string) error {
+	data, err := os.ReadFile(hostsPath)
+	if os.IsNotExist(err) {
+		if hostname != "" {
+			fmt.Printf("%s is not mounted, cannot publish %s\n", hostsPath, hostname)
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var lines []string
+	for _, line := range strings.Split(strings.TrimRight(string(data), "\n"), "\n") {
+		if strings.HasSuffix(line, hostsMarker) {
+			continue
+		}
+		lines = append(lines, line)
+	}
+
+	if hostname != "" {
+		fmt.Printf("Publishing %s as %s\n", hostname, ip)
+		lines = append(lines, fmt.Sprintf("%s\t%s %s", ip, hostname, hostsMarker))
+	}
+
+	// the file is a bind mount, it has to be rewritten in place
+	return os.WriteFile(hostsPath, []byte(strings.Join(lines, "\n")+"\n"), 0644)
+}
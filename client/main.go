@@ -21,6 +21,29 @@ const (
 func main() {
 	interfaceName := "chip0"
 
+	fmt.Printf("Setup helper %s\n", helperVersion)
+
+	switch os.Getenv("MODE") {
+	case "policy":
+		runPolicy(interfaceName)
+		return
+	case "teardown":
+		runTeardown(interfaceName)
+		return
+	case "check":
+		runCheck(interfaceName)
+		return
+	case "serve":
+		runServe()
+		return
+	case "routes":
+		runRoutes(interfaceName)
+		return
+	case "shims":
+		runShims()
+		return
+	}
+
 	serverPortString := os.Getenv("SERVER_PORT")
 	if serverPortString == "" {
 		fmt.Printf("SERVER_PORT is not set\n")
@@ -57,6 +80,36 @@ func main() {
 		os.Exit(ExitSetupFailed)
 	}
 
+	preserveSourceIp := false
+	preserveSourceIpString := os.Getenv("PRESERVE_SOURCE_IP")
+	if preserveSourceIpString != "" {
+		preserveSourceIp, err = strconv.ParseBool(preserveSourceIpString)
+		if err != nil {
+			fmt.Printf("PRESERVE_SOURCE_IP is not a boolean\n")
+			os.Exit(ExitSetupFailed)
+		}
+	}
+
+	accessPolicy, err := parseAccessPolicy(os.Getenv("ACCESS_POLICY"))
+	if err != nil {
+		fmt.Printf("ACCESS_POLICY is not valid: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	hostName := os.Getenv("HOST_NAME")
+
+	vmRoutes, err := parseVMRoutes(os.Getenv("VM_ROUTES"))
+	if err != nil {
+		fmt.Printf("VM_ROUTES is not valid: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	shims, err := parseShimNetworks(os.Getenv("SHIM_NETWORKS"))
+	if err != nil {
+		fmt.Printf("SHIM_NETWORKS is not valid: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
 	links, err := netlink.LinkList()
 	if err != nil {
 		fmt.Printf("Could not list links: %v\n", err)
@@ -138,14 +191,20 @@ func main() {
 		os.Exit(ExitSetupFailed)
 	}
 
+	allowedIPs := []net.IPNet{
+		*wildcardIpNet,
+		*hostIpNet,
+	}
+	if accessPolicy != nil {
+		// with a policy in place only the host tunnel address is a valid peer address
+		allowedIPs = []net.IPNet{*hostIpNet}
+	}
+
 	peer := wgtypes.PeerConfig{
 		PublicKey:                   hostPublicKey,
 		Endpoint:                    &net.UDPAddr{IP: ips[0], Port: serverPort},
 		PersistentKeepaliveInterval: &persistentKeepaliveInterval,
-		AllowedIPs: []net.IPNet{
-			*wildcardIpNet,
-			*hostIpNet,
-		},
+		AllowedIPs:                  allowedIPs,
 	}
 
 	fmt.Println("Configuring WireGuard device")
@@ -171,6 +230,72 @@ func main() {
 		os.Exit(ExitSetupFailed)
 	}
 
+	err = applyAccessPolicy(ipt, interfaceName, accessPolicy)
+	if err != nil {
+		fmt.Printf("Failed to apply access policy: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	err = updateHostsEntry(hostName, hostPeerIp)
+	if err != nil {
+		fmt.Printf("Failed to update hosts entry: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	err = applyVMRoutes(vmRoutes)
+	if err != nil {
+		fmt.Printf("Failed to apply routes: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	err = applyRouteForwarding(ipt, interfaceName, vmRoutes)
+	if err != nil {
+		fmt.Printf("Failed to apply route forwarding: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	err = applyShims(shims)
+	if err != nil {
+		// the other networks work without them
+		fmt.Printf("Failed to apply shims: %v\n", err)
+	}
+
+	if preserveSourceIp {
+		fmt.Println("Preserving host source IP, removing iptables NAT rule for host WireGuard IP")
+
+		err = ipt.DeleteIfExists(
+			"nat", "POSTROUTING",
+			"-s", hostPeerIp,
+			"-j", "MASQUERADE",
+		)
+		if err != nil {
+			fmt.Printf("Failed to remove iptables nat rule: %v\n", err)
+			os.Exit(ExitSetupFailed)
+		}
+
+		link, err := netlink.LinkByName(interfaceName)
+		if err != nil {
+			fmt.Printf("Failed to find link %s: %v\n", interfaceName, err)
+			os.Exit(ExitSetupFailed)
+		}
+
+		fmt.Printf("Adding return route for host WireGuard IP through %s\n", interfaceName)
+
+		// Containers reply straight to the host tunnel address, so the
+		// VM needs to know that address lives behind the WireGuard link.
+		err = netlink.RouteReplace(&netlink.Route{
+			LinkIndex: link.Attrs().Index,
+			Dst:       hostIpNet,
+			Scope:     netlink.SCOPE_LINK,
+		})
+		if err != nil {
+			fmt.Printf("Failed to add return route: %v\n", err)
+			os.Exit(ExitSetupFailed)
+		}
+
+		return
+	}
+
 	fmt.Println("Adding iptables NAT rule for host WireGuard IP")
 
 	// Add iptables NAT rule to translate incoming packet's
@@ -187,3 +312,99 @@ func main() {
 		os.Exit(ExitSetupFailed)
 	}
 }
+
+func runPolicy(interfaceName string) {
+	accessPolicy, err := parseAccessPolicy(os.Getenv("ACCESS_POLICY"))
+	if err != nil {
+		fmt.Printf("ACCESS_POLICY is not valid: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	ipt, err := iptables.New()
+	if err != nil {
+		fmt.Printf("Failed to create new iptables client: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	err = applyAccessPolicy(ipt, interfaceName, accessPolicy)
+	if err != nil {
+		fmt.Printf("Failed to apply access policy: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+}
+
+// runTeardown undoes a setup run: it removes the forwarding chains, the NAT
+// rule, the hosts entry, the routes, the shims and the WireGuard interface.
+// Everything missing is skipped.
+func runTeardown(interfaceName string) {
+	ipt, err := iptables.New()
+	if err != nil {
+		fmt.Printf("Failed to create new iptables client: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	fmt.Println("Removing access policy")
+
+	err = applyAccessPolicy(ipt, interfaceName, nil)
+	if err != nil {
+		fmt.Printf("Failed to remove access policy: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	hostPeerIp := os.Getenv("HOST_PEER_IP")
+	if hostPeerIp != "" {
+		fmt.Println("Removing iptables NAT rule for host WireGuard IP")
+
+		err = ipt.DeleteIfExists(
+			"nat", "POSTROUTING",
+			"-s", hostPeerIp,
+			"-j", "MASQUERADE",
+		)
+		if err != nil {
+			fmt.Printf("Failed to remove iptables nat rule: %v\n", err)
+			os.Exit(ExitSetupFailed)
+		}
+	}
+
+	err = updateHostsEntry("", hostPeerIp)
+	if err != nil {
+		fmt.Printf("Failed to remove hosts entry: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	fmt.Println("Removing routes")
+
+	err = applyVMRoutes(nil)
+	if err != nil {
+		fmt.Printf("Failed to remove routes: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	err = applyRouteForwarding(ipt, interfaceName, nil)
+	if err != nil {
+		fmt.Printf("Failed to remove route forwarding: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	fmt.Println("Removing macvlan and ipvlan shims")
+
+	err = applyShims(nil)
+	if err != nil {
+		fmt.Printf("Failed to remove shims: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	link, err := netlink.LinkByName(interfaceName)
+	if err != nil {
+		// already gone
+		return
+	}
+
+	fmt.Printf("Removing WireGuard interface %s\n", interfaceName)
+
+	err = netlink.LinkDel(link)
+	if err != nil {
+		fmt.Printf("Could not delete link %s: %v\n", interfaceName, err)
+		os.Exit(ExitSetupFailed)
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"github.com/coreos/go-iptables/iptables"
+)
+
+const policyChain = "DOCKER-WIN-NET"
+
+// AccessPolicy mirrors the resolved policy sent by the host in ACCESS_POLICY.
+type AccessPolicy struct {
+	Rules                 []AccessRule `json:"rules"`
+	AllowContainersToHost bool         `json:"allowContainersToHost"`
+	// HostPorts are the host services, containers reach them even when they
+	// may not open other connections to the host.
+	HostPorts []string `json:"hostPorts,omitempty"`
+}
+
+type AccessRule struct {
+	Subnet string   `json:"subnet"`
+	Ports  []string `json:"ports"`
+}
+
+func parseAccessPolicy(value string) (*AccessPolicy, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	policy := &AccessPolicy{}
+	err := json.Unmarshal([]byte(value), policy)
+	if err != nil {
+		return nil, err
+	}
+
+	return policy, nil
+}
+
+// applyAccessPolicy rebuilds the forwarding chain for traffic crossing the
+// WireGuard interface. A nil policy removes the chain and leaves forwarding
+// to Docker's own rules.
+func applyAccessPolicy(ipt *iptables.IPTables, interfaceName string, policy *AccessPolicy) error {
+	jump := []string{"-j", policyChain}
+
+	if policy == nil {
+		fmt.Println("No access policy, removing forwarding chain")
+
+		err := ipt.DeleteIfExists("filter", "FORWARD", jump...)
+		if err != nil {
+			return fmt.Errorf("could not remove jump to %s: %v", policyChain, err)
+		}
+
+		exists, err := ipt.ChainExists("filter", policyChain)
+		if err != nil {
+			return fmt.Errorf("could not check chain %s: %v", policyChain, err)
+		}
+		if !exists {
+			return nil
+		}
+
+		return ipt.ClearAndDeleteChain("filter", policyChain)
+	}
+
+	fmt.Printf("Applying access policy with %d rules\n", len(policy.Rules))
+
+	// ClearChain creates the chain when it is missing
+	err := ipt.ClearChain("filter", policyChain)
+	if err != nil {
+		return fmt.Errorf("could not clear chain %s: %v", policyChain, err)
+	}
+
+	for _, rule := range policyRules(interfaceName, policy) {
+		err = ipt.Append("filter", policyChain, rule...)
+		if err != nil {
+			return fmt.Errorf("could not add rule %s: %v", strings.Join(rule, " "), err)
+		}
+	}
+
+	// Docker appends its own rules to FORWARD, ours go first
+	exists, err := ipt.Exists("filter", "FORWARD", jump...)
+	if err != nil {
+		return fmt.Errorf("could not check jump to %s: %v", policyChain, err)
+	}
+	if !exists {
+		err = ipt.Insert("filter", "FORWARD", 1, jump...)
+		if err != nil {
+			return fmt.Errorf("could not add jump to %s: %v", policyChain, err)
+		}
+	}
+
+	return nil
+}
+
+// policyRules returns the rules of the forwarding chain for policy, in order.
+func policyRules(interfaceName string, policy *AccessPolicy) [][]string {
+	rules := [][]string{
+		{"-i", interfaceName, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+		{"-o", interfaceName, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+	}
+
+	for _, rule := range policy.Rules {
+		if len(rule.Ports) == 0 {
+			rules = append(rules, []string{"-i", interfaceName, "-d", rule.Subnet, "-j", "ACCEPT"})
+			continue
+		}
+
+		for _, port := range rule.Ports {
+			match := append([]string{"-i", interfaceName, "-d", rule.Subnet}, portMatch(port)...)
+			rules = append(rules, append(match, "-j", "ACCEPT"))
+		}
+	}
+
+	rules = append(rules, []string{"-i", interfaceName, "-j", "DROP"})
+	if !policy.AllowContainersToHost {
+		// only the host tunnel address is behind the interface
+		for _, port := range policy.HostPorts {
+			match := append([]string{"-o", interfaceName}, portMatch(port)...)
+			rules = append(rules, append(match, "-j", "ACCEPT"))
+		}
+		rules = append(rules, []string{"-o", interfaceName, "-j", "DROP"})
+	}
+
+	return rules
+}
+
+// portMatch turns a policy port, "80", "8000-8100" or "53/udp", into iptables
+// match arguments.
+func portMatch(port string) []string {
+	proto := "tcp"
+	if i := strings.Index(port, "/"); i >= 0 {
+		port, proto = port[:i], port[i+1:]
+	}
+
+	return []string{"-p", proto, "--dport", strings.Replace(port, "-", ":", 1)}
+}
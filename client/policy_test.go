@@ -0,0 +1,106 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPortMatch(t *testing.T) {
+	tests := []struct {
+		port string
+		want []string
+	}{
+		{port: "80", want: []string{"-p", "tcp", "--dport", "80"}},
+		{port: "8000-8100", want: []string{"-p", "tcp", "--dport", "8000:8100"}},
+		{port: "53/udp", want: []string{"-p", "udp", "--dport", "53"}},
+		{port: "5000-5010/udp", want: []string{"-p", "udp", "--dport", "5000:5010"}},
+	}
+
+	for _, test := range tests {
+		if match := portMatch(test.port); !reflect.DeepEqual(match, test.want) {
+			t.Errorf("portMatch(%q) = %q, want %q", test.port, match, test.want)
+		}
+	}
+}
+
+func TestParseAccessPolicy(t *testing.T) {
+	policy, err := parseAccessPolicy("")
+	if err != nil || policy != nil {
+		t.Errorf("parseAccessPolicy(\"\") = %v, %v, want no policy", policy, err)
+	}
+
+	policy, err = parseAccessPolicy(`{"rules":[{"subnet":"172.18.0.0/16","ports":["80"]}],"hostPorts":["5432"]}`)
+	if err != nil {
+		t.Fatalf("parseAccessPolicy failed: %v", err)
+	}
+	want := &AccessPolicy{
+		Rules:     []AccessRule{{Subnet: "172.18.0.0/16", Ports: []string{"80"}}},
+		HostPorts: []string{"5432"},
+	}
+	if !reflect.DeepEqual(policy, want) {
+		t.Errorf("parseAccessPolicy = %+v, want %+v", policy, want)
+	}
+
+	_, err = parseAccessPolicy(`{"rules":`)
+	if err == nil {
+		t.Error("parseAccessPolicy succeeded for invalid JSON")
+	}
+}
+
+func TestPolicyRules(t *testing.T) {
+	established := [][]string{
+		{"-i", "wg0", "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+		{"-o", "wg0", "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+	}
+
+	tests := []struct {
+		name   string
+		policy *AccessPolicy
+		want   [][]string
+	}{
+		{
+			name:   "deny all",
+			policy: &AccessPolicy{},
+			want: [][]string{
+				{"-i", "wg0", "-j", "DROP"},
+				{"-o", "wg0", "-j", "DROP"},
+			},
+		},
+		{
+			name: "subnets and ports",
+			policy: &AccessPolicy{
+				Rules: []AccessRule{
+					{Subnet: "172.18.0.0/16"},
+					{Subnet: "172.19.0.0/16", Ports: []string{"80", "53/udp"}},
+				},
+				AllowContainersToHost: true,
+			},
+			want: [][]string{
+				{"-i", "wg0", "-d", "172.18.0.0/16", "-j", "ACCEPT"},
+				{"-i", "wg0", "-d", "172.19.0.0/16", "-p", "tcp", "--dport", "80", "-j", "ACCEPT"},
+				{"-i", "wg0", "-d", "172.19.0.0/16", "-p", "udp", "--dport", "53", "-j", "ACCEPT"},
+				{"-i", "wg0", "-j", "DROP"},
+			},
+		},
+		{
+			name:   "host services",
+			policy: &AccessPolicy{HostPorts: []string{"5432/tcp", "8000-8100"}},
+			want: [][]string{
+				{"-i", "wg0", "-j", "DROP"},
+				{"-o", "wg0", "-p", "tcp", "--dport", "5432", "-j", "ACCEPT"},
+				{"-o", "wg0", "-p", "tcp", "--dport", "8000:8100", "-j", "ACCEPT"},
+				{"-o", "wg0", "-j", "DROP"},
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rules := policyRules("wg0", test.policy)
+			want := append(append([][]string{}, established...), test.want...)
+			if !reflect.DeepEqual(rules, want) {
+				t.Errorf("policyRules =\n%q\nwant\n%q", rules, want)
+			}
+		})
+	}
+}
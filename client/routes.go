@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/coreos/go-iptables/iptables"
+	"github.com/vishvananda/netlink"
+)
+
+const routesChain = "DOCKER-WIN-NET-ROUTES"
+
+// routeProtocol marks the routes added for VM_ROUTES, so the next run can
+// find and remove those no longer wanted.
+const routeProtocol = netlink.RouteProtocol(0x57)
+
+// VMRoute mirrors a route sent by the host in VM_ROUTES. Subnet is reached
+// through Via, or straight from the VM when Via is empty.
+type VMRoute struct {
+	Subnet string `json:"subnet"`
+	Via    string `json:"via,omitempty"`
+}
+
+func parseVMRoutes(value string) ([]VMRoute, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var routes []VMRoute
+	err := json.Unmarshal([]byte(value), &routes)
+	if err != nil {
+		return nil, err
+	}
+
+	return routes, nil
+}
+
+func runRoutes(interfaceName string) {
+	routes, err := parseVMRoutes(os.Getenv("VM_ROUTES"))
+	if err != nil {
+		fmt.Printf("VM_ROUTES is not valid: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	err = applyVMRoutes(routes)
+	if err != nil {
+		fmt.Printf("Failed to apply routes: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	ipt, err := iptables.New()
+	if err != nil {
+		fmt.Printf("Failed to create new iptables client: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	err = applyRouteForwarding(ipt, interfaceName, routes)
+	if err != nil {
+		fmt.Printf("Failed to apply route forwarding: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+}
+
+// applyVMRoutes adds a route for every entry with a gateway and removes the
+// routes of earlier runs that are no longer listed. Gateways that are
+// addresses of the VM itself need no route, the subnet is local already.
+func applyVMRoutes(routes []VMRoute) error {
+	local, err := localAddresses()
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[string]bool)
+	for _, route := range routes {
+		if route.Via == "" {
+			continue
+		}
+
+		gateway := net.ParseIP(route.Via)
+		if gateway == nil {
+			return fmt.Errorf("invalid gateway %s", route.Via)
+		}
+		if local[gateway.String()] {
+			fmt.Printf("Skipping route for %s, %s is local\n", route.Subnet, route.Via)
+			continue
+		}
+
+		dst, err := netlink.ParseIPNet(route.Subnet)
+		if err != nil {
+			return fmt.Errorf("invalid subnet %s: %v", route.Subnet, err)
+		}
+
+		fmt.Printf("Routing %s via %s\n", dst, gateway)
+
+		err = netlink.RouteReplace(&netlink.Route{
+			Dst:      dst,
+			Gw:       gateway,
+			Protocol: routeProtocol,
+		})
+		if err != nil {
+			return fmt.Errorf("could not add route for %s: %v", dst, err)
+		}
+		wanted[dst.String()] = true
+	}
+
+	existing, err := netlink.RouteListFiltered(netlink.FAMILY_V4, &netlink.Route{Protocol: routeProtocol}, netlink.RT_FILTER_PROTOCOL)
+	if err != nil {
+		return fmt.Errorf("could not list routes: %v", err)
+	}
+
+	for _, route := range existing {
+		if route.Dst == nil || wanted[route.Dst.String()] {
+			continue
+		}
+
+		fmt.Printf("Removing route for %s\n", route.Dst)
+
+		err = netlink.RouteDel(&route)
+		if err != nil && err != syscall.ESRCH {
+			return fmt.Errorf("could not remove route for %s: %v", route.Dst, err)
+		}
+	}
+
+	return nil
+}
+
+// applyRouteForwarding lets traffic from the tunnel through to the routed
+// ranges and their replies back, for VMs that drop forwarded packets by
+// default. The chain is appended to FORWARD, after Docker's rules and the
+// access policy. A policy drops everything from the tunnel it doesn't list,
+// so with one the ranges have to be listed as policy subnets. No routes
+// remove the chain.
+func applyRouteForwarding(ipt *iptables.IPTables, interfaceName string, routes []VMRoute) error {
+	jump := []string{"-j", routesChain}
+
+	if len(routes) == 0 {
+		err := ipt.DeleteIfExists("filter", "FORWARD", jump...)
+		if err != nil {
+			return fmt.Errorf("could not remove jump to %s: %v", routesChain, err)
+		}
+
+		exists, err := ipt.ChainExists("filter", routesChain)
+		if err != nil {
+			return fmt.Errorf("could not check chain %s: %v", routesChain, err)
+		}
+		if !exists {
+			return nil
+		}
+
+		return ipt.ClearAndDeleteChain("filter", routesChain)
+	}
+
+	fmt.Printf("Forwarding %d routed ranges\n", len(routes))
+
+	// ClearChain creates the chain when it is missing
+	err := ipt.ClearChain("filter", routesChain)
+	if err != nil {
+		return fmt.Errorf("could not clear chain %s: %v", routesChain, err)
+	}
+
+	for _, rule := range routeForwardingRules(interfaceName, routes) {
+		err = ipt.Append("filter", routesChain, rule...)
+		if err != nil {
+			return fmt.Errorf("could not add rule %v: %v", rule, err)
+		}
+	}
+
+	return ipt.AppendUnique("filter", "FORWARD", jump...)
+}
+
+func routeForwardingRules(interfaceName string, routes []VMRoute) [][]string {
+	var rules [][]string
+	for _, route := range routes {
+		rules = append(rules,
+			[]string{"-i", interfaceName, "-d", route.Subnet, "-j", "ACCEPT"},
+			[]string{"-o", interfaceName, "-s", route.Subnet, "-m", "conntrack", "--ctstate", "ESTABLISHED,RELATED", "-j", "ACCEPT"},
+		)
+	}
+
+	return rules
+}
+
+func localAddresses() (map[string]bool, error) {
+	addrs, err := netlink.AddrList(nil, netlink.FAMILY_V4)
+	if err != nil {
+		return nil, fmt.Errorf("could not list addresses: %v", err)
+	}
+
+	local := make(map[string]bool)
+	for _, addr := range addrs {
+		local[addr.IP.String()] = true
+	}
+
+	return local, nil
+}
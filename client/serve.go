@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// runServe answers every HTTP request with SELFTEST_TOKEN, it is the responder
+// the selftest command fetches from through the tunnel.
+func runServe() {
+	token := os.Getenv("SELFTEST_TOKEN")
+
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = fmt.Fprint(w, token)
+	})
+
+	fmt.Println("Serving the selftest token on :8080")
+
+	err := http.ListenAndServe(":8080", nil)
+	if err != nil {
+		fmt.Printf("Failed to serve: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+}
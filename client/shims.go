@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/vishvananda/netlink"
+)
+
+// shimPrefix names the shim links, the rest of the name is the start of the
+// network ID. Link names are limited to 15 characters.
+const shimPrefix = "dws-"
+
+// ShimNetwork mirrors a macvlan or ipvlan network sent by the host in
+// SHIM_NETWORKS. The VM can't reach the children of a macvlan or ipvlan
+// parent directly, a child of its own, the shim, with Address on it can.
+type ShimNetwork struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Driver  string `json:"driver"`
+	Mode    string `json:"mode,omitempty"`
+	Parent  string `json:"parent"`
+	Subnet  string `json:"subnet"`
+	Address string `json:"address"`
+}
+
+func (s ShimNetwork) linkName() string {
+	id := s.ID
+	if len(id) > 15-len(shimPrefix) {
+		id = id[:15-len(shimPrefix)]
+	}
+
+	return shimPrefix + id
+}
+
+func parseShimNetworks(value string) ([]ShimNetwork, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var shims []ShimNetwork
+	err := json.Unmarshal([]byte(value), &shims)
+	if err != nil {
+		return nil, err
+	}
+
+	return shims, nil
+}
+
+func runShims() {
+	shims, err := parseShimNetworks(os.Getenv("SHIM_NETWORKS"))
+	if err != nil {
+		fmt.Printf("SHIM_NETWORKS is not valid: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+
+	err = applyShims(shims)
+	if err != nil {
+		fmt.Printf("Failed to apply shims: %v\n", err)
+		os.Exit(ExitSetupFailed)
+	}
+}
+
+// applyShims creates a shim for every network that has none and removes the
+// shims of networks no longer listed. A network whose parent is missing is
+// skipped, the others are still set up.
+func applyShims(shims []ShimNetwork) error {
+	wanted := make(map[string]bool)
+	var failed []string
+	for _, shim := range shims {
+		wanted[shim.linkName()] = true
+
+		err := applyShim(shim)
+		if err != nil {
+			fmt.Printf("Failed to set up shim for %s: %v\n", shim.Name, err)
+			failed = append(failed, shim.Name)
+		}
+	}
+
+	links, err := netlink.LinkList()
+	if err != nil {
+		return fmt.Errorf("could not list links: %v", err)
+	}
+
+	for _, link := range links {
+		name := link.Attrs().Name
+		if !strings.HasPrefix(name, shimPrefix) || wanted[name] {
+			continue
+		}
+
+		fmt.Printf("Removing shim %s\n", name)
+
+		err = netlink.LinkDel(link)
+		if err != nil {
+			return fmt.Errorf("could not delete link %s: %v", name, err)
+		}
+	}
+
+	if len(failed) > 0 {
+		return fmt.Errorf("no shim for %s", strings.Join(failed, ", "))
+	}
+
+	return nil
+}
+
+// applyShim creates the shim of a network, or recreates it when its parent,
+// driver or mode changed, and leaves only the shim address and the route to
+// the subnet on it.
+func applyShim(shim ShimNetwork) error {
+	name := shim.linkName()
+
+	parent, err := netlink.LinkByName(shim.Parent)
+	if err != nil {
+		return fmt.Errorf("could not find parent %s: %v", shim.Parent, err)
+	}
+
+	wanted, err := newShimLink(shim, name, parent.Attrs().Index)
+	if err != nil {
+		return err
+	}
+
+	link, err := netlink.LinkByName(name)
+	if err == nil && !shimLinkMatches(link, wanted) {
+		fmt.Printf("Recreating shim %s for %s, its parent or mode changed\n", name, shim.Name)
+
+		err = netlink.LinkDel(link)
+		if err != nil {
+			return fmt.Errorf("could not delete link %s: %v", name, err)
+		}
+		link = nil
+	}
+	if link == nil {
+		fmt.Printf("Creating %s shim %s on %s for %s\n", shim.Driver, name, shim.Parent, shim.Name)
+
+		err = netlink.LinkAdd(wanted)
+		if err != nil {
+			return fmt.Errorf("could not add link %s: %v", name, err)
+		}
+		link = wanted
+	}
+
+	address, err := netlink.ParseAddr(shim.Address + "/32")
+	if err != nil {
+		return fmt.Errorf("invalid shim address %s: %v", shim.Address, err)
+	}
+
+	err = netlink.AddrReplace(link, address)
+	if err != nil {
+		return fmt.Errorf("could not assign %s to %s: %v", shim.Address, name, err)
+	}
+
+	// the address of a previous aux-address would answer for a container
+	addrs, err := netlink.AddrList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("could not list addresses of %s: %v", name, err)
+	}
+	for _, addr := range addrs {
+		if addr.IP.Equal(address.IP) {
+			continue
+		}
+
+		err = netlink.AddrDel(link, &addr)
+		if err != nil {
+			return fmt.Errorf("could not remove %s from %s: %v", addr.IP, name, err)
+		}
+	}
+
+	err = netlink.LinkSetUp(link)
+	if err != nil {
+		return fmt.Errorf("could not set %s up: %v", name, err)
+	}
+
+	dst, err := netlink.ParseIPNet(shim.Subnet)
+	if err != nil {
+		return fmt.Errorf("invalid subnet %s: %v", shim.Subnet, err)
+	}
+
+	// the containers are reached through the shim, not the parent
+	err = netlink.RouteReplace(&netlink.Route{
+		LinkIndex: link.Attrs().Index,
+		Dst:       dst,
+		Src:       address.IP,
+		Scope:     netlink.SCOPE_LINK,
+	})
+	if err != nil {
+		return fmt.Errorf("could not route %s through %s: %v", shim.Subnet, name, err)
+	}
+
+	// a subnet or IP range that changed leaves the previous route behind
+	routes, err := netlink.RouteList(link, netlink.FAMILY_V4)
+	if err != nil {
+		return fmt.Errorf("could not list routes of %s: %v", name, err)
+	}
+	for _, route := range routes {
+		if route.Dst == nil || route.Dst.String() == dst.String() {
+			continue
+		}
+
+		err = netlink.RouteDel(&route)
+		if err != nil {
+			return fmt.Errorf("could not remove route %s from %s: %v", route.Dst, name, err)
+		}
+	}
+
+	return nil
+}
+
+// shimLinkMatches reports whether an existing shim link has the parent,
+// driver and mode of the wanted one. The kernel can't change them in place.
+func shimLinkMatches(link, wanted netlink.Link) bool {
+	if link.Type() != wanted.Type() || link.Attrs().ParentIndex != wanted.Attrs().ParentIndex {
+		return false
+	}
+
+	switch wanted := wanted.(type) {
+	case *netlink.Macvlan:
+		existing, ok := link.(*netlink.Macvlan)
+		return ok && existing.Mode == wanted.Mode
+	case *netlink.IPVlan:
+		existing, ok := link.(*netlink.IPVlan)
+		return ok && existing.Mode == wanted.Mode
+	}
+
+	return true
+}
+
+func newShimLink(shim ShimNetwork, name string, parentIndex int) (netlink.Link, error) {
+	attrs := netlink.NewLinkAttrs()
+	attrs.Name = name
+	attrs.ParentIndex = parentIndex
+
+	switch shim.Driver {
+	case "macvlan":
+		// a private shim couldn't reach its siblings
+		modes := map[string]netlink.MacvlanMode{
+			"":       netlink.MACVLAN_MODE_BRIDGE,
+			"bridge": netlink.MACVLAN_MODE_BRIDGE,
+			"vepa":   netlink.MACVLAN_MODE_VEPA,
+		}
+		mode, ok := modes[shim.Mode]
+		if !ok {
+			return nil, fmt.Errorf("unsupported macvlan mode %s", shim.Mode)
+		}
+
+		return &netlink.Macvlan{LinkAttrs: attrs, Mode: mode}, nil
+	case "ipvlan":
+		modes := map[string]netlink.IPVlanMode{
+			"":    netlink.IPVLAN_MODE_L2,
+			"l2":  netlink.IPVLAN_MODE_L2,
+			"l3":  netlink.IPVLAN_MODE_L3,
+			"l3s": netlink.IPVLAN_MODE_L3S,
+		}
+		mode, ok := modes[shim.Mode]
+		if !ok {
+			return nil, fmt.Errorf("unsupported ipvlan mode %s", shim.Mode)
+		}
+
+		return &netlink.IPVlan{LinkAttrs: attrs, Mode: mode}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported driver %s", shim.Driver)
+}
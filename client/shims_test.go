@@ -0,0 +1,33 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/vishvananda/netlink"
+)
+
+func TestShimLinkMatches(t *testing.T) {
+	attrs := func(parentIndex int) netlink.LinkAttrs {
+		return netlink.LinkAttrs{Name: "dws-0123456789a", ParentIndex: parentIndex}
+	}
+	wanted := &netlink.Macvlan{LinkAttrs: attrs(2), Mode: netlink.MACVLAN_MODE_BRIDGE}
+
+	tests := []struct {
+		name string
+		link netlink.Link
+		want bool
+	}{
+		{name: "same", link: &netlink.Macvlan{LinkAttrs: attrs(2), Mode: netlink.MACVLAN_MODE_BRIDGE}, want: true},
+		{name: "other parent", link: &netlink.Macvlan{LinkAttrs: attrs(3), Mode: netlink.MACVLAN_MODE_BRIDGE}},
+		{name: "other mode", link: &netlink.Macvlan{LinkAttrs: attrs(2), Mode: netlink.MACVLAN_MODE_VEPA}},
+		{name: "other driver", link: &netlink.IPVlan{LinkAttrs: attrs(2), Mode: netlink.IPVLAN_MODE_L2}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := shimLinkMatches(test.link, wanted); got != test.want {
+				t.Errorf("shimLinkMatches = %t, want %t", got, test.want)
+			}
+		})
+	}
+}
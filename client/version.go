@@ -0,0 +1,7 @@
+package main
+
+// helperVersion is the version of the helper built from this directory. The
+// image is tagged with it and labeled with it, the host pins the same value in
+// helperVersion and pulls the image again when the label doesn't match. Bump
+// both whenever a MODE or a variable changes.
+const helperVersion = "2"
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+// Config is read from a JSON file placed next to the executable. Every field
+// is optional, a missing file gives the defaults. The top level holds the
+// default profile, usually Docker Desktop.
+type Config struct {
+	Profile
+	// Profiles are further Docker engines connected at the same time.
+	Profiles []Profile `json:"profiles"`
+	// PeerPool is the range tunnel peer addresses are picked from when a
+	// profile doesn't set them.
+	PeerPool string `json:"peerPool"`
+	// MetricsListen enables the Prometheus endpoint on this loopback address,
+	// like "127.0.0.1:9469".
+	MetricsListen string    `json:"metricsListen"`
+	Log           LogConfig `json:"log"`
+	// KeepKeysOnPause reuses the tunnel keys and addresses when the service
+	// continues, by default they are generated and allocated again.
+	KeepKeysOnPause bool `json:"keepKeysOnPause"`
+}
+
+type LogConfig struct {
+	// Level is one of debug, info, warning and error, info by default.
+	Level string `json:"level"`
+	// File is the JSON log file, next to the executable by default, "off"
+	// disables it.
+	File      string `json:"file"`
+	MaxSizeMB int    `json:"maxSizeMB"`
+	MaxFiles  int    `json:"maxFiles"`
+}
+
+func NewConfig() *Config {
+	return &Config{}
+}
+
+func getConfigPath(name string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", errors.New("failed to get executable path: " + err.Error())
+	}
+
+	return filepath.Join(filepath.Dir(exe), name+".json"), nil
+}
+
+// loadConfig reads the config of the named service.
+func loadConfig(name string) (*Config, error) {
+	configPath, err := getConfigPath(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return LoadConfig(configPath)
+}
+
+func LoadConfig(path string) (*Config, error) {
+	config := NewConfig()
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, errors.New("failed to read config: " + err.Error())
+	}
+
+	err = json.Unmarshal(data, config)
+	if err != nil {
+		return nil, errors.New("failed to parse config: " + err.Error())
+	}
+
+	err = config.Validate()
+	if err != nil {
+		return nil, errors.New("invalid config: " + err.Error())
+	}
+
+	return config, nil
+}
+
+// GetProfiles returns the default profile followed by the listed ones, with
+// defaults applied.
+func (c *Config) GetProfiles() []*Profile {
+	profiles := []*Profile{c.Profile.withDefaults(0)}
+	for i, profile := range c.Profiles {
+		profiles = append(profiles, profile.withDefaults(i+1))
+	}
+
+	return profiles
+}
+
+// GetProfile returns the named profile, the default one when name is empty.
+func (c *Config) GetProfile(name string) (*Profile, error) {
+	if name == "" {
+		name = defaultProfileName
+	}
+
+	for _, profile := range c.GetProfiles() {
+		if profile.Name == name {
+			return profile, nil
+		}
+	}
+
+	return nil, errors.New("unknown profile " + name)
+}
+
+func (c *Config) Validate() error {
+	_, err := ParseLevel(c.Log.Level)
+	if err != nil {
+		return err
+	}
+
+	if c.MetricsListen != "" {
+		err = validateMetricsListen(c.MetricsListen)
+		if err != nil {
+			return fmt.Errorf("invalid metrics address %s: %w", c.MetricsListen, err)
+		}
+	}
+
+	if c.PeerPool != "" {
+		_, pool, err := net.ParseCIDR(c.PeerPool)
+		if err != nil || pool.IP.To4() == nil {
+			return fmt.Errorf("invalid peer pool %s", c.PeerPool)
+		}
+		if ones, _ := pool.Mask.Size(); ones > 30 {
+			return fmt.Errorf("peer pool %s is smaller than a /30", c.PeerPool)
+		}
+	}
+
+	for i, profile := range c.Profiles {
+		if profile.Name == "" || profile.Name == defaultProfileName {
+			return fmt.Errorf("profile %d needs a name other than %q", i+1, defaultProfileName)
+		}
+	}
+
+	names := make(map[string]bool)
+	interfaces := make(map[string]bool)
+	ports := make(map[int]bool)
+	ips := make(map[string]bool)
+	for _, profile := range c.GetProfiles() {
+		err := profile.Validate()
+		if err != nil {
+			return fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+
+		if names[profile.Name] {
+			return fmt.Errorf("profile %s is defined twice", profile.Name)
+		}
+		names[profile.Name] = true
+
+		if interfaces[profile.InterfaceName] {
+			return fmt.Errorf("profile %s: interface %s is already used", profile.Name, profile.InterfaceName)
+		}
+		interfaces[profile.InterfaceName] = true
+
+		if profile.Port != 0 && ports[profile.Port] {
+			return fmt.Errorf("profile %s: port %d is already used", profile.Name, profile.Port)
+		}
+		ports[profile.Port] = true
+
+		for _, ip := range []string{profile.HostPeerIp, profile.VmPeerIp} {
+			if ip != "" && ips[ip] {
+				return fmt.Errorf("profile %s: peer IP %s is already used", profile.Name, ip)
+			}
+			ips[ip] = true
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadConfig(t *testing.T) {
+	tests := []struct {
+		name                 string
+		data                 string
+		wantPreserveSourceIp bool
+		wantErr              bool
+	}{
+		{name: "missing file"},
+		{name: "empty object", data: "{}"},
+		{name: "preserve source IP", data: `{"preserveSourceIp": true}`, wantPreserveSourceIp: true},
+		{name: "unknown fields", data: `{"somethingElse": 1}`},
+		{name: "invalid JSON", data: `{"preserveSourceIp": `, wantErr: true},
+		{name: "wrong type", data: `{"preserveSourceIp": "yes"}`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config.json")
+			if test.data != "" {
+				err := os.WriteFile(path, []byte(test.data), 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			config, err := LoadConfig(path)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("LoadConfig = %+v, want an error", config)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("LoadConfig failed: %v", err)
+			}
+			if config.PreserveSourceIp != test.wantPreserveSourceIp {
+				t.Errorf("PreserveSourceIp = %t, want %t", config.PreserveSourceIp, test.wantPreserveSourceIp)
+			}
+		})
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		config  Config
+		wantErr bool
+	}{
+		{name: "defaults"},
+		{
+			name: "several profiles",
+			config: Config{Profiles: []Profile{
+				{Name: "podman", DockerHost: "npipe:////./pipe/podman-machine-default"},
+				{Name: "devbox", DockerHost: "tcp://devbox:2376"},
+			}},
+		},
+		{name: "unnamed profile", config: Config{Profiles: []Profile{{DockerHost: "tcp://devbox:2376"}}}, wantErr: true},
+		{name: "profile named default", config: Config{Profiles: []Profile{{Name: defaultProfileName}}}, wantErr: true},
+		{name: "same name", config: Config{Profiles: []Profile{{Name: "podman"}, {Name: "podman"}}}, wantErr: true},
+		{
+			name:    "same interface",
+			config:  Config{Profiles: []Profile{{Name: "podman", InterfaceName: "docker-win-net-connect"}}},
+			wantErr: true,
+		},
+		{
+			name:    "same port",
+			config:  Config{Profile: Profile{Port: 2040}, Profiles: []Profile{{Name: "podman", Port: 2040}}},
+			wantErr: true,
+		},
+		{
+			name: "same peer IP",
+			config: Config{
+				Profile:  Profile{HostPeerIp: "10.20.40.1", VmPeerIp: "10.20.40.2"},
+				Profiles: []Profile{{Name: "podman", HostPeerIp: "10.20.41.1", VmPeerIp: "10.20.40.2"}},
+			},
+			wantErr: true,
+		},
+		{
+			name:    "invalid peer IP",
+			config:  Config{Profile: Profile{HostPeerIp: "10.20.40", VmPeerIp: "10.20.40.2"}},
+			wantErr: true,
+		},
+		{
+			name:    "interface name too long",
+			config:  Config{Profiles: []Profile{{Name: "a-profile-with-a-rather-long-name"}}},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.config.Validate()
+			if (err != nil) != test.wantErr {
+				t.Errorf("Validate = %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestConfigGetProfiles(t *testing.T) {
+	config := &Config{Profiles: []Profile{
+		{Name: "podman"},
+		{Name: "devbox", InterfaceName: "devbox"},
+	}}
+
+	want := [][2]string{
+		{defaultProfileName, "docker-win-net-connect"},
+		{"podman", "dwnc-podman"},
+		{"devbox", "devbox"},
+	}
+
+	profiles := config.GetProfiles()
+	if len(profiles) != len(want) {
+		t.Fatalf("GetProfiles returned %d profiles, want %d", len(profiles), len(want))
+	}
+	for i, profile := range profiles {
+		if profile.Name != want[i][0] || profile.InterfaceName != want[i][1] {
+			t.Errorf("profile %d = %s on %s, want %s on %s", i, profile.Name, profile.InterfaceName, want[i][0], want[i][1])
+		}
+	}
+}
+
+func TestConfigGetProfile(t *testing.T) {
+	config := &Config{Profiles: []Profile{{Name: "podman"}}}
+
+	tests := []struct {
+		name     string
+		wantName string
+		wantErr  bool
+	}{
+		{name: "", wantName: defaultProfileName},
+		{name: defaultProfileName, wantName: defaultProfileName},
+		{name: "podman", wantName: "podman"},
+		{name: "devbox", wantErr: true},
+	}
+
+	for _, test := range tests {
+		profile, err := config.GetProfile(test.name)
+		if test.wantErr {
+			if err == nil {
+				t.Errorf("GetProfile(%q) = %s, want an error", test.name, profile.Name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("GetProfile(%q) failed: %v", test.name, err)
+		} else if profile.Name != test.wantName {
+			t.Errorf("GetProfile(%q) = %s, want %s", test.name, profile.Name, test.wantName)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// NetworkStatus is a routed Docker network as reported by the control API.
+type NetworkStatus struct {
+	Profile string   `json:"profile"`
+	ID      string   `json:"id"`
+	Name    string   `json:"name"`
+	Driver  string   `json:"driver"`
+	Subnets []string `json:"subnets"`
+}
+
+type controlError struct {
+	Error string `json:"error"`
+}
+
+// ControlServer serves the local control API on a named pipe on Windows and a
+// Unix socket elsewhere, only reachable by administrators.
+type ControlServer struct {
+	supervisor *Supervisor
+	listener   net.Listener
+	server     *http.Server
+}
+
+func NewControlServer(name string, supervisor *Supervisor) (*ControlServer, error) {
+	listener, err := listenControl(name)
+	if err != nil {
+		return nil, errors.New("failed to listen for control requests: " + err.Error())
+	}
+
+	c := &ControlServer{
+		supervisor: supervisor,
+		listener:   listener,
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", c.handle(http.MethodGet, c.status))
+	mux.HandleFunc("/networks", c.handle(http.MethodGet, c.networks))
+	mux.HandleFunc("/reconcile", c.handle(http.MethodPost, c.reconcile))
+	mux.HandleFunc("/reprovision", c.handle(http.MethodPost, c.reprovision))
+	mux.HandleFunc("/reload", c.handle(http.MethodPost, c.reload))
+	c.server = &http.Server{Handler: mux}
+
+	return c, nil
+}
+
+func (c *ControlServer) Serve() {
+	err := c.server.Serve(c.listener)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error(EventControlAPIFailed, "Control API stopped", "error", err)
+	}
+}
+
+func (c *ControlServer) Close() error {
+	return c.server.Close()
+}
+
+func (c *ControlServer) handle(method string, f func(r *http.Request) (any, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		result, err := f(r)
+		if err != nil {
+			w.WriteHeader(http.StatusInternalServerError)
+			_ = json.NewEncoder(w).Encode(controlError{Error: err.Error()})
+			return
+		}
+
+		_ = json.NewEncoder(w).Encode(result)
+	}
+}
+
+func (c *ControlServer) status(r *http.Request) (any, error) {
+	return c.supervisor.Status(), nil
+}
+
+func (c *ControlServer) networks(r *http.Request) (any, error) {
+	statuses := []NetworkStatus{}
+	err := c.supervisor.forEach(r.URL.Query().Get("profile"), func(runner *ProfileRunner) error {
+		networks, err := runner.Networks()
+		if err != nil {
+			return err
+		}
+
+		for _, network := range networks {
+			status := NetworkStatus{
+				Profile: runner.profile.Name,
+				ID:      network.ID,
+				Name:    network.Name,
+				Driver:  network.Driver,
+			}
+			for _, config := range network.IPAM.Config {
+				status.Subnets = append(status.Subnets, config.Subnet)
+			}
+			statuses = append(statuses, status)
+		}
+
+		return nil
+	})
+
+	return statuses, err
+}
+
+func (c *ControlServer) reconcile(r *http.Request) (any, error) {
+	return struct{}{}, c.supervisor.forEach(r.URL.Query().Get("profile"), (*ProfileRunner).Reconcile)
+}
+
+func (c *ControlServer) reprovision(r *http.Request) (any, error) {
+	return struct{}{}, c.supervisor.forEach(r.URL.Query().Get("profile"), (*ProfileRunner).Reprovision)
+}
+
+func (c *ControlServer) reload(r *http.Request) (any, error) {
+	return struct{}{}, c.supervisor.Reload()
+}
+
+// ControlClient talks to the control API of the running service.
+type ControlClient struct {
+	http *http.Client
+}
+
+func NewControlClient(name string) *ControlClient {
+	return &ControlClient{
+		http: &http.Client{
+			Timeout: 2 * time.Minute,
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return dialControl(ctx, name)
+				},
+			},
+		},
+	}
+}
+
+func (c *ControlClient) call(method, path, profile string, result any) error {
+	u := url.URL{Scheme: "http", Host: "service", Path: path}
+	if profile != "" {
+		u.RawQuery = url.Values{"profile": {profile}}.Encode()
+	}
+
+	req, err := http.NewRequest(method, u.String(), nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return errors.New("service is not reachable: " + err.Error())
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e controlError
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return errors.New(e.Error)
+		}
+		return fmt.Errorf("control request failed with status %s", resp.Status)
+	}
+
+	if result == nil {
+		return nil
+	}
+
+	return json.Unmarshal(body, result)
+}
+
+func (c *ControlClient) Status() ([]ProfileStatus, error) {
+	var statuses []ProfileStatus
+	err := c.call(http.MethodGet, "/status", "", &statuses)
+
+	return statuses, err
+}
+
+func (c *ControlClient) Networks(profile string) ([]NetworkStatus, error) {
+	var networks []NetworkStatus
+	err := c.call(http.MethodGet, "/networks", profile, &networks)
+
+	return networks, err
+}
+
+func (c *ControlClient) Reconcile(profile string) error {
+	return c.call(http.MethodPost, "/reconcile", profile, nil)
+}
+
+func (c *ControlClient) Reprovision(profile string) error {
+	return c.call(http.MethodPost, "/reprovision", profile, nil)
+}
+
+func (c *ControlClient) Reload() error {
+	return c.call(http.MethodPost, "/reload", "", nil)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func newTestControlClient(t *testing.T, handler http.Handler) *ControlClient {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	return &ControlClient{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					var dialer net.Dialer
+					return dialer.DialContext(ctx, "tcp", server.Listener.Addr().String())
+				},
+			},
+		},
+	}
+}
+
+func TestControlHandle(t *testing.T) {
+	c := &ControlServer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/value", c.handle(http.MethodGet, func(r *http.Request) (any, error) {
+		return []string{r.URL.Query().Get("profile")}, nil
+	}))
+	mux.HandleFunc("/fail", c.handle(http.MethodPost, func(r *http.Request) (any, error) {
+		return nil, errors.New("unknown profile podman")
+	}))
+	client := newTestControlClient(t, mux)
+
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		profile string
+		want    string
+		wantErr string
+	}{
+		{name: "result", method: http.MethodGet, path: "/value", profile: "podman", want: "podman"},
+		{name: "error", method: http.MethodPost, path: "/fail", wantErr: "unknown profile podman"},
+		{name: "wrong method", method: http.MethodPost, path: "/value", wantErr: "control request failed with status 405 Method Not Allowed"},
+		{name: "unknown path", method: http.MethodGet, path: "/missing", wantErr: "control request failed with status 404 Not Found"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var result []string
+			err := client.call(test.method, test.path, test.profile, &result)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Errorf("call = %v, want error %q", err, test.wantErr)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("call failed: %v", err)
+			}
+			if len(result) != 1 || result[0] != test.want {
+				t.Errorf("call = %q, want [%q]", result, test.want)
+			}
+		})
+	}
+}
+
+func TestControlClientUnreachable(t *testing.T) {
+	client := &ControlClient{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					return nil, errors.New("pipe not found")
+				},
+			},
+		},
+	}
+
+	err := client.Reconcile("")
+	if err == nil {
+		t.Fatal("Reconcile succeeded without a service")
+	}
+}
@@ -0,0 +1,40 @@
+//go:build !windows
+
+package main
+
+import (
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+)
+
+func getControlSocket(name string) string {
+	return filepath.Join("/run", name+".sock")
+}
+
+func listenControl(name string) (net.Listener, error) {
+	path := getControlSocket(name)
+
+	// a socket left behind by a crashed service blocks listening
+	_ = os.Remove(path)
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+
+	err = os.Chmod(path, 0600)
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+
+	return listener, nil
+}
+
+func dialControl(ctx context.Context, name string) (net.Conn, error) {
+	var dialer net.Dialer
+
+	return dialer.DialContext(ctx, "unix", getControlSocket(name))
+}
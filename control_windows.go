@@ -0,0 +1,24 @@
+package main
+
+import (
+	"context"
+	"github.com/Microsoft/go-winio"
+	"net"
+)
+
+// controlPipeSecurity limits the pipe to SYSTEM and the Administrators group.
+const controlPipeSecurity = "D:P(A;;GA;;;SY)(A;;GA;;;BA)"
+
+func getControlPipe(name string) string {
+	return `\\.\pipe\` + name
+}
+
+func listenControl(name string) (net.Listener, error) {
+	return winio.ListenPipe(getControlPipe(name), &winio.PipeConfig{
+		SecurityDescriptor: controlPipeSecurity,
+	})
+}
+
+func dialControl(ctx context.Context, name string) (net.Conn, error) {
+	return winio.DialPipeContext(ctx, getControlPipe(name))
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"errors"
+	"golang.org/x/sys/windows"
+	"os"
+	"path/filepath"
+)
+
+// dataDirSddl makes Administrators the owner and gives only SYSTEM and
+// Administrators access, inherited by everything created inside.
+const dataDirSddl = "O:BAD:P(A;OICI;FA;;;SY)(A;OICI;FA;;;BA)"
+
+// getDataDir returns the directory holding the extracted WireGuard binaries
+// and the tunnel configs, under ProgramData rather than next to the executable
+// which may live in a folder users can write to.
+func getDataDir(name string) string {
+	programData := os.Getenv("ProgramData")
+	if programData == "" {
+		programData = `C:\ProgramData`
+	}
+
+	return filepath.Join(programData, name)
+}
+
+// prepareDataDir creates the data directory and locks it down. The ACL is set
+// on an existing directory too, anybody can create folders in ProgramData.
+func prepareDataDir(name string) (string, error) {
+	dir := getDataDir(name)
+
+	err := os.MkdirAll(dir, 0700)
+	if err != nil {
+		return "", errors.New("failed to create data directory: " + err.Error())
+	}
+
+	sd, err := windows.SecurityDescriptorFromString(dataDirSddl)
+	if err != nil {
+		return "", errors.New("failed to parse data directory ACL: " + err.Error())
+	}
+
+	owner, _, err := sd.Owner()
+	if err != nil {
+		return "", errors.New("failed to get data directory owner: " + err.Error())
+	}
+
+	dacl, _, err := sd.DACL()
+	if err != nil {
+		return "", errors.New("failed to get data directory ACL: " + err.Error())
+	}
+
+	err = windows.SetNamedSecurityInfo(dir, windows.SE_FILE_OBJECT,
+		windows.OWNER_SECURITY_INFORMATION|windows.DACL_SECURITY_INFORMATION|windows.PROTECTED_DACL_SECURITY_INFORMATION,
+		owner, nil, dacl, nil)
+	if err != nil {
+		return "", errors.New("failed to secure data directory: " + err.Error())
+	}
+
+	return dir, nil
+}
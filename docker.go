@@ -1,21 +1,37 @@
 package main
 
 import (
+	"bufio"
+	"bytes"
 	"context"
 	"errors"
+	"fmt"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
 	"github.com/docker/docker/client"
+	"github.com/docker/docker/pkg/stdcopy"
+	"io"
 	"strings"
 	"time"
 )
 
+// helperVersionLabel holds the helper version on the setup image, see
+// client/Dockerfile.
+const helperVersionLabel = "io.github.i-rocky.docker-win-net.helper-version"
+
 type Docker struct {
 	cli *client.Client
 	ctx context.Context
 }
 
-func NewDocker(ctx context.Context) (*Docker, error) {
-	cli, err := client.NewClientWithOpts(client.FromEnv)
+func NewDocker(ctx context.Context, host string) (*Docker, error) {
+	opts := []client.Opt{client.FromEnv}
+	if host != "" {
+		opts = append(opts, client.WithHost(host))
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
 	if err != nil {
 		return nil, err
 	}
@@ -53,28 +69,158 @@ func (d *Docker) GetSubnets() ([]string, error) {
 	return subnets, nil
 }
 
+func (d *Docker) GetNetworkSubnets(name string) ([]string, error) {
+	networks, err := d.cli.NetworkList(d.ctx, types.NetworkListOptions{
+		Filters: filters.NewArgs(filters.Arg("name", name)),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var subnets []string
+	for _, network := range networks {
+		// the name filter matches substrings
+		if network.Name != name {
+			continue
+		}
+
+		for _, config := range network.IPAM.Config {
+			subnets = append(subnets, config.Subnet)
+		}
+	}
+
+	return subnets, nil
+}
+
+// WaitRunning returns once the engine answers, checking every 20 seconds
+// while it doesn't. A running engine returns at once.
 func (d *Docker) WaitRunning() error {
 	waitTime := 20 * time.Second
-	timer := time.NewTimer(waitTime)
-	defer timer.Stop()
 
 	for {
-		select {
-		case <-timer.C:
-			_, err := d.cli.Info(context.Background())
-			if err == nil {
-				return nil
-			}
+		_, err := d.cli.Info(d.ctx)
+		if err == nil {
+			return nil
+		}
 
-			if strings.Contains(err.Error(), "pipe") && strings.Contains(err.Error(), "docker_engine") {
-				//_ = elog.Info(1, fmt.Sprintf("Docker not running. Checking again in %f seconds...", waitTime.Seconds()))
-				timer.Reset(waitTime)
-				continue
+		if !client.IsErrConnectionFailed(err) && !(strings.Contains(err.Error(), "pipe") && strings.Contains(err.Error(), "docker_engine")) {
+			if d.ctx.Err() != nil {
+				return errors.New("context cancelled")
 			}
+			return errors.New("failed to reach docker: " + err.Error())
+		}
 
-			return errors.New("something went wrong")
+		logger.Debug(EventDockerNotRunning, "Docker not running, checking again", "wait", waitTime)
+		timer := time.NewTimer(waitTime)
+		select {
+		case <-timer.C:
 		case <-d.ctx.Done():
+			timer.Stop()
 			return errors.New("context cancelled")
 		}
 	}
 }
+
+// SetupImageVersion returns the helper version the local setup image was built
+// from, empty for images without the label. It fails when the image is missing.
+func (d *Docker) SetupImageVersion() (string, error) {
+	image, _, err := d.cli.ImageInspectWithRaw(d.ctx, version.SetupImage)
+	if err != nil {
+		return "", err
+	}
+	if image.Config == nil {
+		return "", nil
+	}
+
+	return image.Config.Labels[helperVersionLabel], nil
+}
+
+// PullSetupImage pulls the setup image and waits for the pull to finish.
+func (d *Docker) PullSetupImage() error {
+	reader, err := d.cli.ImagePull(d.ctx, version.SetupImage, types.ImagePullOptions{})
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	// the pull runs while the progress is read
+	_, err = io.Copy(io.Discard, reader)
+
+	return err
+}
+
+// RunHelper runs the helper image with env and the bind mounts binds on the
+// host network of the engine's VM, waits for it to exit and returns its
+// output. Every output line is logged at debug level.
+func (d *Docker) RunHelper(log *Logger, env, binds []string) (string, error) {
+	resp, err := d.cli.ContainerCreate(d.ctx, &container.Config{
+		Image: version.SetupImage,
+		Env:   env,
+	}, &container.HostConfig{
+		AutoRemove:  true,
+		NetworkMode: "host",
+		CapAdd:      []string{"NET_ADMIN"},
+		Binds:       binds,
+	}, nil, nil, fmt.Sprintf("wireguard-setup-%d", time.Now().UnixNano()))
+	if err != nil {
+		return "", fmt.Errorf("failed to create container: %w", err)
+	}
+
+	// wait before starting, an auto-removed container may be gone before the
+	// wait is registered otherwise
+	waitChan, waitErrs := d.cli.ContainerWait(d.ctx, resp.ID, container.WaitConditionNextExit)
+
+	err = d.cli.ContainerStart(d.ctx, resp.ID, types.ContainerStartOptions{})
+	if err != nil {
+		return "", fmt.Errorf("failed to start container: %w", err)
+	}
+
+	output := d.readHelperOutput(log, resp.ID)
+
+	select {
+	case result := <-waitChan:
+		if result.Error != nil {
+			return output, fmt.Errorf("failed to wait for container: %s", result.Error.Message)
+		}
+		if result.StatusCode != 0 {
+			return output, fmt.Errorf("setup container exited with status %d", result.StatusCode)
+		}
+	case err := <-waitErrs:
+		return output, fmt.Errorf("failed to wait for container: %w", err)
+	}
+
+	return output, nil
+}
+
+// readHelperOutput follows the output of the helper container until it exits.
+func (d *Docker) readHelperOutput(log *Logger, id string) string {
+	reader, err := d.cli.ContainerLogs(d.ctx, id, types.ContainerLogsOptions{
+		ShowStdout: true,
+		ShowStderr: true,
+		Follow:     true,
+	})
+	if err != nil {
+		log.Warning(EventHelperLogsFailed, "Failed to get setup container logs", "container", id, "error", err)
+		return ""
+	}
+
+	defer func(reader io.ReadCloser) {
+		err := reader.Close()
+		if err != nil {
+			log.Warning(EventHelperLogsFailed, "Failed to close setup container logs", "container", id, "error", err)
+		}
+	}(reader)
+
+	var output bytes.Buffer
+	_, err = stdcopy.StdCopy(&output, &output, reader)
+	if err != nil {
+		log.Warning(EventHelperLogsFailed, "Failed to read setup container logs", "container", id, "error", err)
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(output.Bytes()))
+	for scanner.Scan() {
+		log.Debug(EventHelperOutput, scanner.Text(), "container", id)
+	}
+
+	return output.String()
+}
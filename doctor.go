@@ -0,0 +1,431 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Doctor checks every link between the host and the containers of a profile,
+// in the order traffic crosses them, and prints a hint for each failure.
+type Doctor struct {
+	Utils
+	name     string
+	failures int
+}
+
+type doctorProfile struct {
+	*Profile
+	docker  *Docker
+	subnets []string
+}
+
+func NewDoctor(name string) *Doctor {
+	return &Doctor{name: name}
+}
+
+func (d *Doctor) pass(check, detail string) {
+	fmt.Printf("  PASS  %-18s %s\n", check, detail)
+}
+
+func (d *Doctor) fail(check, detail, hint string) {
+	d.failures++
+	fmt.Printf("  FAIL  %-18s %s\n", check, detail)
+	if hint != "" {
+		fmt.Printf("        %-18s hint: %s\n", "", hint)
+	}
+}
+
+func (d *Doctor) skip(check, reason string) {
+	fmt.Printf("  SKIP  %-18s %s\n", check, reason)
+}
+
+// Run checks the named profile, or every profile when name is empty.
+func (d *Doctor) Run(profileName string) error {
+	config, err := loadConfig(d.name)
+	if err != nil {
+		return err
+	}
+
+	allocations, err := LoadAllocations(getAllocationsPath(d.name))
+	if err != nil {
+		return err
+	}
+
+	profiles := config.GetProfiles()
+	found := false
+	for _, profile := range profiles {
+		if profileName != "" && profile.Name != profileName {
+			continue
+		}
+
+		allocation := allocations.Profiles[profile.Name]
+		if profile.HostPeerIp == "" {
+			profile.HostPeerIp = allocation.HostPeerIp
+			profile.VmPeerIp = allocation.VmPeerIp
+		}
+		if profile.Port == 0 {
+			profile.Port = allocation.Port
+		}
+
+		if found {
+			fmt.Println()
+		}
+		found = true
+		fmt.Printf("Profile %s\n", profile.Name)
+		d.checkProfile(profile, profiles)
+	}
+
+	if !found {
+		return errors.New("unknown profile " + profileName)
+	}
+
+	if d.failures > 0 {
+		return fmt.Errorf("%d checks failed", d.failures)
+	}
+
+	return nil
+}
+
+func (d *Doctor) checkProfile(profile *Profile, profiles []*Profile) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	docker, err := NewDocker(ctx, profile.DockerHost)
+	if err != nil {
+		d.fail("docker engine", err.Error(), "check dockerHost in the config")
+		return
+	}
+	defer docker.Close()
+
+	p := &doctorProfile{Profile: profile, docker: docker}
+
+	if !d.checkDocker(p) {
+		d.skip("setup image", "Docker is not reachable")
+		d.skip("remaining checks", "Docker is not reachable")
+		return
+	}
+	imageOk := d.checkImage(p)
+
+	if profile.HostPeerIp == "" {
+		d.fail("addresses", "no tunnel addresses allocated", "start the service, it allocates them once Docker answers")
+		return
+	}
+
+	d.checkListener(p)
+
+	tunnelOk := d.checkTunnelService(p)
+	if tunnelOk {
+		d.checkInterface(p)
+		d.checkRoutes(p)
+		d.checkAllowedIPs(p)
+		d.checkProbe(p)
+	} else {
+		d.skip("interface", "the tunnel is not running")
+		d.skip("routes", "the tunnel is not running")
+		d.skip("allowed IPs", "the tunnel is not running")
+		d.skip("probe", "the tunnel is not running")
+	}
+
+	if imageOk {
+		d.checkVM(p)
+	} else {
+		d.skip("vm side", "the setup image is missing or outdated")
+	}
+
+	d.checkConflicts(p, profiles)
+}
+
+func (d *Doctor) checkDocker(p *doctorProfile) bool {
+	ctx, cancel := context.WithTimeout(p.docker.ctx, 5*time.Second)
+	defer cancel()
+
+	server, err := p.docker.cli.ServerVersion(ctx)
+	if err != nil {
+		d.fail("docker engine", err.Error(), "start Docker Desktop or check dockerHost in the config")
+		return false
+	}
+	d.pass("docker engine", fmt.Sprintf("Docker %s, API %s", server.Version, server.APIVersion))
+
+	p.subnets, err = p.docker.GetSubnets()
+	if err != nil {
+		d.fail("docker networks", err.Error(), "")
+		return false
+	}
+
+	return true
+}
+
+func (d *Doctor) checkImage(p *doctorProfile) bool {
+	image, _, err := p.docker.cli.ImageInspectWithRaw(p.docker.ctx, version.SetupImage)
+	if err != nil {
+		d.fail("setup image", version.SetupImage+" is not present", "run docker pull "+version.SetupImage)
+		return false
+	}
+
+	id := strings.TrimPrefix(image.ID, "sha256:")
+	if len(id) > 12 {
+		id = id[:12]
+	}
+
+	current := ""
+	if image.Config != nil {
+		current = image.Config.Labels[helperVersionLabel]
+	}
+	if current != helperVersion {
+		d.fail("setup image", fmt.Sprintf("%s %s is helper version %q, expected %s", version.SetupImage, id, current, helperVersion), "restart the service or run docker pull "+version.SetupImage)
+		return false
+	}
+	d.pass("setup image", fmt.Sprintf("%s %s, helper version %s, created %s", version.SetupImage, id, current, image.Created))
+
+	return true
+}
+
+func (d *Doctor) checkTunnelService(p *doctorProfile) bool {
+	service := "WireGuardTunnel$" + p.InterfaceName
+	output, err := d.runPowerShell(fmt.Sprintf("(Get-Service -Name %s -ErrorAction Stop).Status", quotePowerShell(service)))
+	if err != nil {
+		d.fail("tunnel service", service+" is not installed", "start the service or run reprovision")
+		return false
+	}
+
+	state := strings.TrimSpace(output)
+	if state != "Running" {
+		d.fail("tunnel service", service+" is "+state, "restart the service")
+		return false
+	}
+	d.pass("tunnel service", service+" is running")
+
+	return true
+}
+
+func (d *Doctor) checkListener(p *doctorProfile) {
+	rules, err := newListenerFirewall(p.InterfaceName).Rules()
+	if err != nil {
+		d.fail("listener", err.Error(), "")
+		return
+	}
+
+	if len(rules) < listenerRuleCount {
+		d.fail("listener", fmt.Sprintf("%d of %d firewall rules are in place, UDP port %d is reachable from every network", len(rules), listenerRuleCount, p.Port), "run reconcile, the service applies them again")
+		return
+	}
+	d.pass("listener", fmt.Sprintf("UDP port %d is restricted to the Docker VM", p.Port))
+}
+
+func (d *Doctor) checkInterface(p *doctorProfile) {
+	iface, err := net.InterfaceByName(p.InterfaceName)
+	if err != nil {
+		d.fail("interface", p.InterfaceName+" does not exist", "restart the service")
+		return
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		d.fail("interface", err.Error(), "")
+		return
+	}
+
+	for _, addr := range addrs {
+		ipNet, ok := addr.(*net.IPNet)
+		if ok && ipNet.IP.String() == p.HostPeerIp {
+			d.pass("interface", fmt.Sprintf("%s has %s", p.InterfaceName, p.HostPeerIp))
+			return
+		}
+	}
+
+	d.fail("interface", fmt.Sprintf("%s doesn't have %s", p.InterfaceName, p.HostPeerIp), "run reprovision")
+}
+
+func (d *Doctor) checkRoutes(p *doctorProfile) {
+	routes, err := d.getRoutes()
+	if err != nil {
+		d.fail("routes", err.Error(), "")
+		return
+	}
+
+	// a subnet may be routed through its whole address pool
+	var routed []*net.IPNet
+	for _, route := range routes {
+		_, ipNet, err := net.ParseCIDR(route[1])
+		if err == nil && route[0] == p.InterfaceName && !strings.HasSuffix(route[1], "/0") {
+			routed = append(routed, ipNet)
+		}
+	}
+
+	var missing []string
+	for _, subnet := range p.subnets {
+		_, subnetNet, err := net.ParseCIDR(subnet)
+		if err != nil || !coveredBy(subnetNet, routed) {
+			missing = append(missing, subnet)
+		}
+	}
+
+	if len(missing) > 0 {
+		d.fail("routes", "no route for "+strings.Join(missing, ", "), "run reconcile")
+		return
+	}
+	d.pass("routes", fmt.Sprintf("%d Docker subnets routed through %s", len(p.subnets), p.InterfaceName))
+}
+
+func (d *Doctor) checkAllowedIPs(p *doctorProfile) {
+	wg := filepath.Join(getDataDir(d.name), "bin", "wg.exe")
+	err := ensureBinary(wg, "wg.exe")
+	if err != nil {
+		d.fail("allowed IPs", err.Error(), "")
+		return
+	}
+
+	output, err := d.runCommandOutput(wg, "show", p.InterfaceName, "allowed-ips")
+	if err != nil {
+		d.fail("allowed IPs", err.Error(), "restart the service")
+		return
+	}
+
+	var allowed []*net.IPNet
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		_, ips, _ := strings.Cut(line, "\t")
+		for _, ip := range strings.Fields(ips) {
+			_, ipNet, err := net.ParseCIDR(ip)
+			if err == nil {
+				allowed = append(allowed, ipNet)
+			}
+		}
+	}
+
+	var missing []string
+	for _, subnet := range p.subnets {
+		_, subnetNet, err := net.ParseCIDR(subnet)
+		if err != nil || !coveredBy(subnetNet, allowed) {
+			missing = append(missing, subnet)
+		}
+	}
+
+	if len(missing) > 0 {
+		d.fail("allowed IPs", "the peer doesn't allow "+strings.Join(missing, ", "), "run reconcile")
+		return
+	}
+	d.pass("allowed IPs", "every Docker subnet is allowed through the tunnel")
+}
+
+func (d *Doctor) checkProbe(p *doctorProfile) {
+	err := d.runCommand("ping", "-n", "1", "-w", "2000", p.VmPeerIp)
+	if err != nil {
+		d.fail("probe", p.VmPeerIp+" does not answer", "run reprovision, the VM side may have lost its interface")
+		return
+	}
+	d.pass("probe", p.VmPeerIp+" answers")
+}
+
+func (d *Doctor) checkVM(p *doctorProfile) {
+	output, err := p.docker.RunHelper(logger, []string{
+		"MODE=check",
+		"HOST_PEER_IP=" + p.HostPeerIp,
+		"VM_PEER_IP=" + p.VmPeerIp,
+		fmt.Sprintf("PRESERVE_SOURCE_IP=%t", p.PreserveSourceIp),
+	}, nil)
+	if err != nil {
+		d.fail("vm side", err.Error(), "update the setup image with docker pull "+version.SetupImage)
+		return
+	}
+
+	hints := map[string]string{
+		"vm interface":  "run reprovision",
+		"vm address":    "run reprovision",
+		"vm handshake":  "check that the listener firewall rules allow the VM, see status",
+		"vm forwarding": "enable net.ipv4.ip_forward in the Docker VM",
+		"vm nat":        "run reprovision",
+	}
+
+	checks := 0
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), "\t", 4)
+		if len(fields) != 4 || fields[0] != "CHECK" {
+			continue
+		}
+		checks++
+
+		if fields[2] == "ok" {
+			d.pass(fields[1], fields[3])
+		} else {
+			d.fail(fields[1], fields[3], hints[fields[1]])
+		}
+	}
+
+	if checks == 0 {
+		d.fail("vm side", "the setup image reported nothing", "update the setup image with docker pull "+version.SetupImage)
+	}
+}
+
+func (d *Doctor) checkConflicts(p *doctorProfile, profiles []*Profile) {
+	own := make(map[string]bool)
+	for _, profile := range profiles {
+		own[profile.InterfaceName] = true
+	}
+
+	routes, err := d.getRoutes()
+	if err != nil {
+		d.fail("route conflicts", err.Error(), "")
+		return
+	}
+
+	var conflicts []string
+	for _, subnet := range p.subnets {
+		_, subnetNet, err := net.ParseCIDR(subnet)
+		if err != nil {
+			continue
+		}
+
+		for _, route := range routes {
+			_, routeNet, err := net.ParseCIDR(route[1])
+			if err != nil || route[0] == p.InterfaceName || strings.HasSuffix(route[1], "/0") {
+				continue
+			}
+			if subnetNet.Contains(routeNet.IP) || routeNet.Contains(subnetNet.IP) {
+				conflicts = append(conflicts, fmt.Sprintf("%s via %s", route[1], route[0]))
+			}
+		}
+	}
+
+	if len(conflicts) > 0 {
+		d.fail("route conflicts", strings.Join(conflicts, ", "), "remove the routes or move the Docker networks to other subnets")
+	} else {
+		d.pass("route conflicts", "no other interface routes the Docker subnets")
+	}
+
+	output, err := d.runPowerShell("Get-Service -Name 'WireGuardTunnel$*' | Where-Object { $_.Status -eq 'Running' } | ForEach-Object { $_.Name }")
+	if err != nil {
+		d.fail("other tunnels", err.Error(), "")
+		return
+	}
+
+	var others []string
+	for _, line := range strings.Split(output, "\n") {
+		tunnel := strings.TrimPrefix(strings.TrimSpace(line), "WireGuardTunnel$")
+		if tunnel != "" && !own[tunnel] {
+			others = append(others, tunnel)
+		}
+	}
+
+	if len(others) > 0 {
+		d.fail("other tunnels", "running: "+strings.Join(others, ", "), "make sure their AllowedIPs don't cover the Docker subnets")
+		return
+	}
+	d.pass("other tunnels", "no other WireGuard tunnel is running")
+}
+
+func coveredBy(ipNet *net.IPNet, networks []*net.IPNet) bool {
+	ones, _ := ipNet.Mask.Size()
+	for _, other := range networks {
+		otherOnes, _ := other.Mask.Size()
+		if otherOnes <= ones && other.Contains(ipNet.IP) {
+			return true
+		}
+	}
+
+	return false
+}
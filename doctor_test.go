@@ -0,0 +1,29 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestCoveredBy(t *testing.T) {
+	networks := parseCIDRs(t, "172.17.0.0/16", "10.0.0.0/8", "192.168.1.5/32")
+
+	tests := []struct {
+		cidr string
+		want bool
+	}{
+		{cidr: "172.17.0.0/16", want: true},
+		{cidr: "172.17.5.0/24", want: true},
+		{cidr: "10.20.30.0/24", want: true},
+		{cidr: "192.168.1.5/32", want: true},
+		{cidr: "172.16.0.0/12"},
+		{cidr: "172.18.0.0/16"},
+		{cidr: "192.168.1.0/24"},
+	}
+
+	for _, test := range tests {
+		ipNet := parseCIDRs(t, test.cidr)[0]
+		if covered := coveredBy(ipNet, networks); covered != test.want {
+			t.Errorf("coveredBy(%s) = %t, want %t", test.cidr, covered, test.want)
+		}
+	}
+}
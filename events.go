@@ -0,0 +1,95 @@
+package main
+
+// Event identifies a log entry, it is used as the Windows Event Log event ID
+// and written to the other sinks as "event". IDs are grouped by area and never
+// reused.
+type Event uint32
+
+// service lifecycle, config and local endpoints
+const (
+	EventServiceStarting   Event = 100
+	EventServiceStopped    Event = 101
+	EventServiceFailed     Event = 102
+	EventServiceStartFail  Event = 103
+	EventAcceptingCommands Event = 104
+	EventServiceStopping   Event = 105
+	EventUnexpectedControl Event = 106
+	EventConfigReloading   Event = 107
+	EventProfilesStarting  Event = 108
+	EventControlAPIFailed  Event = 109
+	EventMetricsFailed     Event = 110
+	EventLogFileFailed     Event = 111
+	EventServicePausing    Event = 112
+	EventServiceContinuing Event = 113
+	EventPauseFailed       Event = 114
+	EventStopTimeout       Event = 115
+	EventJournalFailed     Event = 116
+	EventRemovingOrphan    Event = 117
+	EventCleanupFailed     Event = 118
+	EventReloadFailed      Event = 119
+)
+
+// host side of the tunnel
+const (
+	EventAllocated              Event = 200
+	EventAllocationFailed       Event = 201
+	EventTunnelSetupFailed      Event = 202
+	EventTunnelListening        Event = 203
+	EventTeardownFailed         Event = 204
+	EventDockerCloseFailed      Event = 205
+	EventExtractingBinaries     Event = 206
+	EventDownloadingImage       Event = 207
+	EventPullingImage           Event = 208
+	EventRestrictingListener    Event = 209
+	EventListenerRestrictFailed Event = 210
+	EventInstallingTunnel       Event = 211
+	EventUpdatingInterface      Event = 212
+	EventDeletingDefaultRoute   Event = 213
+	EventUpdatingHostServices   Event = 214
+	EventWithdrawingRoutes      Event = 215
+	EventTearingDownHost        Event = 216
+	EventBinaryMismatch         Event = 217
+	EventRoutingAddressPools    Event = 218
+	EventAddressPoolSkipped     Event = 219
+)
+
+// VM side of the tunnel
+const (
+	EventSettingUpVM          Event = 300
+	EventSetupVMFailed        Event = 301
+	EventSetupVMComplete      Event = 302
+	EventHelperOutput         Event = 303
+	EventReprovisioning       Event = 304
+	EventPolicyFailed         Event = 305
+	EventHelperLogsFailed     Event = 306
+	EventTearingDownVM        Event = 307
+	EventVMTeardownFailed     Event = 308
+	EventPolicyNetworkMissing Event = 309
+)
+
+// Docker events and routes
+const (
+	EventWatchingEvents       Event = 400
+	EventEventsError          Event = 401
+	EventNetworkCreated       Event = 402
+	EventNetworkDestroyed     Event = 403
+	EventNetworkInspectFailed Event = 404
+	EventRouteAddFailed       Event = 405
+	EventRouteDeleteFailed    Event = 406
+	EventEventsStopped        Event = 407
+	EventDockerNotRunning     Event = 408
+	EventEventsResumed        Event = 409
+	EventEventsResync         Event = 410
+	EventEventsResyncFailed   Event = 411
+	EventRouteRetrying        Event = 412
+	EventAllowedIPsFailed     Event = 413
+	EventBatchApplied         Event = 414
+	EventKubernetesFailed     Event = 415
+	EventSourcesUpdated       Event = 416
+	EventVMRoutesFailed       Event = 417
+	EventShimsFailed          Event = 418
+	EventSourceRangeOverlap   Event = 419
+	EventExtraRouteSkipped    Event = 420
+	EventShimSkipped          Event = 421
+	EventShimAdding           Event = 422
+)
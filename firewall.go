@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Firewall manages a group of Windows Firewall rules through PowerShell, every
+// rule it creates is tagged with the group so it can be listed and removed as
+// a whole.
+type Firewall struct {
+	Utils
+	group string
+}
+
+type FirewallRule struct {
+	Name           string
+	Action         string
+	Protocol       string
+	LocalPort      string
+	InterfaceAlias string
+	RemoteAddress  []string
+}
+
+func NewFirewall(group string) *Firewall {
+	return &Firewall{group: group}
+}
+
+func (f *Firewall) AddRule(rule FirewallRule) error {
+	args := []string{
+		"New-NetFirewallRule",
+		"-Group", quotePowerShell(f.group),
+		"-DisplayName", quotePowerShell(rule.Name),
+		"-Direction", "Inbound",
+		"-Action", rule.Action,
+		"-Protocol", rule.Protocol,
+		"-LocalPort", rule.LocalPort,
+	}
+	if rule.InterfaceAlias != "" {
+		args = append(args, "-InterfaceAlias", quotePowerShell(rule.InterfaceAlias))
+	}
+	if len(rule.RemoteAddress) > 0 {
+		args = append(args, "-RemoteAddress", strings.Join(rule.RemoteAddress, ","))
+	}
+
+	_, err := f.runPowerShell(strings.Join(args, " ") + " | Out-Null")
+	if err != nil {
+		return errors.New("error adding firewall rule " + err.Error())
+	}
+
+	return nil
+}
+
+// Clear removes every rule of the group, a group without rules is not an error.
+func (f *Firewall) Clear() error {
+	_, err := f.runPowerShell(fmt.Sprintf("Remove-NetFirewallRule -Group %s -ErrorAction SilentlyContinue", quotePowerShell(f.group)))
+	if err != nil {
+		return errors.New("error removing firewall rules " + err.Error())
+	}
+
+	return nil
+}
+
+// Rules returns the display names of the rules currently in the group.
+func (f *Firewall) Rules() ([]string, error) {
+	output, err := f.runPowerShell(fmt.Sprintf("Get-NetFirewallRule -Group %s -ErrorAction SilentlyContinue | ForEach-Object { $_.DisplayName }", quotePowerShell(f.group)))
+	if err != nil {
+		return nil, errors.New("error listing firewall rules " + err.Error())
+	}
+
+	var rules []string
+	for _, line := range strings.Split(output, "\n") {
+		line = strings.TrimSpace(line)
+		if line != "" {
+			rules = append(rules, line)
+		}
+	}
+
+	return rules, nil
+}
+
+func quotePowerShell(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+const defaultHostServicesHostname = "winhost.tunnel.internal"
+
+// HostServices opens selected ports on the host to containers. The ports are
+// allowed by Windows Firewall only on the tunnel interface and the helper
+// writes Hostname for the host tunnel address to the VM's hosts file. Docker's
+// DNS doesn't read that file, containers resolve it only with --add-host.
+type HostServices struct {
+	Hostname string `json:"hostname"`
+	// Ports are written like policy ports, "5432", "8000-8100" or "53/udp".
+	Ports []string `json:"ports"`
+}
+
+func (h *HostServices) Validate() error {
+	for _, port := range h.Ports {
+		err := validatePort(port)
+		if err != nil {
+			return fmt.Errorf("invalid host service port %s: %w", port, err)
+		}
+	}
+
+	return nil
+}
+
+func (h *HostServices) GetHostname() string {
+	if h == nil {
+		return ""
+	}
+
+	if h.Hostname == "" {
+		return defaultHostServicesHostname
+	}
+
+	return h.Hostname
+}
+
+// helperBinds returns the mounts the helper needs to publish Hostname: the
+// VM's hosts file, which no helper run gets without host services.
+func (h *HostServices) helperBinds() []string {
+	if h == nil {
+		return nil
+	}
+
+	return []string{"/etc/hosts:/host/etc/hosts"}
+}
+
+func newHostServicesFirewall(interfaceName string) *Firewall {
+	return NewFirewall(interfaceName + " host services")
+}
+
+func (h *HostServices) firewallRules(interfaceName string) []FirewallRule {
+	var rules []FirewallRule
+	for _, port := range h.Ports {
+		port, proto, found := strings.Cut(port, "/")
+		if !found {
+			proto = "tcp"
+		}
+
+		rules = append(rules, FirewallRule{
+			Name:           fmt.Sprintf("%s host service %s/%s", interfaceName, port, proto),
+			Action:         "Allow",
+			Protocol:       strings.ToUpper(proto),
+			LocalPort:      port,
+			InterfaceAlias: interfaceName,
+		})
+	}
+
+	return rules
+}
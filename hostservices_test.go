@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHostServicesValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		ports   []string
+		wantErr bool
+	}{
+		{name: "no ports"},
+		{name: "ports", ports: []string{"5432", "8000-8100", "53/udp"}},
+		{name: "invalid port", ports: []string{"5432", "postgres"}, wantErr: true},
+		{name: "invalid protocol", ports: []string{"53/icmp"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			services := &HostServices{Ports: test.ports}
+
+			err := services.Validate()
+			if (err != nil) != test.wantErr {
+				t.Errorf("Validate = %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestHostServicesGetHostname(t *testing.T) {
+	tests := []struct {
+		name     string
+		services *HostServices
+		want     string
+	}{
+		{name: "not configured", services: nil, want: ""},
+		{name: "default", services: &HostServices{}, want: defaultHostServicesHostname},
+		{name: "configured", services: &HostServices{Hostname: "host.internal"}, want: "host.internal"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if hostname := test.services.GetHostname(); hostname != test.want {
+				t.Errorf("GetHostname = %q, want %q", hostname, test.want)
+			}
+		})
+	}
+}
+
+func TestHostServicesFirewallRules(t *testing.T) {
+	services := &HostServices{Ports: []string{"5432", "8000-8100/tcp", "53/udp"}}
+
+	want := []FirewallRule{
+		{Name: "wg0 host service 5432/tcp", Action: "Allow", Protocol: "TCP", LocalPort: "5432", InterfaceAlias: "wg0"},
+		{Name: "wg0 host service 8000-8100/tcp", Action: "Allow", Protocol: "TCP", LocalPort: "8000-8100", InterfaceAlias: "wg0"},
+		{Name: "wg0 host service 53/udp", Action: "Allow", Protocol: "UDP", LocalPort: "53", InterfaceAlias: "wg0"},
+	}
+
+	rules := services.firewallRules("wg0")
+	if !reflect.DeepEqual(rules, want) {
+		t.Errorf("firewallRules = %+v, want %+v", rules, want)
+	}
+}
+
+func TestHostServicesHelperBinds(t *testing.T) {
+	var none *HostServices
+	if binds := none.helperBinds(); binds != nil {
+		t.Errorf("helperBinds without host services = %q, want none", binds)
+	}
+
+	binds := (&HostServices{Ports: []string{"5432"}}).helperBinds()
+	if len(binds) != 1 || binds[0] != "/etc/hosts:/host/etc/hosts" {
+		t.Errorf("helperBinds = %q, want the hosts file", binds)
+	}
+}
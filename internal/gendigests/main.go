@@ -0,0 +1,77 @@
+// gendigests records the SHA-256 digests of the WireGuard binaries in bin and
+// the version of wireguard.exe in bin/digests.json, which is embedded with
+// them. Run it through go generate, from the module root, whenever the
+// binaries change.
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/tc-hib/winres"
+	"github.com/tc-hib/winres/version"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+type binaryDigests struct {
+	Files            map[string]string `json:"files"`
+	WireguardVersion string            `json:"wireguardVersion"`
+}
+
+func main() {
+	digests := binaryDigests{Files: make(map[string]string)}
+
+	for _, name := range []string{"wg.exe", "wireguard.exe"} {
+		data, err := os.ReadFile(filepath.Join("bin", name))
+		if err != nil {
+			log.Fatalf("failed to read %s: %v", name, err)
+		}
+
+		sum := sha256.Sum256(data)
+		digests.Files[name] = hex.EncodeToString(sum[:])
+	}
+
+	digests.WireguardVersion = readVersion(filepath.Join("bin", "wireguard.exe"))
+
+	data, err := json.MarshalIndent(digests, "", "  ")
+	if err != nil {
+		log.Fatalf("failed to encode digests: %v", err)
+	}
+
+	err = os.WriteFile(filepath.Join("bin", "digests.json"), append(data, '\n'), 0644)
+	if err != nil {
+		log.Fatalf("failed to write digests: %v", err)
+	}
+}
+
+// readVersion returns the product version from the version resource of an
+// executable, or "unknown" when it has none.
+func readVersion(path string) string {
+	file, err := os.Open(path)
+	if err != nil {
+		return "unknown"
+	}
+	defer file.Close()
+
+	resources, err := winres.LoadFromEXESingleType(file, winres.RT_VERSION)
+	if err != nil {
+		return "unknown"
+	}
+
+	result := "unknown"
+	resources.WalkType(winres.RT_VERSION, func(resID winres.Identifier, langID uint16, data []byte) bool {
+		info, err := version.FromBytes(data)
+		if err != nil {
+			return true
+		}
+
+		v := info.ProductVersion
+		result = fmt.Sprintf("%d.%d.%d.%d", v[0], v[1], v[2], v[3])
+		return false
+	})
+
+	return result
+}
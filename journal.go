@@ -0,0 +1,313 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"golang.org/x/sys/windows/svc"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Journal records every system change the service makes, so the changes left
+// behind by a crash can be undone at the next start or by the cleanup command.
+// It is saved after each change.
+type Journal struct {
+	Utils
+	mu       sync.Mutex
+	path     string
+	Profiles map[string]*JournalEntry `json:"profiles"`
+}
+
+// JournalEntry holds the changes made for one profile.
+type JournalEntry struct {
+	// Tunnel is the interface of the installed tunnel service, empty when
+	// none is installed.
+	Tunnel        string `json:"tunnel,omitempty"`
+	WireguardPath string `json:"wireguardPath,omitempty"`
+	ConfPath      string `json:"confPath,omitempty"`
+	// Routes are the routes added to the tunnel interface.
+	Routes         []JournalRoute `json:"routes,omitempty"`
+	FirewallGroups []string       `json:"firewallGroups,omitempty"`
+}
+
+type JournalRoute struct {
+	Ip             string `json:"ip"`
+	Mask           string `json:"mask"`
+	InterfaceIndex int    `json:"interfaceIndex"`
+}
+
+// getJournalPath returns the journal inside the data directory, which only
+// SYSTEM and Administrators can write. Replaying the journal removes files and
+// runs wireguard.exe, a journal users can edit would let them do that as SYSTEM.
+func getJournalPath(name string) string {
+	return filepath.Join(getDataDir(name), "state.json")
+}
+
+func LoadJournal(path string) (*Journal, error) {
+	journal := &Journal{
+		path:     path,
+		Profiles: make(map[string]*JournalEntry),
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return journal, nil
+	}
+	if err != nil {
+		return nil, errors.New("failed to read state journal: " + err.Error())
+	}
+
+	err = json.Unmarshal(data, journal)
+	if err != nil {
+		return nil, errors.New("failed to parse state journal: " + err.Error())
+	}
+	if journal.Profiles == nil {
+		journal.Profiles = make(map[string]*JournalEntry)
+	}
+
+	return journal, nil
+}
+
+func loadJournal(name string) (*Journal, error) {
+	return LoadJournal(getJournalPath(name))
+}
+
+// save writes the journal to a temporary file first, a crash while writing
+// leaves the previous journal in place.
+func (j *Journal) save() error {
+	data, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	err = os.WriteFile(j.path+".tmp", data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(j.path+".tmp", j.path)
+}
+
+// update changes the entry of a profile and saves the journal. A journal that
+// can't be saved doesn't stop the change, it is only logged.
+func (j *Journal) update(profile string, f func(entry *JournalEntry)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	entry := j.Profiles[profile]
+	if entry == nil {
+		entry = &JournalEntry{}
+		j.Profiles[profile] = entry
+	}
+	f(entry)
+
+	if entry.Tunnel == "" && entry.ConfPath == "" && len(entry.Routes) == 0 && len(entry.FirewallGroups) == 0 {
+		delete(j.Profiles, profile)
+	}
+
+	err := j.save()
+	if err != nil {
+		logger.Warning(EventJournalFailed, "Failed to save state journal", "profile", profile, "error", err)
+	}
+}
+
+func (j *Journal) AddTunnel(profile, interfaceName, wireguardPath, confPath string) {
+	j.update(profile, func(entry *JournalEntry) {
+		entry.Tunnel = interfaceName
+		entry.WireguardPath = wireguardPath
+		entry.ConfPath = confPath
+	})
+}
+
+func (j *Journal) RemoveTunnel(profile string) {
+	j.update(profile, func(entry *JournalEntry) {
+		entry.Tunnel = ""
+		entry.WireguardPath = ""
+	})
+}
+
+func (j *Journal) RemoveConf(profile string) {
+	j.update(profile, func(entry *JournalEntry) {
+		entry.ConfPath = ""
+	})
+}
+
+func (j *Journal) AddRoute(profile, ip, mask string, interfaceIndex int) {
+	j.update(profile, func(entry *JournalEntry) {
+		for _, route := range entry.Routes {
+			if route.Ip == ip && route.InterfaceIndex == interfaceIndex {
+				return
+			}
+		}
+		entry.Routes = append(entry.Routes, JournalRoute{Ip: ip, Mask: mask, InterfaceIndex: interfaceIndex})
+	})
+}
+
+func (j *Journal) RemoveRoute(profile, ip string) {
+	j.update(profile, func(entry *JournalEntry) {
+		var routes []JournalRoute
+		for _, route := range entry.Routes {
+			if route.Ip != ip {
+				routes = append(routes, route)
+			}
+		}
+		entry.Routes = routes
+	})
+}
+
+func (j *Journal) AddFirewallGroup(profile, group string) {
+	j.update(profile, func(entry *JournalEntry) {
+		for _, existing := range entry.FirewallGroups {
+			if existing == group {
+				return
+			}
+		}
+		entry.FirewallGroups = append(entry.FirewallGroups, group)
+	})
+}
+
+func (j *Journal) RemoveFirewallGroup(profile, group string) {
+	j.update(profile, func(entry *JournalEntry) {
+		var groups []string
+		for _, existing := range entry.FirewallGroups {
+			if existing != group {
+				groups = append(groups, existing)
+			}
+		}
+		entry.FirewallGroups = groups
+	})
+}
+
+// Replay undoes every recorded change: routes first, then the tunnel service,
+// its config file and the firewall rules. Changes that are already gone are
+// dropped silently, those that fail stay in the journal for the next try.
+func (j *Journal) Replay() error {
+	j.mu.Lock()
+	profiles := make([]string, 0, len(j.Profiles))
+	for profile := range j.Profiles {
+		profiles = append(profiles, profile)
+	}
+	j.mu.Unlock()
+
+	var errs []error
+	for _, profile := range profiles {
+		err := j.replayProfile(profile)
+		if err != nil {
+			errs = append(errs, errors.New("profile "+profile+": "+err.Error()))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (j *Journal) replayProfile(profile string) error {
+	j.mu.Lock()
+	entry := *j.Profiles[profile]
+	j.mu.Unlock()
+
+	log := logger.With("profile", profile)
+	var errs []error
+
+	for _, route := range entry.Routes {
+		log.Info(EventRemovingOrphan, "Removing orphaned route", "route", route.Ip+"/"+route.Mask)
+		// a route that is gone already fails as well, it is dropped either way
+		_ = j.runCommand("route", "DELETE", route.Ip, "MASK", route.Mask, "0.0.0.0", "IF", strconv.Itoa(route.InterfaceIndex))
+		j.RemoveRoute(profile, route.Ip)
+	}
+
+	if entry.Tunnel != "" {
+		log.Info(EventRemovingOrphan, "Removing orphaned tunnel", "interface", entry.Tunnel)
+		_, err := j.runPowerShell("Get-Service -Name " + quotePowerShell("WireGuardTunnel$"+entry.Tunnel) + " -ErrorAction Stop | Out-Null")
+		if err == nil {
+			err = j.uninstallTunnel(entry.WireguardPath, entry.Tunnel)
+		} else {
+			// the service doesn't exist anymore
+			err = nil
+		}
+		if err != nil {
+			errs = append(errs, errors.New("failed to uninstall tunnel: "+err.Error()))
+		} else {
+			j.RemoveTunnel(profile)
+		}
+	}
+
+	if entry.ConfPath != "" && !j.inDataDir(entry.ConfPath) {
+		// the service never writes configs elsewhere, the entry was edited
+		log.Warning(EventCleanupFailed, "Not removing tunnel config outside the data directory", "path", entry.ConfPath)
+		j.RemoveConf(profile)
+	} else if entry.ConfPath != "" {
+		err := os.Remove(entry.ConfPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			errs = append(errs, errors.New("failed to remove tunnel config: "+err.Error()))
+		} else {
+			j.RemoveConf(profile)
+		}
+	}
+
+	for _, group := range entry.FirewallGroups {
+		log.Info(EventRemovingOrphan, "Removing orphaned firewall rules", "group", group)
+		err := NewFirewall(group).Clear()
+		if err != nil {
+			errs = append(errs, err)
+		} else {
+			j.RemoveFirewallGroup(profile, group)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// inDataDir reports whether path is inside the directory of the journal, the
+// data directory. The service only records paths inside it, the journal is
+// not trusted with others.
+func (j *Journal) inDataDir(path string) bool {
+	if !filepath.IsAbs(path) {
+		return false
+	}
+
+	rel, err := filepath.Rel(filepath.Dir(j.path), path)
+	if err != nil {
+		return false
+	}
+
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// uninstallTunnel removes the tunnel service with the recorded wireguard.exe,
+// checked against the embedded binary like every other run of it. Only a path
+// inside the data directory is run, the extracted binary otherwise.
+func (j *Journal) uninstallTunnel(wireguardPath, interfaceName string) error {
+	if !j.inDataDir(wireguardPath) {
+		wireguardPath = filepath.Join(filepath.Dir(j.path), "bin", "wireguard.exe")
+	}
+
+	err := ensureBinary(wireguardPath, "wireguard.exe")
+	if err != nil {
+		return err
+	}
+
+	return j.runCommand(wireguardPath, "/uninstalltunnelservice", interfaceName)
+}
+
+// runCleanup replays the journal of a stopped service, for the cleanup command.
+func runCleanup(name string, manager *Manager) error {
+	state, err := manager.QueryService()
+	if err == nil && state != svc.Stopped {
+		return errors.New("the service is running, stop it first")
+	}
+
+	_, err = prepareDataDir(name)
+	if err != nil {
+		return err
+	}
+
+	journal, err := loadJournal(name)
+	if err != nil {
+		return err
+	}
+
+	return journal.Replay()
+}
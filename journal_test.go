@@ -0,0 +1,240 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func newTestJournal(t *testing.T) *Journal {
+	t.Helper()
+
+	journal, err := LoadJournal(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return journal
+}
+
+func TestJournalSaveLoad(t *testing.T) {
+	journal := newTestJournal(t)
+	journal.AddTunnel("podman", "dwnc-podman", `C:\wireguard.exe`, `C:\dwnc-podman.conf`)
+	journal.AddRoute("podman", "172.17.0.0", "255.255.0.0", 12)
+	journal.AddRoute("podman", "172.17.0.0", "255.255.0.0", 12)
+	journal.AddRoute("podman", "172.18.0.0", "255.255.0.0", 12)
+	journal.AddFirewallGroup("podman", "dwnc-podman")
+	journal.AddFirewallGroup("podman", "dwnc-podman")
+
+	loaded, err := LoadJournal(journal.path)
+	if err != nil {
+		t.Fatalf("LoadJournal failed: %v", err)
+	}
+
+	want := map[string]*JournalEntry{
+		"podman": {
+			Tunnel:        "dwnc-podman",
+			WireguardPath: `C:\wireguard.exe`,
+			ConfPath:      `C:\dwnc-podman.conf`,
+			Routes: []JournalRoute{
+				{Ip: "172.17.0.0", Mask: "255.255.0.0", InterfaceIndex: 12},
+				{Ip: "172.18.0.0", Mask: "255.255.0.0", InterfaceIndex: 12},
+			},
+			FirewallGroups: []string{"dwnc-podman"},
+		},
+	}
+	if !reflect.DeepEqual(loaded.Profiles, want) {
+		t.Errorf("loaded profiles = %+v, want %+v", loaded.Profiles["podman"], want["podman"])
+	}
+}
+
+func TestJournalRemove(t *testing.T) {
+	journal := newTestJournal(t)
+	journal.AddTunnel("podman", "dwnc-podman", `C:\wireguard.exe`, `C:\dwnc-podman.conf`)
+	journal.AddRoute("podman", "172.17.0.0", "255.255.0.0", 12)
+	journal.AddFirewallGroup("podman", "dwnc-podman")
+
+	journal.RemoveRoute("podman", "172.17.0.0")
+	journal.RemoveFirewallGroup("podman", "dwnc-podman")
+	journal.RemoveTunnel("podman")
+	if journal.Profiles["podman"] == nil {
+		t.Fatal("entry removed while the config file is still recorded")
+	}
+
+	journal.RemoveConf("podman")
+	if len(journal.Profiles) != 0 {
+		t.Errorf("profiles = %+v, want the empty entry removed", journal.Profiles)
+	}
+
+	loaded, err := LoadJournal(journal.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.Profiles) != 0 {
+		t.Errorf("loaded profiles = %+v, want none", loaded.Profiles)
+	}
+}
+
+func TestLoadJournalInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	err := os.WriteFile(path, []byte(`{"profiles": `), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = LoadJournal(path)
+	if err == nil {
+		t.Error("LoadJournal succeeded for invalid JSON")
+	}
+}
+
+func TestJournalReplay(t *testing.T) {
+	uninstall := filepath.Join("bin", "wireguard.exe") + " /uninstalltunnelservice dwnc-podman"
+
+	tests := []struct {
+		name         string
+		fail         string
+		outside      bool
+		wantCommands []string
+		wantErr      bool
+		wantTunnel   bool
+	}{
+		{
+			name: "everything removed",
+			wantCommands: []string{
+				"route DELETE 172.17.0.0 MASK 255.255.0.0 0.0.0.0 IF 12",
+				"Get-Service -Name 'WireGuardTunnel$dwnc-podman'",
+				uninstall,
+				"Remove-NetFirewallRule -Group 'dwnc-podman'",
+			},
+		},
+		{
+			name: "tunnel service gone",
+			fail: "Get-Service",
+			wantCommands: []string{
+				"route DELETE 172.17.0.0 MASK 255.255.0.0 0.0.0.0 IF 12",
+				"Get-Service -Name 'WireGuardTunnel$dwnc-podman'",
+				"Remove-NetFirewallRule -Group 'dwnc-podman'",
+			},
+		},
+		{
+			name: "route already gone",
+			fail: "route DELETE",
+			wantCommands: []string{
+				"route DELETE 172.17.0.0 MASK 255.255.0.0 0.0.0.0 IF 12",
+				"Get-Service -Name 'WireGuardTunnel$dwnc-podman'",
+				uninstall,
+				"Remove-NetFirewallRule -Group 'dwnc-podman'",
+			},
+		},
+		{
+			name: "uninstall fails",
+			fail: "/uninstalltunnelservice",
+			wantCommands: []string{
+				"route DELETE 172.17.0.0 MASK 255.255.0.0 0.0.0.0 IF 12",
+				"Get-Service -Name 'WireGuardTunnel$dwnc-podman'",
+				uninstall,
+				"Remove-NetFirewallRule -Group 'dwnc-podman'",
+			},
+			wantErr:    true,
+			wantTunnel: true,
+		},
+		{
+			name:    "paths outside the data directory",
+			outside: true,
+			wantCommands: []string{
+				"route DELETE 172.17.0.0 MASK 255.255.0.0 0.0.0.0 IF 12",
+				"Get-Service -Name 'WireGuardTunnel$dwnc-podman'",
+				uninstall,
+				"Remove-NetFirewallRule -Group 'dwnc-podman'",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			fake := newFakeCommands(t, func(command string) bool {
+				return test.fail != "" && strings.Contains(command, test.fail)
+			})
+
+			journal := newTestJournal(t)
+			dataDir := filepath.Dir(journal.path)
+			wireguardPath := filepath.Join(dataDir, "bin", "wireguard.exe")
+			confPath := filepath.Join(dataDir, "dwnc-podman.conf")
+			if test.outside {
+				wireguardPath = filepath.Join(t.TempDir(), "wireguard.exe")
+				confPath = filepath.Join(t.TempDir(), "dwnc-podman.conf")
+			}
+
+			err := os.WriteFile(confPath, []byte("[Interface]"), 0600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			journal.AddTunnel("podman", "dwnc-podman", wireguardPath, confPath)
+			journal.AddRoute("podman", "172.17.0.0", "255.255.0.0", 12)
+			journal.AddFirewallGroup("podman", "dwnc-podman")
+
+			err = journal.Replay()
+			if (err != nil) != test.wantErr {
+				t.Errorf("Replay = %v, want error %t", err, test.wantErr)
+			}
+
+			commands := fake.Commands()
+			if len(commands) != len(test.wantCommands) {
+				t.Fatalf("commands = %q, want %q", commands, test.wantCommands)
+			}
+			for i, command := range commands {
+				if !strings.Contains(command, test.wantCommands[i]) {
+					t.Errorf("command %d = %q, want %q", i, command, test.wantCommands[i])
+				}
+			}
+			if test.outside && len(commands) > 2 && !strings.HasPrefix(commands[2], dataDir) {
+				t.Errorf("command 2 = %q, want the wireguard.exe of the data directory", commands[2])
+			}
+
+			_, err = os.Stat(confPath)
+			if test.outside && err != nil {
+				t.Error("tunnel config outside the data directory was removed")
+			}
+			if !test.outside && !os.IsNotExist(err) {
+				t.Error("tunnel config file wasn't removed")
+			}
+
+			entry := journal.Profiles["podman"]
+			if test.wantTunnel {
+				if entry == nil || entry.Tunnel != "dwnc-podman" || len(entry.Routes) != 0 || len(entry.FirewallGroups) != 0 {
+					t.Errorf("entry = %+v, want only the tunnel left", entry)
+				}
+			} else if entry != nil {
+				t.Errorf("entry = %+v, want it removed", entry)
+			}
+		})
+	}
+}
+
+func TestJournalInDataDir(t *testing.T) {
+	journal := newTestJournal(t)
+	dataDir := filepath.Dir(journal.path)
+
+	tests := []struct {
+		path string
+		want bool
+	}{
+		{path: filepath.Join(dataDir, "dwnc-podman.conf"), want: true},
+		{path: filepath.Join(dataDir, "bin", "wireguard.exe"), want: true},
+		{path: dataDir},
+		{path: filepath.Dir(dataDir)},
+		{path: filepath.Join(dataDir, "..", "dwnc-podman.conf")},
+		{path: dataDir + "-other" + string(filepath.Separator) + "dwnc-podman.conf"},
+		{path: "dwnc-podman.conf"},
+		{path: ""},
+	}
+
+	for _, test := range tests {
+		if inside := journal.inDataDir(test.path); inside != test.want {
+			t.Errorf("inDataDir(%q) = %t, want %t", test.path, inside, test.want)
+		}
+	}
+}
@@ -0,0 +1,651 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v3"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KubernetesSource routes the pod, service and load balancer ranges of local
+// Kubernetes clusters, like Docker Desktop's and kind's, found through a
+// kubeconfig. The ranges aren't Docker networks, the VM reaches them through
+// the cluster nodes.
+type KubernetesSource struct {
+	// Kubeconfig is read by the service, which runs as LocalSystem, so the
+	// path has to be given, like C:\Users\me\.kube\config.
+	Kubeconfig string `json:"kubeconfig"`
+	// Contexts are the kubeconfig contexts to route, path patterns like
+	// "kind-*". Only clusters served from this machine are considered.
+	Contexts []string `json:"contexts"`
+	// Interval is how often the clusters are looked up, 30s by default.
+	Interval string `json:"interval"`
+}
+
+var defaultKubernetesContexts = []string{"docker-desktop", "kind-*"}
+
+// VMRoute is a range the VM reaches through a gateway, sent to the helper in
+// VM_ROUTES. An empty Via leaves the range to the VM's own routes.
+type VMRoute struct {
+	Subnet string `json:"subnet"`
+	Via    string `json:"via,omitempty"`
+}
+
+func (k *KubernetesSource) Validate() error {
+	if k.Kubeconfig == "" {
+		return errors.New("kubernetes needs a kubeconfig path")
+	}
+
+	for _, pattern := range k.Contexts {
+		_, err := path.Match(pattern, "")
+		if err != nil {
+			return fmt.Errorf("invalid kubernetes context pattern %s: %w", pattern, err)
+		}
+	}
+
+	if k.Interval != "" {
+		interval, err := time.ParseDuration(k.Interval)
+		if err != nil || interval < time.Second {
+			return fmt.Errorf("invalid kubernetes interval %s", k.Interval)
+		}
+	}
+
+	return nil
+}
+
+func (k *KubernetesSource) getInterval() time.Duration {
+	interval, err := time.ParseDuration(k.Interval)
+	if err != nil {
+		return 30 * time.Second
+	}
+
+	return interval
+}
+
+func (k *KubernetesSource) matches(context string) bool {
+	patterns := k.Contexts
+	if len(patterns) == 0 {
+		patterns = defaultKubernetesContexts
+	}
+
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, context); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// kubernetesDiscovery looks up the routable ranges of the clusters through
+// their API servers. The service runs as LocalSystem, so it reads the
+// kubeconfig itself and never runs kubectl or the credential plugins a user's
+// kubeconfig names.
+type kubernetesDiscovery struct {
+	source *KubernetesSource
+}
+
+// kubeconfig holds the parts of a kubeconfig the discovery uses.
+type kubeconfig struct {
+	Clusters []struct {
+		Name    string      `yaml:"name"`
+		Cluster kubeCluster `yaml:"cluster"`
+	} `yaml:"clusters"`
+	Users []struct {
+		Name string   `yaml:"name"`
+		User kubeUser `yaml:"user"`
+	} `yaml:"users"`
+	Contexts []struct {
+		Name    string `yaml:"name"`
+		Context struct {
+			Cluster string `yaml:"cluster"`
+			User    string `yaml:"user"`
+		} `yaml:"context"`
+	} `yaml:"contexts"`
+}
+
+type kubeCluster struct {
+	Server                   string `yaml:"server"`
+	CertificateAuthority     string `yaml:"certificate-authority"`
+	CertificateAuthorityData string `yaml:"certificate-authority-data"`
+	InsecureSkipTLSVerify    bool   `yaml:"insecure-skip-tls-verify"`
+}
+
+type kubeUser struct {
+	ClientCertificate     string `yaml:"client-certificate"`
+	ClientCertificateData string `yaml:"client-certificate-data"`
+	ClientKey             string `yaml:"client-key"`
+	ClientKeyData         string `yaml:"client-key-data"`
+	Token                 string `yaml:"token"`
+	TokenFile             string `yaml:"tokenFile"`
+	// Exec and AuthProvider run programs to get credentials, they are only
+	// checked for
+	Exec         *yaml.Node `yaml:"exec"`
+	AuthProvider *yaml.Node `yaml:"auth-provider"`
+}
+
+func loadKubeconfig(path string) (*kubeconfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.New("failed to read kubeconfig: " + err.Error())
+	}
+
+	var config kubeconfig
+	err = yaml.Unmarshal(data, &config)
+	if err != nil {
+		return nil, errors.New("failed to parse kubeconfig: " + err.Error())
+	}
+
+	return &config, nil
+}
+
+// kubeClient talks to the API server of one kubeconfig context.
+type kubeClient struct {
+	server string
+	token  string
+	client *http.Client
+}
+
+// client returns the client of a context. It refuses users that authenticate
+// with exec or auth-provider plugins and credentials kept in files: the
+// plugins would run and the files would be read as LocalSystem, on behalf of
+// whoever can edit the kubeconfig.
+func (c *kubeconfig) client(context string) (*kubeClient, error) {
+	clusterName, userName := "", ""
+	found := false
+	for _, entry := range c.Contexts {
+		if entry.Name == context {
+			clusterName, userName = entry.Context.Cluster, entry.Context.User
+			found = true
+			break
+		}
+	}
+	if !found {
+		return nil, fmt.Errorf("no context %s", context)
+	}
+
+	var cluster *kubeCluster
+	for i := range c.Clusters {
+		if c.Clusters[i].Name == clusterName {
+			cluster = &c.Clusters[i].Cluster
+			break
+		}
+	}
+	if cluster == nil {
+		return nil, fmt.Errorf("no cluster %s", clusterName)
+	}
+
+	var user kubeUser
+	for _, entry := range c.Users {
+		if entry.Name == userName {
+			user = entry.User
+			break
+		}
+	}
+
+	if user.Exec != nil || user.AuthProvider != nil {
+		return nil, fmt.Errorf("user %s authenticates with a credential plugin, the service doesn't run it", userName)
+	}
+	if user.ClientCertificate != "" || user.ClientKey != "" || user.TokenFile != "" || cluster.CertificateAuthority != "" {
+		return nil, fmt.Errorf("context %s keeps credentials in files, the service only reads them from the kubeconfig itself", context)
+	}
+
+	tlsConfig := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: cluster.InsecureSkipTLSVerify,
+	}
+
+	if cluster.CertificateAuthorityData != "" {
+		ca, err := base64.StdEncoding.DecodeString(cluster.CertificateAuthorityData)
+		if err != nil {
+			return nil, errors.New("invalid certificate-authority-data: " + err.Error())
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, errors.New("no certificate in certificate-authority-data")
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if user.ClientCertificateData != "" || user.ClientKeyData != "" {
+		certificate, err := base64.StdEncoding.DecodeString(user.ClientCertificateData)
+		if err != nil {
+			return nil, errors.New("invalid client-certificate-data: " + err.Error())
+		}
+		key, err := base64.StdEncoding.DecodeString(user.ClientKeyData)
+		if err != nil {
+			return nil, errors.New("invalid client-key-data: " + err.Error())
+		}
+
+		pair, err := tls.X509KeyPair(certificate, key)
+		if err != nil {
+			return nil, errors.New("invalid client certificate: " + err.Error())
+		}
+		tlsConfig.Certificates = []tls.Certificate{pair}
+	}
+
+	return &kubeClient{
+		server: strings.TrimSuffix(cluster.Server, "/"),
+		token:  user.Token,
+		client: &http.Client{
+			Timeout:   5 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: tlsConfig},
+			// the server was checked to be local, a redirect could lead
+			// the credentials elsewhere
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+	}, nil
+}
+
+// Discover returns the routes of every matching cluster that answers, keyed
+// by context. Clusters that don't answer are left out, they come back once
+// they do.
+func (d *kubernetesDiscovery) Discover(log *Logger) (map[string][]VMRoute, error) {
+	config, err := loadKubeconfig(d.source.Kubeconfig)
+	if err != nil {
+		return nil, err
+	}
+
+	clusters := make(map[string][]VMRoute)
+	for _, context := range d.localContexts(config) {
+		client, err := config.client(context)
+		if err != nil {
+			log.Warning(EventKubernetesFailed, "Kubernetes context can't be used", "context", context, "error", err)
+			continue
+		}
+
+		routes, err := d.discoverCluster(client)
+		client.client.CloseIdleConnections()
+		if err != nil {
+			log.Debug(EventKubernetesFailed, "Kubernetes cluster not reachable", "context", context, "error", err)
+			continue
+		}
+		clusters[context] = routes
+	}
+
+	return clusters, nil
+}
+
+// localContexts returns the matching contexts whose API server runs on this
+// machine, remote clusters aren't behind the Docker VM.
+func (d *kubernetesDiscovery) localContexts(config *kubeconfig) []string {
+	servers := make(map[string]string)
+	for _, cluster := range config.Clusters {
+		servers[cluster.Name] = cluster.Cluster.Server
+	}
+
+	var contexts []string
+	for _, context := range config.Contexts {
+		if d.source.matches(context.Name) && isLocalServer(servers[context.Context.Cluster]) {
+			contexts = append(contexts, context.Name)
+		}
+	}
+	sort.Strings(contexts)
+
+	return contexts
+}
+
+func isLocalServer(server string) bool {
+	u, err := url.Parse(server)
+	if err != nil {
+		return false
+	}
+
+	host := u.Hostname()
+	if host == "localhost" || host == "kubernetes.docker.internal" || host == "host.docker.internal" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+
+	return ip != nil && ip.IsLoopback()
+}
+
+type kubeList struct {
+	Items []json.RawMessage `json:"items"`
+}
+
+// list gets a list of resources from the API server, like /api/v1/nodes.
+func (c *kubeClient) list(path string) ([]json.RawMessage, error) {
+	request, err := http.NewRequest(http.MethodGet, c.server+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	request.Header.Set("Accept", "application/json")
+	if c.token != "" {
+		request.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	response, err := c.client.Do(request)
+	if err != nil {
+		return nil, err
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s answered %s", path, response.Status)
+	}
+
+	var list kubeList
+	err = json.NewDecoder(response.Body).Decode(&list)
+	if err != nil {
+		return nil, err
+	}
+
+	return list.Items, nil
+}
+
+// discoverCluster collects the pod CIDR of every node, reached through that
+// node, and the service and load balancer ranges, reached through the first
+// node.
+func (d *kubernetesDiscovery) discoverCluster(client *kubeClient) ([]VMRoute, error) {
+	nodes, err := client.list("/api/v1/nodes")
+	if err != nil {
+		return nil, errors.New("failed to list nodes: " + err.Error())
+	}
+
+	var routes []VMRoute
+	gateway := ""
+	for _, item := range nodes {
+		var node struct {
+			Spec struct {
+				PodCIDR  string   `json:"podCIDR"`
+				PodCIDRs []string `json:"podCIDRs"`
+			} `json:"spec"`
+			Status struct {
+				Addresses []struct {
+					Type    string `json:"type"`
+					Address string `json:"address"`
+				} `json:"addresses"`
+			} `json:"status"`
+		}
+		if json.Unmarshal(item, &node) != nil {
+			continue
+		}
+
+		nodeIp := ""
+		for _, address := range node.Status.Addresses {
+			if address.Type == "InternalIP" && net.ParseIP(address.Address).To4() != nil {
+				nodeIp = address.Address
+				break
+			}
+		}
+		if nodeIp == "" {
+			continue
+		}
+		if gateway == "" {
+			gateway = nodeIp
+		}
+
+		podCIDRs := node.Spec.PodCIDRs
+		if len(podCIDRs) == 0 && node.Spec.PodCIDR != "" {
+			podCIDRs = []string{node.Spec.PodCIDR}
+		}
+		for _, cidr := range podCIDRs {
+			routes = appendIPv4Route(routes, cidr, nodeIp)
+		}
+	}
+
+	if gateway == "" {
+		return nil, errors.New("no node with an IPv4 address")
+	}
+
+	serviceCIDR := d.serviceCIDR(client)
+	if serviceCIDR != "" {
+		routes = appendIPv4Route(routes, serviceCIDR, gateway)
+	}
+
+	services, err := client.list("/api/v1/services")
+	if err != nil {
+		return nil, errors.New("failed to list services: " + err.Error())
+	}
+
+	for _, item := range services {
+		var service struct {
+			Spec struct {
+				ClusterIP string `json:"clusterIP"`
+			} `json:"spec"`
+			Status struct {
+				LoadBalancer struct {
+					Ingress []struct {
+						Ip string `json:"ip"`
+					} `json:"ingress"`
+				} `json:"loadBalancer"`
+			} `json:"status"`
+		}
+		if json.Unmarshal(item, &service) != nil {
+			continue
+		}
+
+		// without the service range every cluster IP is routed on its own
+		if serviceCIDR == "" && net.ParseIP(service.Spec.ClusterIP) != nil {
+			routes = appendIPv4Route(routes, service.Spec.ClusterIP+"/32", gateway)
+		}
+		for _, ingress := range service.Status.LoadBalancer.Ingress {
+			if net.ParseIP(ingress.Ip) != nil {
+				routes = appendIPv4Route(routes, ingress.Ip+"/32", gateway)
+			}
+		}
+	}
+
+	for _, cidr := range d.loadBalancerPools(client) {
+		routes = appendIPv4Route(routes, cidr, gateway)
+	}
+
+	return routes, nil
+}
+
+// serviceCIDR reads the service range from the flags of the kube-apiserver
+// static pod, as set up by kubeadm for Docker Desktop and kind. It returns
+// an empty string when the range can't be found.
+func (d *kubernetesDiscovery) serviceCIDR(client *kubeClient) string {
+	pods, err := client.list("/api/v1/namespaces/kube-system/pods?labelSelector=" + url.QueryEscape("component=kube-apiserver"))
+	if err != nil {
+		return ""
+	}
+
+	for _, item := range pods {
+		var pod struct {
+			Spec struct {
+				Containers []struct {
+					Command []string `json:"command"`
+					Args    []string `json:"args"`
+				} `json:"containers"`
+			} `json:"spec"`
+		}
+		if json.Unmarshal(item, &pod) != nil {
+			continue
+		}
+
+		for _, container := range pod.Spec.Containers {
+			for _, arg := range append(container.Command, container.Args...) {
+				value, found := strings.CutPrefix(arg, "--service-cluster-ip-range=")
+				if !found {
+					continue
+				}
+				// dual stack clusters list both families
+				for _, cidr := range strings.Split(value, ",") {
+					ip, _, err := net.ParseCIDR(cidr)
+					if err == nil && ip.To4() != nil {
+						return cidr
+					}
+				}
+			}
+		}
+	}
+
+	return ""
+}
+
+// loadBalancerPools returns the address pools of MetalLB, which kind clusters
+// commonly use for LoadBalancer services. Clusters without MetalLB have none.
+func (d *kubernetesDiscovery) loadBalancerPools(client *kubeClient) []string {
+	pools, err := client.list("/apis/metallb.io/v1beta1/ipaddresspools")
+	if err != nil {
+		return nil
+	}
+
+	var cidrs []string
+	for _, item := range pools {
+		var pool struct {
+			Spec struct {
+				Addresses []string `json:"addresses"`
+			} `json:"spec"`
+		}
+		if json.Unmarshal(item, &pool) != nil {
+			continue
+		}
+
+		for _, address := range pool.Spec.Addresses {
+			cidrs = append(cidrs, rangeToCIDRs(address)...)
+		}
+	}
+
+	return cidrs
+}
+
+func appendIPv4Route(routes []VMRoute, cidr, via string) []VMRoute {
+	ip, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil || ip.To4() == nil {
+		return routes
+	}
+	// a cluster can't take the default route over
+	if ones, _ := ipNet.Mask.Size(); ones == 0 {
+		return routes
+	}
+
+	for _, route := range routes {
+		if route.Subnet == ipNet.String() {
+			return routes
+		}
+	}
+
+	return append(routes, VMRoute{Subnet: ipNet.String(), Via: via})
+}
+
+// rangeToCIDRs turns a CIDR or an IPv4 range like 172.18.255.200-172.18.255.250
+// into the CIDRs covering it. The whole address space isn't a range, it would
+// take the default route over.
+func rangeToCIDRs(address string) []string {
+	from, to, found := strings.Cut(address, "-")
+	if !found {
+		_, ipNet, err := net.ParseCIDR(strings.TrimSpace(address))
+		if err == nil {
+			if ones, _ := ipNet.Mask.Size(); ones == 0 {
+				return nil
+			}
+		}
+		return []string{strings.TrimSpace(address)}
+	}
+
+	start := net.ParseIP(strings.TrimSpace(from)).To4()
+	end := net.ParseIP(strings.TrimSpace(to)).To4()
+	if start == nil || end == nil {
+		return nil
+	}
+
+	first := uint64(start[0])<<24 | uint64(start[1])<<16 | uint64(start[2])<<8 | uint64(start[3])
+	last := uint64(end[0])<<24 | uint64(end[1])<<16 | uint64(end[2])<<8 | uint64(end[3])
+
+	var cidrs []string
+	for first <= last {
+		// the largest aligned block starting at first that ends before last
+		size := 32
+		for size > 0 {
+			block := uint64(1) << (32 - size + 1)
+			if first%block != 0 || first+block-1 > last {
+				break
+			}
+			size--
+		}
+
+		if size == 0 {
+			return nil
+		}
+
+		ip := net.IPv4(byte(first>>24), byte(first>>16), byte(first>>8), byte(first))
+		cidrs = append(cidrs, fmt.Sprintf("%s/%d", ip, size))
+		first += uint64(1) << (32 - size)
+	}
+
+	return cidrs
+}
+
+// watchKubernetes looks the clusters up right away and then every interval
+// and sends the routes clear of the host's ranges when they changed.
+func (w *Wireguard) watchKubernetes(ctx context.Context, results chan<- map[string][]VMRoute) {
+	discovery := &kubernetesDiscovery{source: w.kubernetes}
+	ticker := time.NewTicker(w.kubernetes.getInterval())
+	defer ticker.Stop()
+
+	var last map[string][]VMRoute
+	for {
+		clusters, err := discovery.Discover(w.log)
+		if err != nil {
+			w.log.Warning(EventKubernetesFailed, "Failed to look up Kubernetes clusters", "error", err)
+		} else if !equalSources(clusters, last) {
+			// the changed clusters are tried again next time when the
+			// ranges can't be checked
+			cleared, err := w.clearRanges(kubernetesSource, clusters)
+			if err != nil {
+				w.log.Warning(EventKubernetesFailed, "Failed to check Kubernetes ranges against the host's routes", "error", err)
+			} else {
+				select {
+				case results <- cleared:
+					last = clusters
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func equalSources(a, b map[string][]VMRoute) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for id, routes := range a {
+		if !equalRoutes(routes, b[id]) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func equalRoutes(a, b []VMRoute) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
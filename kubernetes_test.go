@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestRangeToCIDRs(t *testing.T) {
+	tests := []struct {
+		address string
+		want    []string
+	}{
+		{address: "10.96.0.0/12", want: []string{"10.96.0.0/12"}},
+		{address: " 10.96.0.0/12 ", want: []string{"10.96.0.0/12"}},
+		{address: "172.18.255.200-172.18.255.200", want: []string{"172.18.255.200/32"}},
+		{address: "172.18.255.0-172.18.255.255", want: []string{"172.18.255.0/24"}},
+		{address: "172.18.255.200 - 172.18.255.207", want: []string{"172.18.255.200/29"}},
+		{
+			address: "172.18.255.200-172.18.255.250",
+			want: []string{
+				"172.18.255.200/29",
+				"172.18.255.208/28",
+				"172.18.255.224/28",
+				"172.18.255.240/29",
+				"172.18.255.248/31",
+				"172.18.255.250/32",
+			},
+		},
+		{address: "10.0.0.255-10.0.1.0", want: []string{"10.0.0.255/32", "10.0.1.0/32"}},
+		{address: "0.0.0.0-255.255.255.255"},
+		{address: "0.0.0.0/0"},
+		{address: "0.0.0.0-127.255.255.255", want: []string{"0.0.0.0/1"}},
+		{address: "172.18.255.250-172.18.255.200"},
+		{address: "172.18.255.200-fd00::1"},
+		{address: "invalid-172.18.255.200"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			cidrs := rangeToCIDRs(test.address)
+			if strings.Join(cidrs, " ") != strings.Join(test.want, " ") {
+				t.Errorf("rangeToCIDRs(%q) = %q, want %q", test.address, cidrs, test.want)
+			}
+		})
+	}
+}
+
+func writeKubeconfig(t *testing.T, server, user string) string {
+	path := filepath.Join(t.TempDir(), "config")
+	config := fmt.Sprintf(`apiVersion: v1
+kind: Config
+clusters:
+- name: kind-a
+  cluster:
+    server: %s
+    insecure-skip-tls-verify: true
+- name: remote
+  cluster:
+    server: https://k8s.example.com
+contexts:
+- name: kind-a
+  context:
+    cluster: kind-a
+    user: kind-a
+- name: kind-remote
+  context:
+    cluster: remote
+    user: kind-a
+users:
+- name: kind-a
+  user:
+%s`, server, user)
+
+	err := os.WriteFile(path, []byte(config), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func TestKubeconfigClient(t *testing.T) {
+	tests := []struct {
+		name    string
+		user    string
+		wantErr bool
+	}{
+		{name: "token", user: "    token: secret\n"},
+		{name: "no credentials", user: "    {}\n"},
+		{name: "exec plugin", user: "    exec:\n      command: C:\\evil.exe\n", wantErr: true},
+		{name: "auth provider", user: "    auth-provider:\n      name: oidc\n", wantErr: true},
+		{name: "token file", user: "    tokenFile: C:\\Windows\\secret\n", wantErr: true},
+		{name: "client key file", user: "    client-certificate: cert.pem\n    client-key: key.pem\n", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			config, err := loadKubeconfig(writeKubeconfig(t, "https://127.0.0.1:6443", test.user))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = config.client("kind-a")
+			if (err != nil) != test.wantErr {
+				t.Errorf("client() error = %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestKubernetesDiscover(t *testing.T) {
+	responses := map[string]string{
+		"/api/v1/nodes": `{"items": [
+			{"spec": {"podCIDR": "10.244.0.0/24"}, "status": {"addresses": [{"type": "InternalIP", "address": "172.18.0.2"}]}},
+			{"spec": {"podCIDRs": ["10.244.1.0/24", "fd00:10:244:1::/64"]}, "status": {"addresses": [{"type": "InternalIP", "address": "172.18.0.3"}]}}
+		]}`,
+		"/api/v1/namespaces/kube-system/pods": `{"items": [
+			{"spec": {"containers": [{"command": ["kube-apiserver", "--service-cluster-ip-range=10.96.0.0/16"]}]}}
+		]}`,
+		"/api/v1/services": `{"items": [
+			{"spec": {"clusterIP": "10.96.0.1"}, "status": {"loadBalancer": {"ingress": [{"ip": "172.18.255.200"}]}}}
+		]}`,
+		"/apis/metallb.io/v1beta1/ipaddresspools": `{"items": [
+			{"spec": {"addresses": ["172.18.255.208-172.18.255.215"]}}
+		]}`,
+	}
+
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		response, ok := responses[r.URL.Path]
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		_, _ = w.Write([]byte(response))
+	}))
+	defer server.Close()
+
+	path := writeKubeconfig(t, server.URL, "    token: secret\n")
+	discovery := &kubernetesDiscovery{source: &KubernetesSource{Kubeconfig: path}}
+
+	// the server certificate is checked against the inline authority
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = []byte(strings.Replace(string(data), "insecure-skip-tls-verify: true", "certificate-authority-data: "+base64.StdEncoding.EncodeToString(ca), 1))
+	err = os.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	clusters, err := discovery.Discover(NewLogger(LevelDebug, &memorySink{}))
+	if err != nil {
+		t.Fatalf("Discover failed: %v", err)
+	}
+
+	if _, ok := clusters["kind-remote"]; ok {
+		t.Error("the cluster of a remote server is discovered")
+	}
+	want := []VMRoute{
+		{Subnet: "10.244.0.0/24", Via: "172.18.0.2"},
+		{Subnet: "10.244.1.0/24", Via: "172.18.0.3"},
+		{Subnet: "10.96.0.0/16", Via: "172.18.0.2"},
+		{Subnet: "172.18.255.200/32", Via: "172.18.0.2"},
+		{Subnet: "172.18.255.208/29", Via: "172.18.0.2"},
+	}
+	if routes := clusters["kind-a"]; !equalRoutes(routes, want) {
+		t.Errorf("routes = %v, want %v", routes, want)
+	}
+}
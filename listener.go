@@ -0,0 +1,190 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// listenerRuleCount is the number of firewall rules that lock down the
+// WireGuard listener when they are all in place.
+const listenerRuleCount = 3
+
+func newListenerFirewall(interfaceName string) *Firewall {
+	return NewFirewall(interfaceName + " listener")
+}
+
+// getVmSourceRanges returns the networks the Docker VM reaches the host from,
+// the configured ones or those of the WSL and Hyper-V virtual switches.
+func getVmSourceRanges(configured []string) ([]*net.IPNet, error) {
+	var ranges []*net.IPNet
+	for _, source := range configured {
+		_, ipNet, err := net.ParseCIDR(source)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listener source %s: %w", source, err)
+		}
+		ranges = append(ranges, ipNet)
+	}
+	if len(ranges) > 0 {
+		return ranges, nil
+	}
+
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range interfaces {
+		if !strings.HasPrefix(i.Name, "vEthernet (WSL") && i.Name != "vEthernet (DockerNAT)" {
+			continue
+		}
+
+		addrs, err := i.Addrs()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if !ok || ipNet.IP.To4() == nil {
+				continue
+			}
+			ranges = append(ranges, &net.IPNet{IP: ipNet.IP.Mask(ipNet.Mask), Mask: ipNet.Mask})
+		}
+	}
+
+	if len(ranges) == 0 {
+		return nil, errors.New("no WSL or Hyper-V virtual switch found, set listenerSources in the config")
+	}
+
+	return ranges, nil
+}
+
+// excludeRanges returns the IPv4 address ranges not covered by networks, in the
+// "first-last" form Windows Firewall accepts.
+func excludeRanges(networks []*net.IPNet) []string {
+	type span struct{ first, last uint64 }
+
+	var spans []span
+	for _, ipNet := range networks {
+		ip := ipNet.IP.To4()
+		if ip == nil {
+			continue
+		}
+		ones, _ := ipNet.Mask.Size()
+		first := uint64(binary.BigEndian.Uint32(ip.Mask(ipNet.Mask)))
+		spans = append(spans, span{first, first + (1 << (32 - ones)) - 1})
+	}
+	sort.Slice(spans, func(i, j int) bool { return spans[i].first < spans[j].first })
+
+	var ranges []string
+	next := uint64(0)
+	for _, s := range spans {
+		if s.first > next {
+			ranges = append(ranges, formatRange(next, s.first-1))
+		}
+		if s.last+1 > next {
+			next = s.last + 1
+		}
+	}
+	if next <= 0xffffffff {
+		ranges = append(ranges, formatRange(next, 0xffffffff))
+	}
+
+	return ranges
+}
+
+func formatRange(first, last uint64) string {
+	ip := func(n uint64) string {
+		b := make(net.IP, 4)
+		binary.BigEndian.PutUint32(b, uint32(n))
+		return b.String()
+	}
+
+	return ip(first) + "-" + ip(last)
+}
+
+// lockDownListener allows the WireGuard port only from the VM source ranges.
+// Block rules win over allow rules in Windows Firewall, so everything else is
+// blocked explicitly.
+func (w *Wireguard) lockDownListener() error {
+	ranges, err := getVmSourceRanges(w.listenerSources)
+	if err != nil {
+		return err
+	}
+
+	sources := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		sources = append(sources, r.String())
+	}
+
+	err = w.listenerFirewall.Clear()
+	if err != nil {
+		return err
+	}
+
+	port := strconv.Itoa(w.port)
+	rules := []FirewallRule{
+		{
+			Name:          fmt.Sprintf("%s listener allow VM", w.interfaceName),
+			Action:        "Allow",
+			Protocol:      "UDP",
+			LocalPort:     port,
+			RemoteAddress: sources,
+		},
+		{
+			Name:          fmt.Sprintf("%s listener block IPv4", w.interfaceName),
+			Action:        "Block",
+			Protocol:      "UDP",
+			LocalPort:     port,
+			RemoteAddress: excludeRanges(ranges),
+		},
+		{
+			Name:          fmt.Sprintf("%s listener block IPv6", w.interfaceName),
+			Action:        "Block",
+			Protocol:      "UDP",
+			LocalPort:     port,
+			RemoteAddress: []string{"::/0"},
+		},
+	}
+
+	for _, rule := range rules {
+		err = w.listenerFirewall.AddRule(rule)
+		if err != nil {
+			return err
+		}
+	}
+	w.listenerRanges = strings.Join(sources, ",")
+
+	return nil
+}
+
+// checkListener applies the listener rules again when some of them were
+// removed or the VM source ranges changed since they were applied.
+func (w *Wireguard) checkListener() error {
+	ranges, err := getVmSourceRanges(w.listenerSources)
+	if err != nil {
+		return err
+	}
+
+	sources := make([]string, 0, len(ranges))
+	for _, r := range ranges {
+		sources = append(sources, r.String())
+	}
+
+	rules, err := w.listenerFirewall.Rules()
+	if err != nil {
+		return err
+	}
+	if len(rules) >= listenerRuleCount && strings.Join(sources, ",") == w.listenerRanges {
+		return nil
+	}
+
+	w.log.Info(EventRestrictingListener, "Listener firewall rules are missing or outdated, applying them again", "rules", len(rules), "sources", strings.Join(sources, ","))
+
+	return w.lockDownListener()
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestExcludeRanges(t *testing.T) {
+	tests := []struct {
+		name     string
+		networks []string
+		want     []string
+	}{
+		{name: "nothing covered", want: []string{"0.0.0.0-255.255.255.255"}},
+		{
+			name:     "one network",
+			networks: []string{"172.20.0.0/20"},
+			want:     []string{"0.0.0.0-172.19.255.255", "172.20.16.0-255.255.255.255"},
+		},
+		{
+			name:     "unsorted networks",
+			networks: []string{"192.168.1.0/24", "172.20.0.0/20"},
+			want: []string{
+				"0.0.0.0-172.19.255.255",
+				"172.20.16.0-192.168.0.255",
+				"192.168.2.0-255.255.255.255",
+			},
+		},
+		{
+			name:     "nested networks",
+			networks: []string{"172.16.0.0/12", "172.20.0.0/20"},
+			want:     []string{"0.0.0.0-172.15.255.255", "172.32.0.0-255.255.255.255"},
+		},
+		{
+			name:     "adjacent networks",
+			networks: []string{"10.0.0.0/24", "10.0.1.0/24"},
+			want:     []string{"0.0.0.0-9.255.255.255", "10.0.2.0-255.255.255.255"},
+		},
+		{name: "range start", networks: []string{"0.0.0.0/8"}, want: []string{"1.0.0.0-255.255.255.255"}},
+		{name: "range end", networks: []string{"255.255.255.0/24"}, want: []string{"0.0.0.0-255.255.254.255"}},
+		{name: "everything", networks: []string{"0.0.0.0/0"}},
+		{name: "IPv6 is ignored", networks: []string{"fd00::/64"}, want: []string{"0.0.0.0-255.255.255.255"}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var networks []*net.IPNet
+			for _, cidr := range test.networks {
+				_, ipNet, err := net.ParseCIDR(cidr)
+				if err != nil {
+					t.Fatal(err)
+				}
+				networks = append(networks, ipNet)
+			}
+
+			ranges := excludeRanges(networks)
+			if strings.Join(ranges, " ") != strings.Join(test.want, " ") {
+				t.Errorf("excludeRanges = %q, want %q", ranges, test.want)
+			}
+		})
+	}
+}
+
+func TestGetVmSourceRangesConfigured(t *testing.T) {
+	tests := []struct {
+		name       string
+		configured []string
+		want       []string
+		wantErr    bool
+	}{
+		{name: "networks", configured: []string{"172.20.0.0/20", "192.168.1.10/24"}, want: []string{"172.20.0.0/20", "192.168.1.0/24"}},
+		{name: "invalid network", configured: []string{"172.20.0.0/20", "172.20.0.0"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ranges, err := getVmSourceRanges(test.configured)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("getVmSourceRanges = %v, want an error", ranges)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("getVmSourceRanges failed: %v", err)
+			}
+
+			var cidrs []string
+			for _, ipNet := range ranges {
+				cidrs = append(cidrs, ipNet.String())
+			}
+			if strings.Join(cidrs, " ") != strings.Join(test.want, " ") {
+				t.Errorf("getVmSourceRanges = %q, want %q", cidrs, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/sys/windows/svc/debug"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarning
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug:   "debug",
+	LevelInfo:    "info",
+	LevelWarning: "warning",
+	LevelError:   "error",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func ParseLevel(s string) (Level, error) {
+	if s == "" {
+		return LevelInfo, nil
+	}
+
+	for level, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return level, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown log level %s", s)
+}
+
+type Field struct {
+	Key   string
+	Value any
+}
+
+type Entry struct {
+	Time    time.Time
+	Level   Level
+	Event   Event
+	Message string
+	Fields  []Field
+}
+
+// text renders the message followed by the fields as key=value pairs.
+func (e *Entry) text() string {
+	var b strings.Builder
+	b.WriteString(e.Message)
+	for _, field := range e.Fields {
+		_, _ = fmt.Fprintf(&b, " %s=%v", field.Key, field.Value)
+	}
+
+	return b.String()
+}
+
+// Sink receives every entry at or above the logger level.
+type Sink interface {
+	Write(entry *Entry) error
+	Close() error
+}
+
+type loggerCore struct {
+	mu    sync.Mutex
+	level Level
+	sinks []Sink
+}
+
+// Logger writes leveled entries with an event ID from the catalog and
+// structured fields to all of its sinks. Loggers derived with With share the
+// sinks and the level.
+type Logger struct {
+	core   *loggerCore
+	fields []Field
+}
+
+// logger is replaced by runService once the sinks are known, until then
+// entries go to stdout.
+var logger = NewLogger(LevelInfo, NewStdoutSink())
+
+func NewLogger(level Level, sinks ...Sink) *Logger {
+	return &Logger{
+		core: &loggerCore{
+			level: level,
+			sinks: sinks,
+		},
+	}
+}
+
+// With returns a logger adding the given key/value pairs to every entry.
+func (l *Logger) With(pairs ...any) *Logger {
+	return &Logger{
+		core:   l.core,
+		fields: append(append([]Field(nil), l.fields...), toFields(pairs)...),
+	}
+}
+
+func (l *Logger) SetLevel(level Level) {
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+	l.core.level = level
+}
+
+func (l *Logger) Close() error {
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+
+	var errs []error
+	for _, sink := range l.core.sinks {
+		errs = append(errs, sink.Close())
+	}
+
+	return errors.Join(errs...)
+}
+
+func (l *Logger) Debug(event Event, message string, pairs ...any) {
+	l.log(LevelDebug, event, message, pairs)
+}
+
+func (l *Logger) Info(event Event, message string, pairs ...any) {
+	l.log(LevelInfo, event, message, pairs)
+}
+
+func (l *Logger) Warning(event Event, message string, pairs ...any) {
+	l.log(LevelWarning, event, message, pairs)
+}
+
+func (l *Logger) Error(event Event, message string, pairs ...any) {
+	l.log(LevelError, event, message, pairs)
+}
+
+func (l *Logger) log(level Level, event Event, message string, pairs []any) {
+	l.core.mu.Lock()
+	defer l.core.mu.Unlock()
+
+	if level < l.core.level {
+		return
+	}
+
+	entry := &Entry{
+		Time:    time.Now(),
+		Level:   level,
+		Event:   event,
+		Message: message,
+		Fields:  append(append([]Field(nil), l.fields...), toFields(pairs)...),
+	}
+
+	for _, sink := range l.core.sinks {
+		// a failing sink must not take the others down
+		_ = sink.Write(entry)
+	}
+}
+
+func toFields(pairs []any) []Field {
+	var fields []Field
+	for i := 0; i+1 < len(pairs); i += 2 {
+		value := pairs[i+1]
+		if err, ok := value.(error); ok {
+			value = err.Error()
+		}
+		fields = append(fields, Field{Key: fmt.Sprint(pairs[i]), Value: value})
+	}
+
+	return fields
+}
+
+func getLogPath(name string) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", errors.New("failed to get executable path: " + err.Error())
+	}
+
+	return filepath.Join(filepath.Dir(exe), name+".log"), nil
+}
+
+// newLogFileSink opens the JSON log file configured for the named service, it
+// returns nil when the file is turned off.
+func newLogFileSink(name string, config LogConfig) (*FileSink, error) {
+	path := config.File
+	if path == "off" {
+		return nil, nil
+	}
+	if path == "" {
+		var err error
+		path, err = getLogPath(name)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	maxSize := int64(config.MaxSizeMB) << 20
+	if maxSize <= 0 {
+		maxSize = 10 << 20
+	}
+
+	maxFiles := config.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = 5
+	}
+
+	return NewFileSink(path, maxSize, maxFiles)
+}
+
+// EventLogSink writes to the Windows Event Log, or to the console when running
+// in debug mode.
+type EventLogSink struct {
+	log debug.Log
+}
+
+func NewEventLogSink(log debug.Log) *EventLogSink {
+	return &EventLogSink{log: log}
+}
+
+func (s *EventLogSink) Write(entry *Entry) error {
+	switch entry.Level {
+	case LevelError:
+		return s.log.Error(uint32(entry.Event), entry.text())
+	case LevelWarning:
+		return s.log.Warning(uint32(entry.Event), entry.text())
+	default:
+		return s.log.Info(uint32(entry.Event), entry.text())
+	}
+}
+
+func (s *EventLogSink) Close() error {
+	return s.log.Close()
+}
+
+type StdoutSink struct{}
+
+func NewStdoutSink() *StdoutSink {
+	return &StdoutSink{}
+}
+
+func (s *StdoutSink) Write(entry *Entry) error {
+	_, err := fmt.Fprintf(os.Stdout, "%s %-7s %4d %s\n", entry.Time.Format(time.RFC3339), strings.ToUpper(entry.Level.String()), entry.Event, entry.text())
+
+	return err
+}
+
+func (s *StdoutSink) Close() error {
+	return nil
+}
+
+// FileSink writes one JSON object per line and rotates the file once it grows
+// past maxSize, keeping maxFiles old files as path.1, path.2 and so on.
+type FileSink struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+}
+
+func NewFileSink(path string, maxSize int64, maxFiles int) (*FileSink, error) {
+	s := &FileSink{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+
+	err := s.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *FileSink) open() error {
+	file, err := os.OpenFile(s.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return errors.New("failed to open log file: " + err.Error())
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		_ = file.Close()
+		return errors.New("failed to stat log file: " + err.Error())
+	}
+
+	s.file = file
+	s.size = info.Size()
+
+	return nil
+}
+
+// rotate closes the file, shifts the old files and opens a new one. When the
+// new file can't be opened the sink stays without a file and Write opens it
+// again, so a failed rotation doesn't drop every later entry.
+func (s *FileSink) rotate() error {
+	err := s.file.Close()
+	s.file = nil
+	if err != nil {
+		return err
+	}
+
+	for i := s.maxFiles - 1; i > 0; i-- {
+		_ = os.Rename(fmt.Sprintf("%s.%d", s.path, i), fmt.Sprintf("%s.%d", s.path, i+1))
+	}
+
+	if s.maxFiles > 0 {
+		_ = os.Rename(s.path, s.path+".1")
+	} else {
+		_ = os.Remove(s.path)
+	}
+
+	return s.open()
+}
+
+func (s *FileSink) Write(entry *Entry) error {
+	record := map[string]any{
+		"time":    entry.Time.Format(time.RFC3339Nano),
+		"level":   entry.Level.String(),
+		"event":   entry.Event,
+		"message": entry.Message,
+	}
+	for _, field := range entry.Fields {
+		record[field.Key] = field.Value
+	}
+
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+
+	if s.file == nil {
+		err = s.open()
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.size+int64(len(data)) > s.maxSize {
+		err = s.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	n, err := s.file.Write(data)
+	s.size += int64(n)
+
+	return err
+}
+
+func (s *FileSink) Close() error {
+	if s.file == nil {
+		return nil
+	}
+
+	return s.file.Close()
+}
@@ -0,0 +1,178 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// memorySink keeps the entries written to it.
+type memorySink struct {
+	entries []*Entry
+}
+
+func (s *memorySink) Write(entry *Entry) error {
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+func (s *memorySink) Close() error {
+	return nil
+}
+
+func TestParseLevel(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    Level
+		wantErr bool
+	}{
+		{value: "", want: LevelInfo},
+		{value: "debug", want: LevelDebug},
+		{value: "info", want: LevelInfo},
+		{value: "Warning", want: LevelWarning},
+		{value: "ERROR", want: LevelError},
+		{value: "verbose", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			level, err := ParseLevel(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("ParseLevel(%q) = %s, want an error", test.value, level)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("ParseLevel(%q) failed: %v", test.value, err)
+			}
+			if level != test.want {
+				t.Errorf("ParseLevel(%q) = %s, want %s", test.value, level, test.want)
+			}
+		})
+	}
+}
+
+func TestLogger(t *testing.T) {
+	sink := &memorySink{}
+	log := NewLogger(LevelInfo, sink)
+	profileLog := log.With("profile", "podman")
+
+	log.Debug(EventServiceStarting, "Hidden")
+	profileLog.Info(EventServiceStarting, "Starting", "attempt", 2)
+	profileLog.Error(EventServiceStarting, "Failed", "error", errors.New("no engine"))
+	log.SetLevel(LevelDebug)
+	log.Debug(EventServiceStarting, "Shown", "dangling")
+
+	want := []string{
+		"info Starting profile=podman attempt=2",
+		"error Failed profile=podman error=no engine",
+		"debug Shown",
+	}
+
+	var got []string
+	for _, entry := range sink.entries {
+		got = append(got, entry.Level.String()+" "+entry.text())
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("entries = %q, want %q", got, want)
+	}
+}
+
+func TestFileSinkRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "service.log")
+	sink, err := NewFileSink(path, 200, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	for i := 0; i < 10; i++ {
+		err = sink.Write(&Entry{Time: time.Now(), Level: LevelInfo, Event: EventServiceStarting, Message: fmt.Sprintf("entry %d", i)})
+		if err != nil {
+			t.Fatalf("Write failed: %v", err)
+		}
+	}
+
+	for _, name := range []string{path, path + ".1", path + ".2"} {
+		info, err := os.Stat(name)
+		if err != nil {
+			t.Fatalf("%s is missing: %v", filepath.Base(name), err)
+		}
+		if info.Size() > 200 {
+			t.Errorf("%s has %d bytes, more than the maximum", filepath.Base(name), info.Size())
+		}
+	}
+	if _, err := os.Stat(path + ".3"); !os.IsNotExist(err) {
+		t.Errorf("%s.3 exists, only 2 old files are kept", filepath.Base(path))
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+
+	var last map[string]any
+	err = json.Unmarshal([]byte(lines[len(lines)-1]), &last)
+	if err != nil {
+		t.Fatalf("last line is not JSON: %v", err)
+	}
+	if last["message"] != "entry 9" || last["level"] != "info" {
+		t.Errorf("last entry = %v, want entry 9 at info", last)
+	}
+}
+
+func TestFileSinkRecoversFromFailedRotation(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "logs")
+	err := os.Mkdir(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "service.log")
+	sink, err := NewFileSink(path, 100, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+
+	entry := &Entry{Time: time.Now(), Level: LevelInfo, Event: EventServiceStarting, Message: strings.Repeat("x", 60)}
+	err = sink.Write(entry)
+	if err != nil {
+		t.Fatalf("Write failed: %v", err)
+	}
+
+	// the rotation can't open a new file without the directory
+	err = os.RemoveAll(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Write(entry)
+	if err == nil {
+		t.Fatal("Write succeeded without the log directory")
+	}
+
+	err = os.Mkdir(dir, 0700)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = sink.Write(entry)
+	if err != nil {
+		t.Fatalf("Write after the directory is back failed: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), entry.Message) {
+		t.Errorf("log file = %q, want the entry written after the failed rotation", data)
+	}
+}
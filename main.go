@@ -34,6 +34,13 @@ func main() {
 
 	installer := NewInstaller(os.Args[0], svcName, "Docker network hacking service")
 	manager := NewManager(svcName)
+	control := NewControlClient(svcName)
+
+	// commands acting on a single profile take its name as the next argument
+	profile := ""
+	if len(os.Args) > 2 {
+		profile = os.Args[2]
+	}
 
 	cmd := strings.ToLower(os.Args[1])
 	switch cmd {
@@ -41,7 +48,11 @@ func main() {
 		runService(svcName, true)
 		return
 	case "install":
-		err = installer.InstallService()
+		var opts *InstallOptions
+		opts, err = parseInstallOptions(os.Args[2:])
+		if err == nil {
+			err = installer.InstallService(opts)
+		}
 	case "remove", "uninstall":
 		err = installer.RemoveService()
 	case "start":
@@ -52,6 +63,26 @@ func main() {
 		err = manager.ControlService(svc.Pause, svc.Paused)
 	case "continue":
 		err = manager.ControlService(svc.Continue, svc.Running)
+	case "status":
+		err = printStatus(svcName, manager)
+	case "networks":
+		err = printNetworks(svcName, profile)
+	case "reconcile":
+		err = control.Reconcile(profile)
+	case "reprovision":
+		err = control.Reprovision(profile)
+	case "reload":
+		err = control.Reload()
+	case "cleanup":
+		err = runCleanup(svcName, manager)
+	case "doctor":
+		err = NewDoctor(svcName).Run(profile)
+	case "plan":
+		err = NewPlanner(svcName).Run(profile)
+	case "selftest":
+		err = NewSelfTest(svcName).Run(profile)
+	case "version":
+		err = printVersion()
 	default:
 		log.Printf("invalid command %s", cmd)
 	}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricInfo describes a metric family in the exposition output.
+type metricInfo struct {
+	kind string
+	help string
+}
+
+var metricInfos = map[string]metricInfo{
+	"dwnc_routed_networks":              {"gauge", "Docker networks currently routed through the tunnel."},
+	"dwnc_route_operations_total":       {"counter", "Route additions and deletions by result."},
+	"dwnc_latest_handshake_age_seconds": {"gauge", "Seconds since the latest WireGuard handshake with the VM."},
+	"dwnc_tunnel_receive_bytes_total":   {"counter", "Bytes received from the VM through the tunnel."},
+	"dwnc_tunnel_transmit_bytes_total":  {"counter", "Bytes sent to the VM through the tunnel."},
+	"dwnc_docker_events_total":          {"counter", "Docker network events processed by action."},
+	"dwnc_docker_event_resyncs_total":   {"counter", "Full network resyncs after the events stream was down too long."},
+	"dwnc_setup_vm_attempts_total":      {"counter", "VM side setup attempts by result."},
+	"dwnc_setup_vm_duration_seconds":    {"summary", "Time spent setting up the VM side."},
+	"dwnc_docker_engine_up":             {"gauge", "Whether the Docker engine answers."},
+	"dwnc_route_batch_size":             {"summary", "Networks changed per batch of coalesced network events."},
+	"dwnc_route_batch_apply_seconds":    {"summary", "Time spent queuing the routes of a batch and applying its policy and shims."},
+}
+
+// Metrics holds the values collected while the service runs, keyed by metric
+// name and rendered label set.
+type Metrics struct {
+	mu     sync.Mutex
+	values map[string]map[string]float64
+}
+
+var metrics = NewMetrics()
+
+func NewMetrics() *Metrics {
+	return &Metrics{values: make(map[string]map[string]float64)}
+}
+
+// labels renders key/value pairs as a Prometheus label set.
+func labels(pairs ...string) string {
+	var parts []string
+	for i := 0; i+1 < len(pairs); i += 2 {
+		parts = append(parts, fmt.Sprintf("%s=%s", pairs[i], strconv.Quote(pairs[i+1])))
+	}
+
+	return strings.Join(parts, ",")
+}
+
+func (m *Metrics) Add(name string, value float64, pairs ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][labels(pairs...)] += value
+}
+
+func (m *Metrics) Inc(name string, pairs ...string) {
+	m.Add(name, 1, pairs...)
+}
+
+func (m *Metrics) Set(name string, value float64, pairs ...string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.values[name] == nil {
+		m.values[name] = make(map[string]float64)
+	}
+	m.values[name][labels(pairs...)] = value
+}
+
+// Observe records a duration in a summary without quantiles.
+func (m *Metrics) Observe(name string, d time.Duration, pairs ...string) {
+	m.ObserveValue(name, d.Seconds(), pairs...)
+}
+
+// ObserveValue records a value in a summary without quantiles.
+func (m *Metrics) ObserveValue(name string, value float64, pairs ...string) {
+	m.Add(name+"_sum", value, pairs...)
+	m.Add(name+"_count", 1, pairs...)
+}
+
+func (m *Metrics) snapshot() map[string]map[string]float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	values := make(map[string]map[string]float64, len(m.values))
+	for name, series := range m.values {
+		values[name] = make(map[string]float64, len(series))
+		for l, v := range series {
+			values[name][l] = v
+		}
+	}
+
+	return values
+}
+
+// MetricsServer serves the collected metrics and the live tunnel statistics on
+// a loopback address in the Prometheus text format.
+type MetricsServer struct {
+	supervisor *Supervisor
+	server     *http.Server
+}
+
+func validateMetricsListen(address string) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return errors.New("metrics must listen on a loopback address")
+	}
+
+	return nil
+}
+
+func NewMetricsServer(address string, supervisor *Supervisor) *MetricsServer {
+	m := &MetricsServer{supervisor: supervisor}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", m.serveMetrics)
+	m.server = &http.Server{Addr: address, Handler: mux}
+
+	return m
+}
+
+func (m *MetricsServer) Serve() {
+	err := m.server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error(EventMetricsFailed, "Metrics endpoint stopped", "error", err)
+	}
+}
+
+func (m *MetricsServer) Close() error {
+	return m.server.Close()
+}
+
+func (m *MetricsServer) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	values := metrics.snapshot()
+	set := func(name string, value float64, pairs ...string) {
+		if values[name] == nil {
+			values[name] = make(map[string]float64)
+		}
+		values[name][labels(pairs...)] = value
+	}
+
+	for _, runner := range m.supervisor.getRunners() {
+		profile := runner.profile.Name
+
+		ctx, cancel := context.WithTimeout(r.Context(), 2*time.Second)
+		_, err := runner.docker.cli.Ping(ctx)
+		cancel()
+		up := 0.0
+		if err == nil {
+			up = 1
+		}
+		set("dwnc_docker_engine_up", up, "profile", profile)
+
+		wireguard, err := runner.getWireguard()
+		if err != nil {
+			continue
+		}
+
+		stats, err := wireguard.getPeerStats()
+		if err != nil {
+			continue
+		}
+
+		if !stats.latestHandshake.IsZero() {
+			set("dwnc_latest_handshake_age_seconds", time.Since(stats.latestHandshake).Seconds(), "profile", profile)
+		}
+		set("dwnc_tunnel_receive_bytes_total", float64(stats.receiveBytes), "profile", profile)
+		set("dwnc_tunnel_transmit_bytes_total", float64(stats.transmitBytes), "profile", profile)
+	}
+
+	names := make([]string, 0, len(values))
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	described := make(map[string]bool)
+	for _, name := range names {
+		family := name
+		if _, ok := metricInfos[family]; !ok {
+			// summaries are stored as their _sum and _count series
+			family = strings.TrimSuffix(strings.TrimSuffix(name, "_sum"), "_count")
+		}
+		if info, ok := metricInfos[family]; ok && !described[family] {
+			described[family] = true
+			_, _ = fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", family, info.help, family, info.kind)
+		}
+
+		series := make([]string, 0, len(values[name]))
+		for l := range values[name] {
+			series = append(series, l)
+		}
+		sort.Strings(series)
+
+		for _, l := range series {
+			_, _ = fmt.Fprintf(w, "%s{%s} %s\n", name, l, strconv.FormatFloat(values[name][l], 'g', -1, 64))
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLabels(t *testing.T) {
+	tests := []struct {
+		pairs []string
+		want  string
+	}{
+		{want: ""},
+		{pairs: []string{"profile", "default"}, want: `profile="default"`},
+		{pairs: []string{"profile", "default", "result", "success"}, want: `profile="default",result="success"`},
+		{pairs: []string{"name", `say "hi"`}, want: `name="say \"hi\""`},
+		{pairs: []string{"profile", "default", "dangling"}, want: `profile="default"`},
+	}
+
+	for _, test := range tests {
+		if l := labels(test.pairs...); l != test.want {
+			t.Errorf("labels(%q) = %s, want %s", test.pairs, l, test.want)
+		}
+	}
+}
+
+func TestValidateMetricsListen(t *testing.T) {
+	tests := []struct {
+		address string
+		wantErr bool
+	}{
+		{address: "127.0.0.1:9469"},
+		{address: "localhost:9469"},
+		{address: "[::1]:9469"},
+		{address: "0.0.0.0:9469", wantErr: true},
+		{address: "192.168.1.10:9469", wantErr: true},
+		{address: ":9469", wantErr: true},
+		{address: "127.0.0.1", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.address, func(t *testing.T) {
+			err := validateMetricsListen(test.address)
+			if (err != nil) != test.wantErr {
+				t.Errorf("validateMetricsListen(%q) = %v, want error %t", test.address, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	previous := metrics
+	metrics = NewMetrics()
+	t.Cleanup(func() {
+		metrics = previous
+	})
+
+	metrics.Inc("dwnc_route_operations_total", "profile", "default", "operation", "add", "result", "success")
+	metrics.Inc("dwnc_route_operations_total", "profile", "default", "operation", "add", "result", "success")
+	metrics.Inc("dwnc_route_operations_total", "profile", "default", "operation", "add", "result", "failure")
+	metrics.Set("dwnc_routed_networks", 3, "profile", "default")
+	metrics.Set("dwnc_routed_networks", 2, "profile", "default")
+	metrics.Observe("dwnc_setup_vm_duration_seconds", 1500*time.Millisecond, "profile", "default")
+	metrics.Observe("dwnc_setup_vm_duration_seconds", 500*time.Millisecond, "profile", "default")
+
+	server := &MetricsServer{supervisor: NewSupervisor("test")}
+	recorder := httptest.NewRecorder()
+	server.serveMetrics(recorder, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+
+	want := `# HELP dwnc_route_operations_total Route additions and deletions by result.
+# TYPE dwnc_route_operations_total counter
+dwnc_route_operations_total{profile="default",operation="add",result="failure"} 1
+dwnc_route_operations_total{profile="default",operation="add",result="success"} 2
+# HELP dwnc_routed_networks Docker networks currently routed through the tunnel.
+# TYPE dwnc_routed_networks gauge
+dwnc_routed_networks{profile="default"} 2
+# HELP dwnc_setup_vm_duration_seconds Time spent setting up the VM side.
+# TYPE dwnc_setup_vm_duration_seconds summary
+dwnc_setup_vm_duration_seconds_count{profile="default"} 2
+dwnc_setup_vm_duration_seconds_sum{profile="default"} 2
+`
+	if body := recorder.Body.String(); body != want {
+		t.Errorf("metrics =\n%s\nwant\n%s", body, want)
+	}
+}
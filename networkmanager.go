@@ -2,22 +2,80 @@ package main
 
 import (
 	"errors"
+	"fmt"
 	"github.com/docker/docker/api/types"
 	"net"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
+// routeAttempts is how often a queued route operation is tried before it is
+// given up and reported in status.
+const routeAttempts = 5
+
+// routeBackoff is the wait after the first failed attempt, tests shorten it.
+var routeBackoff = 1 * time.Second
+
+// NetworkManager routes Docker networks through the tunnel interface. It is
+// safe for concurrent use. Queued operations run in order per network, in the
+// background and with retries.
 type NetworkManager struct {
 	Utils
+	log           *Logger
+	name          string
+	interfaceName string
+	journal       *Journal
+
+	mu             sync.Mutex
 	networks       map[string]types.NetworkResource
 	interfaceIndex int
-	interfaceName  string
+	queues         map[string][]routeOperation
+	failures       map[string]RouteFailure
+	// pools are routed as a whole, the networks inside need no routes
+	pools []*net.IPNet
+	// onDone is called once the operations queued for a network have run
+	onDone func()
+	wg     sync.WaitGroup
+	// done is closed by Stop, it cuts the retries short
+	done chan struct{}
+}
+
+type routeOperation struct {
+	add     bool
+	id      string
+	network types.NetworkResource
 }
 
-func NewNetworkManager(interfaceName string) *NetworkManager {
+func (o routeOperation) String() string {
+	if o.add {
+		return "add"
+	}
+
+	return "remove"
+}
+
+// RouteFailure is a route operation that failed every attempt.
+type RouteFailure struct {
+	Network   string    `json:"network"`
+	Operation string    `json:"operation"`
+	Attempts  int       `json:"attempts"`
+	Error     string    `json:"error"`
+	Time      time.Time `json:"time"`
+}
+
+func NewNetworkManager(name, interfaceName string, journal *Journal) *NetworkManager {
 	return &NetworkManager{
+		log:           logger.With("profile", name),
+		name:          name,
+		journal:       journal,
 		networks:      make(map[string]types.NetworkResource),
 		interfaceName: interfaceName,
+		queues:        make(map[string][]routeOperation),
+		failures:      make(map[string]RouteFailure),
+		done:          make(chan struct{}),
 	}
 }
 
@@ -29,7 +87,9 @@ func (n *NetworkManager) findInterfaceIndex() error {
 
 	for _, i := range interfaces {
 		if i.Name == n.interfaceName {
+			n.mu.Lock()
 			n.interfaceIndex = i.Index
+			n.mu.Unlock()
 			break
 		}
 	}
@@ -37,6 +97,13 @@ func (n *NetworkManager) findInterfaceIndex() error {
 	return err
 }
 
+func (n *NetworkManager) getInterfaceIndex() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return strconv.Itoa(n.interfaceIndex)
+}
+
 func (n *NetworkManager) UpdateInterface(hostIp, vmIp string) error {
 	err := n.findInterfaceIndex()
 	if err != nil {
@@ -51,57 +118,336 @@ func (n *NetworkManager) UpdateInterface(hostIp, vmIp string) error {
 	return nil
 }
 
-func (n *NetworkManager) AddNetwork(id string, network types.NetworkResource) error {
+// networkRoutes returns the routes a network needs, one per subnet outside
+// the routed address pools.
+func (n *NetworkManager) networkRoutes(network types.NetworkResource) ([]*net.IPNet, error) {
+	pools := n.Pools()
+
+	var routes []*net.IPNet
 	for _, config := range network.IPAM.Config {
-		subnet := config.Subnet
-		_, ipNet, err := net.ParseCIDR(subnet)
+		_, ipNet, err := net.ParseCIDR(config.Subnet)
+		if err != nil {
+			return nil, err
+		}
+		if coveredBy(ipNet, pools) {
+			continue
+		}
+		routes = append(routes, ipNet)
+	}
+
+	return routes, nil
+}
+
+// SetPools sets the address pools routed as a whole.
+func (n *NetworkManager) SetPools(pools []*net.IPNet) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.pools = pools
+}
+
+func (n *NetworkManager) Pools() []*net.IPNet {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return n.pools
+}
+
+// SetOnDone sets the function called once the operations queued for a
+// network have run, successful or not. It runs on the queue's goroutine and
+// must not block.
+func (n *NetworkManager) SetOnDone(f func()) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.onDone = f
+}
+
+// AddPoolRoutes routes the address pools through the tunnel.
+func (n *NetworkManager) AddPoolRoutes() error {
+	for _, pool := range n.Pools() {
+		err := n.AddRoute(pool.IP.String(), net.IP(pool.Mask).String())
+		if err != nil {
+			return errors.New("error adding pool route " + err.Error())
+		}
+	}
+
+	return nil
+}
+
+// RemovePoolRoutes deletes the routes of the address pools.
+func (n *NetworkManager) RemovePoolRoutes() error {
+	var errs []error
+	for _, pool := range n.Pools() {
+		err := n.DeleteRoute(pool.IP.String())
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// QueueAdd routes a network in the background, after the operations already
+// queued for it.
+func (n *NetworkManager) QueueAdd(network types.NetworkResource) {
+	n.queue(routeOperation{add: true, id: network.ID, network: network})
+}
+
+// QueueRemove deletes the routes of a network in the background, after the
+// operations already queued for it.
+func (n *NetworkManager) QueueRemove(id, name string) {
+	n.queue(routeOperation{id: id, network: types.NetworkResource{ID: id, Name: name}})
+}
+
+func (n *NetworkManager) queue(operation routeOperation) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	pending := n.queues[operation.id]
+	n.queues[operation.id] = append(pending, operation)
+	if len(pending) == 0 {
+		n.wg.Add(1)
+		go n.runQueue(operation.id, n.done)
+	}
+}
+
+// runQueue works through the operations of one network until none is left.
+func (n *NetworkManager) runQueue(id string, done chan struct{}) {
+	defer n.wg.Done()
+
+	for {
+		n.mu.Lock()
+		operation := n.queues[id][0]
+		n.mu.Unlock()
+
+		attempts, err := n.runOperation(operation, done)
+
+		n.mu.Lock()
 		if err != nil {
-			return err
+			n.failures[id] = RouteFailure{
+				Network:   operation.network.Name,
+				Operation: operation.String(),
+				Attempts:  attempts,
+				Error:     err.Error(),
+				Time:      time.Now(),
+			}
+		} else {
+			delete(n.failures, id)
+		}
+
+		n.queues[id] = n.queues[id][1:]
+		if len(n.queues[id]) == 0 {
+			delete(n.queues, id)
+			onDone := n.onDone
+			n.mu.Unlock()
+
+			if onDone != nil {
+				onDone()
+			}
+			return
+		}
+		n.mu.Unlock()
+	}
+}
+
+// runOperation tries an operation until it succeeds, doubling the wait after
+// every failure. It returns the number of attempts made.
+func (n *NetworkManager) runOperation(operation routeOperation, done chan struct{}) (int, error) {
+	event := EventRouteAddFailed
+	if !operation.add {
+		event = EventRouteDeleteFailed
+	}
+
+	backoff := routeBackoff
+	for attempt := 1; ; attempt++ {
+		var err error
+		if operation.add {
+			err = n.AddNetwork(operation.id, operation.network)
+		} else {
+			err = n.RemoveNetwork(operation.id)
+		}
+		if err == nil {
+			return attempt, nil
+		}
+
+		if attempt == routeAttempts {
+			n.log.Error(event, fmt.Sprintf("Failed to %s network routes, giving up", operation), "network", operation.network.Name, "attempts", attempt, "error", err)
+			return attempt, err
 		}
 
+		n.log.Warning(EventRouteRetrying, fmt.Sprintf("Failed to %s network routes, retrying", operation), "network", operation.network.Name, "attempt", attempt, "retryIn", backoff, "error", err)
+		timer := time.NewTimer(backoff)
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			return attempt, err
+		}
+		backoff *= 2
+	}
+}
+
+// Wait blocks until every queued operation has run. The event loop never
+// waits, a network that keeps failing would hold it up for the whole backoff.
+func (n *NetworkManager) Wait() {
+	n.wg.Wait()
+}
+
+// Stop cuts the retries of queued operations short and waits for them.
+func (n *NetworkManager) Stop() {
+	n.mu.Lock()
+	select {
+	case <-n.done:
+	default:
+		close(n.done)
+	}
+	n.mu.Unlock()
+
+	n.wg.Wait()
+}
+
+func (n *NetworkManager) AddNetwork(id string, network types.NetworkResource) error {
+	routes, err := n.networkRoutes(network)
+	if err != nil {
+		return err
+	}
+
+	for _, ipNet := range routes {
 		err = n.AddRoute(ipNet.IP.String(), net.IP(ipNet.Mask).String())
 		if err != nil {
 			return errors.New("error adding route " + err.Error())
 		}
 	}
 
+	n.mu.Lock()
 	n.networks[id] = network
+	metrics.Set("dwnc_routed_networks", float64(len(n.networks)), "profile", n.name)
+	n.mu.Unlock()
 
 	return nil
 }
 
 func (n *NetworkManager) AddRoute(ip, mask string) error {
-	err := n.runCommand("route", "ADD", ip, "MASK", mask, "0.0.0.0", "IF", strconv.Itoa(n.interfaceIndex))
+	interfaceIndex := n.getInterfaceIndex()
+	err := n.runCommand("route", "ADD", ip, "MASK", mask, "0.0.0.0", "IF", interfaceIndex)
+	if err != nil && strings.Contains(err.Error(), "already exists") {
+		// WireGuard routes the AllowedIPs it started with
+		err = nil
+	}
+	n.countRouteOperation("add", err)
 	if err != nil {
-		return errors.New("error deleting wireguard route " + err.Error())
+		return errors.New("error adding wireguard route " + err.Error())
 	}
+	index, _ := strconv.Atoi(interfaceIndex)
+	n.journal.AddRoute(n.name, ip, mask, index)
 
 	return nil
 }
 
 func (n *NetworkManager) RemoveNetwork(id string) error {
+	n.mu.Lock()
 	network := n.networks[id]
-	for _, config := range network.IPAM.Config {
-		subnet := config.Subnet
-		_, ipNet, err := net.ParseCIDR(subnet)
-		if err != nil {
-			return err
-		}
+	n.mu.Unlock()
+
+	routes, err := n.networkRoutes(network)
+	if err != nil {
+		return err
+	}
+
+	for _, ipNet := range routes {
 		err = n.DeleteRoute(ipNet.IP.String())
 		if err != nil {
 			return errors.New("error deleting route " + err.Error())
 		}
 	}
+
+	n.mu.Lock()
 	delete(n.networks, id)
+	metrics.Set("dwnc_routed_networks", float64(len(n.networks)), "profile", n.name)
+	n.mu.Unlock()
 
 	return nil
 }
 
+// Reset forgets the tracked networks and failures once their routes are gone
+// with the interface. Stop must have been called.
+func (n *NetworkManager) Reset() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.networks = make(map[string]types.NetworkResource)
+	n.failures = make(map[string]RouteFailure)
+	n.done = make(chan struct{})
+	metrics.Set("dwnc_routed_networks", 0, "profile", n.name)
+}
+
 func (n *NetworkManager) DeleteRoute(ip string) error {
-	err := n.runCommand("route", "DELETE", ip, "IF", strconv.Itoa(n.interfaceIndex))
+	err := n.runCommand("route", "DELETE", ip, "IF", n.getInterfaceIndex())
+	n.countRouteOperation("delete", err)
 	if err != nil {
 		return errors.New("error deleting wireguard route " + err.Error())
 	}
+	n.journal.RemoveRoute(n.name, ip)
 
 	return nil
 }
+
+// Networks returns the routed networks.
+func (n *NetworkManager) Networks() []types.NetworkResource {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	networks := make([]types.NetworkResource, 0, len(n.networks))
+	for _, network := range n.networks {
+		networks = append(networks, network)
+	}
+
+	return networks
+}
+
+// Get returns a routed network.
+func (n *NetworkManager) Get(id string) (types.NetworkResource, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	network, ok := n.networks[id]
+
+	return network, ok
+}
+
+// Has reports whether a network is routed.
+func (n *NetworkManager) Has(id string) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	_, ok := n.networks[id]
+
+	return ok
+}
+
+// Failures returns the route operations that failed every attempt and weren't
+// followed by a successful one, oldest first.
+func (n *NetworkManager) Failures() []RouteFailure {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	failures := make([]RouteFailure, 0, len(n.failures))
+	for _, failure := range n.failures {
+		failures = append(failures, failure)
+	}
+	sort.Slice(failures, func(i, j int) bool {
+		return failures[i].Time.Before(failures[j].Time)
+	})
+
+	return failures
+}
+
+func (n *NetworkManager) countRouteOperation(operation string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	metrics.Inc("dwnc_route_operations_total", "profile", n.name, "operation", operation, "result", result)
+}
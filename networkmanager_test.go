@@ -0,0 +1,246 @@
+package main
+
+import (
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestNetworkManager(t *testing.T) *NetworkManager {
+	journal, err := LoadJournal(filepath.Join(t.TempDir(), "state.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	previous := routeBackoff
+	routeBackoff = time.Millisecond
+	t.Cleanup(func() {
+		routeBackoff = previous
+	})
+
+	return NewNetworkManager("test", "dwnc-test", journal)
+}
+
+func testNetwork(id string, subnets ...string) types.NetworkResource {
+	resource := types.NetworkResource{ID: id, Name: "net-" + id, Driver: "bridge"}
+	for _, subnet := range subnets {
+		resource.IPAM.Config = append(resource.IPAM.Config, network.IPAMConfig{Subnet: subnet})
+	}
+
+	return resource
+}
+
+func TestNetworkManagerQueue(t *testing.T) {
+	fake := newFakeCommands(t, nil)
+	n := newTestNetworkManager(t)
+
+	n.QueueAdd(testNetwork("a", "172.18.0.0/16", "172.19.0.0/24"))
+	n.Wait()
+
+	if !n.Has("a") {
+		t.Fatal("network a is not tracked after adding it")
+	}
+	n.QueueRemove("a", "net-a")
+	n.Wait()
+
+	if n.Has("a") {
+		t.Fatal("network a is still tracked after removing it")
+	}
+
+	expected := []string{
+		"route ADD 172.18.0.0 MASK 255.255.0.0 0.0.0.0 IF 0",
+		"route ADD 172.19.0.0 MASK 255.255.255.0 0.0.0.0 IF 0",
+		"route DELETE 172.18.0.0 IF 0",
+		"route DELETE 172.19.0.0 IF 0",
+	}
+	commands := fake.Commands()
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("commands = %q, want %q", commands, expected)
+	}
+	if failures := n.Failures(); len(failures) != 0 {
+		t.Fatalf("failures = %v, want none", failures)
+	}
+}
+
+func TestNetworkManagerPools(t *testing.T) {
+	fake := newFakeCommands(t, nil)
+	n := newTestNetworkManager(t)
+
+	_, pool, _ := net.ParseCIDR("172.16.0.0/12")
+	n.SetPools([]*net.IPNet{pool})
+
+	err := n.AddPoolRoutes()
+	if err != nil {
+		t.Fatalf("AddPoolRoutes failed: %v", err)
+	}
+	n.QueueAdd(testNetwork("a", "172.18.0.0/16", "10.10.0.0/24"))
+	n.Wait()
+	err = n.RemovePoolRoutes()
+	if err != nil {
+		t.Fatalf("RemovePoolRoutes failed: %v", err)
+	}
+
+	expected := []string{
+		"route ADD 172.16.0.0 MASK 255.240.0.0 0.0.0.0 IF 0",
+		"route ADD 10.10.0.0 MASK 255.255.255.0 0.0.0.0 IF 0",
+		"route DELETE 172.16.0.0 IF 0",
+	}
+	commands := fake.Commands()
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("commands = %q, want %q", commands, expected)
+	}
+}
+
+func TestNetworkManagerRetries(t *testing.T) {
+	tests := []struct {
+		name         string
+		failures     int
+		wantAttempts int
+		wantFailed   bool
+	}{
+		{name: "first attempt", failures: 0, wantAttempts: 1},
+		{name: "after retries", failures: 2, wantAttempts: 3},
+		{name: "gives up", failures: routeAttempts, wantAttempts: routeAttempts, wantFailed: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			failed := 0
+			fake := newFakeCommands(t, func(command string) bool {
+				if failed < test.failures {
+					failed++
+					return true
+				}
+				return false
+			})
+			n := newTestNetworkManager(t)
+
+			n.QueueAdd(testNetwork("a", "172.18.0.0/16"))
+			n.Wait()
+
+			if attempts := len(fake.Commands()); attempts != test.wantAttempts {
+				t.Errorf("attempts = %d, want %d", attempts, test.wantAttempts)
+			}
+			if n.Has("a") == test.wantFailed {
+				t.Errorf("tracked = %t, want %t", n.Has("a"), !test.wantFailed)
+			}
+
+			failures := n.Failures()
+			if !test.wantFailed {
+				if len(failures) != 0 {
+					t.Errorf("failures = %v, want none", failures)
+				}
+				return
+			}
+
+			if len(failures) != 1 {
+				t.Fatalf("failures = %v, want one", failures)
+			}
+			failure := failures[0]
+			if failure.Network != "net-a" || failure.Operation != "add" || failure.Attempts != routeAttempts {
+				t.Errorf("failure = %+v, want add of net-a after %d attempts", failure, routeAttempts)
+			}
+		})
+	}
+}
+
+func TestNetworkManagerFailureCleared(t *testing.T) {
+	fail := true
+	newFakeCommands(t, func(command string) bool {
+		return fail
+	})
+	n := newTestNetworkManager(t)
+
+	n.QueueAdd(testNetwork("a", "172.18.0.0/16"))
+	n.Wait()
+	if len(n.Failures()) != 1 {
+		t.Fatalf("failures = %v, want one", n.Failures())
+	}
+
+	fail = false
+	n.QueueAdd(testNetwork("a", "172.18.0.0/16"))
+	n.Wait()
+	if len(n.Failures()) != 0 {
+		t.Fatalf("failures = %v, want none after a successful add", n.Failures())
+	}
+}
+
+func TestNetworkManagerOrderPerNetwork(t *testing.T) {
+	fake := newFakeCommands(t, nil)
+	n := newTestNetworkManager(t)
+
+	n.QueueAdd(testNetwork("a", "172.18.0.0/16"))
+	n.QueueRemove("a", "net-a")
+	n.QueueAdd(testNetwork("a", "172.18.0.0/16"))
+	n.Wait()
+
+	expected := []string{
+		"route ADD 172.18.0.0 MASK 255.255.0.0 0.0.0.0 IF 0",
+		"route DELETE 172.18.0.0 IF 0",
+		"route ADD 172.18.0.0 MASK 255.255.0.0 0.0.0.0 IF 0",
+	}
+	commands := fake.Commands()
+	if strings.Join(commands, "\n") != strings.Join(expected, "\n") {
+		t.Fatalf("commands = %q, want %q", commands, expected)
+	}
+	if !n.Has("a") {
+		t.Fatal("network a is not tracked after adding it again")
+	}
+}
+
+func TestNetworkManagerStop(t *testing.T) {
+	newFakeCommands(t, func(command string) bool {
+		return true
+	})
+	n := newTestNetworkManager(t)
+	routeBackoff = time.Hour
+
+	n.QueueAdd(testNetwork("a", "172.18.0.0/16"))
+	time.Sleep(50 * time.Millisecond)
+
+	done := make(chan struct{})
+	go func() {
+		n.Stop()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop didn't cut the retry short")
+	}
+}
+
+func TestNetworkManagerOnDone(t *testing.T) {
+	newFakeCommands(t, func(command string) bool {
+		return strings.Contains(command, "172.19.0.0")
+	})
+	n := newTestNetworkManager(t)
+
+	done := make(chan struct{}, 2)
+	n.SetOnDone(func() {
+		done <- struct{}{}
+	})
+
+	// the failing network is called back as well, after its last attempt
+	n.QueueAdd(testNetwork("a", "172.18.0.0/16"))
+	n.QueueAdd(testNetwork("b", "172.19.0.0/16"))
+	for i := 0; i < 2; i++ {
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("called back %d times, want 2", i)
+		}
+	}
+
+	if !n.Has("a") {
+		t.Error("network a is not tracked when its queue is done")
+	}
+	if len(n.Failures()) != 1 {
+		t.Errorf("failures = %v, want the one of b", n.Failures())
+	}
+}
@@ -0,0 +1,466 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Planner computes the state the service would bring a profile to from the
+// Docker API, compares it with the system and prints the operations that
+// would close the gap. Nothing is changed.
+type Planner struct {
+	Utils
+	name       string
+	operations int
+}
+
+// planProfile is the desired and the actual state of one profile.
+type planProfile struct {
+	*Profile
+	docker    *Docker
+	wireguard *Wireguard
+	// routes and allowedIPs are CIDRs
+	routes     []string
+	allowedIPs []string
+}
+
+func NewPlanner(name string) *Planner {
+	return &Planner{name: name}
+}
+
+func (p *Planner) add(format string, args ...any) {
+	p.operation("+", format, args...)
+}
+
+func (p *Planner) remove(format string, args ...any) {
+	p.operation("-", format, args...)
+}
+
+func (p *Planner) change(format string, args ...any) {
+	p.operation("~", format, args...)
+}
+
+func (p *Planner) operation(sign, format string, args ...any) {
+	p.operations++
+	fmt.Printf("  %s %s\n", sign, fmt.Sprintf(format, args...))
+}
+
+func (p *Planner) note(format string, args ...any) {
+	fmt.Printf("    %s\n", fmt.Sprintf(format, args...))
+}
+
+// Run plans the named profile, or every profile when name is empty.
+func (p *Planner) Run(profileName string) error {
+	config, err := loadConfig(p.name)
+	if err != nil {
+		return err
+	}
+
+	allocations, err := LoadAllocations(getAllocationsPath(p.name))
+	if err != nil {
+		return err
+	}
+
+	found := false
+	for _, profile := range config.GetProfiles() {
+		if profileName != "" && profile.Name != profileName {
+			continue
+		}
+
+		allocation := allocations.Profiles[profile.Name]
+		if profile.HostPeerIp == "" {
+			profile.HostPeerIp = allocation.HostPeerIp
+			profile.VmPeerIp = allocation.VmPeerIp
+		}
+		if profile.Port == 0 {
+			profile.Port = allocation.Port
+		}
+
+		if found {
+			fmt.Println()
+		}
+		found = true
+		fmt.Printf("Profile %s\n", profile.Name)
+
+		err = p.planProfile(profile)
+		if err != nil {
+			return fmt.Errorf("profile %s: %w", profile.Name, err)
+		}
+	}
+
+	if !found {
+		return errors.New("unknown profile " + profileName)
+	}
+
+	fmt.Println()
+	if p.operations == 0 {
+		fmt.Println("No changes, the system matches Docker")
+	} else {
+		fmt.Printf("Plan: %d operations, none executed\n", p.operations)
+	}
+
+	return nil
+}
+
+func (p *Planner) planProfile(profile *Profile) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Minute)
+	defer cancel()
+
+	docker, err := NewDocker(ctx, profile.DockerHost)
+	if err != nil {
+		return errors.New("failed to create Docker client: " + err.Error())
+	}
+	defer docker.Close()
+
+	pingCtx, pingCancel := context.WithTimeout(ctx, 5*time.Second)
+	_, err = docker.cli.Ping(pingCtx)
+	pingCancel()
+	if err != nil {
+		return errors.New("docker is not running: " + err.Error())
+	}
+
+	if profile.HostPeerIp == "" {
+		subnets, err := docker.GetSubnets()
+		if err != nil {
+			return errors.New("failed to get docker subnets: " + err.Error())
+		}
+
+		p.add("allocate tunnel addresses and port from the peer pool")
+		p.add("install tunnel %s and route %d Docker subnets", profile.InterfaceName, len(subnets))
+		p.add("set up the VM side")
+		p.note("the exact operations depend on the addresses, start the service to allocate them")
+		return nil
+	}
+
+	opts := profile.wireguardOptions()
+	opts.DataDir = getDataDir(p.name)
+	// the journal is only written by changes, a plan makes none
+	wireguard, err := NewWireguard(docker, opts, nil)
+	if err != nil {
+		return err
+	}
+
+	err = wireguard.extractBinaries()
+	if err != nil {
+		return errors.New("failed to extract binaries: " + err.Error())
+	}
+
+	plan := &planProfile{Profile: profile, docker: docker, wireguard: wireguard}
+	err = p.desiredState(plan)
+	if err != nil {
+		return err
+	}
+
+	output, err := p.runPowerShell(fmt.Sprintf("(Get-Service -Name %s -ErrorAction Stop).Status", quotePowerShell("WireGuardTunnel$"+profile.InterfaceName)))
+	if err != nil || strings.TrimSpace(output) != "Running" {
+		return p.planInstall(plan)
+	}
+
+	p.planInterface(plan)
+
+	err = p.planRoutes(plan)
+	if err != nil {
+		return err
+	}
+
+	err = p.planAllowedIPs(plan)
+	if err != nil {
+		return err
+	}
+
+	p.planVM(plan)
+
+	return nil
+}
+
+// desiredState collects the routes the network manager would add for the
+// address pools, the current Docker networks, the extra routes and the
+// Kubernetes clusters and the AllowedIPs the tunnel would be given.
+func (p *Planner) desiredState(plan *planProfile) error {
+	pools, err := plan.wireguard.resolveAddressPools()
+	if err != nil {
+		return errors.New("failed to resolve address pools: " + err.Error())
+	}
+	plan.wireguard.networkManager.SetPools(pools)
+	for _, pool := range pools {
+		plan.routes = append(plan.routes, pool.String())
+	}
+
+	networks, err := plan.docker.cli.NetworkList(plan.docker.ctx, types.NetworkListOptions{})
+	if err != nil {
+		return errors.New("failed to list docker networks: " + err.Error())
+	}
+
+	for _, network := range networks {
+		routes, err := plan.wireguard.networkManager.networkRoutes(network)
+		if err != nil {
+			return fmt.Errorf("network %s: %w", network.Name, err)
+		}
+		for _, route := range routes {
+			plan.routes = append(plan.routes, route.String())
+		}
+	}
+
+	err = plan.wireguard.setStaticRoutes()
+	if err != nil {
+		return errors.New("failed to set extra routes: " + err.Error())
+	}
+
+	if plan.wireguard.kubernetes != nil {
+		discovery := &kubernetesDiscovery{source: plan.wireguard.kubernetes}
+		clusters, err := discovery.Discover(plan.wireguard.log)
+		if err != nil {
+			return errors.New("failed to look up Kubernetes clusters: " + err.Error())
+		}
+		clusters, err = plan.wireguard.clearRanges(kubernetesSource, clusters)
+		if err != nil {
+			return errors.New("failed to check Kubernetes ranges: " + err.Error())
+		}
+
+		if plan.wireguard.sourceRoutes == nil {
+			plan.wireguard.sourceRoutes = make(map[string][]VMRoute)
+		}
+		for name, routes := range plan.wireguard.claimRanges(kubernetesSource, clusters) {
+			plan.wireguard.sourceRoutes[kubernetesSource+"/"+name] = routes
+		}
+	}
+	plan.routes = append(plan.routes, plan.wireguard.sourceSubnets()...)
+
+	plan.allowedIPs, err = plan.wireguard.getAllowedIPs()
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// planInstall lists what Setup and SetupVM would do for a tunnel that isn't
+// running.
+func (p *Planner) planInstall(plan *planProfile) error {
+	conf, err := plan.wireguard.getTunnelConf()
+	if err != nil {
+		return errors.New("failed to get tunnel config: " + err.Error())
+	}
+
+	p.add("%s /installtunnelservice %s", plan.wireguard.exBinDirWireguard, plan.wireguard.getTunnelConfPath())
+	for _, line := range strings.Split(strings.TrimSpace(conf), "\n") {
+		if strings.HasPrefix(line, "PrivateKey") {
+			line = "PrivateKey = (generated)"
+		}
+		if strings.HasPrefix(line, "PublicKey") {
+			line = "PublicKey = (generated)"
+		}
+		p.note("%s", line)
+	}
+
+	p.add("netsh interface ip set address name=%s static %s 255.255.255.255 %s", plan.InterfaceName, plan.HostPeerIp, plan.VmPeerIp)
+	p.remove("route DELETE 0.0.0.0 IF %s", plan.InterfaceName)
+	for _, route := range plan.routes {
+		p.add("route ADD %s 0.0.0.0 IF %s", routeArgs(route), plan.InterfaceName)
+	}
+	p.add("run %s to set up the VM side", version.SetupImage)
+
+	return nil
+}
+
+func (p *Planner) planInterface(plan *planProfile) {
+	iface, err := net.InterfaceByName(plan.InterfaceName)
+	if err == nil {
+		addrs, _ := iface.Addrs()
+		for _, addr := range addrs {
+			ipNet, ok := addr.(*net.IPNet)
+			if ok && ipNet.IP.String() == plan.HostPeerIp {
+				return
+			}
+		}
+	}
+
+	p.change("netsh interface ip set address name=%s static %s 255.255.255.255 %s", plan.InterfaceName, plan.HostPeerIp, plan.VmPeerIp)
+}
+
+func (p *Planner) planRoutes(plan *planProfile) error {
+	routes, err := p.getRoutes()
+	if err != nil {
+		return errors.New("failed to list routes: " + err.Error())
+	}
+
+	actual := make(map[string]bool)
+	for _, route := range routes {
+		if route[0] != plan.InterfaceName {
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(route[1])
+		if err != nil {
+			continue
+		}
+		// host, broadcast and multicast routes come with the interface
+		ones, _ := ipNet.Mask.Size()
+		if ones == 32 || ipNet.IP.IsMulticast() {
+			continue
+		}
+		actual[ipNet.String()] = true
+	}
+
+	desired := make(map[string]bool)
+	for _, route := range plan.routes {
+		desired[route] = true
+		if !actual[route] {
+			p.add("route ADD %s 0.0.0.0 IF %s", routeArgs(route), plan.InterfaceName)
+		}
+	}
+
+	for _, route := range sortedKeys(actual) {
+		if !desired[route] {
+			ip, _, _ := strings.Cut(route, "/")
+			p.remove("route DELETE %s IF %s", ip, plan.InterfaceName)
+		}
+	}
+
+	return nil
+}
+
+func (p *Planner) planAllowedIPs(plan *planProfile) error {
+	output, err := plan.wireguard.runWg("show", plan.InterfaceName, "allowed-ips")
+	if err != nil {
+		return errors.New("failed to read allowed IPs: " + err.Error())
+	}
+
+	peer := ""
+	actual := make(map[string]bool)
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		key, ips, _ := strings.Cut(line, "\t")
+		peer = key
+		for _, ip := range strings.Fields(ips) {
+			_, ipNet, err := net.ParseCIDR(ip)
+			if err == nil {
+				actual[ipNet.String()] = true
+			}
+		}
+	}
+
+	desired := make(map[string]bool)
+	changed := false
+	for _, ip := range plan.allowedIPs {
+		_, ipNet, err := net.ParseCIDR(ip)
+		if err != nil {
+			continue
+		}
+		desired[ipNet.String()] = true
+		if !actual[ipNet.String()] {
+			changed = true
+		}
+	}
+	for ip := range actual {
+		if !desired[ip] {
+			changed = true
+		}
+	}
+
+	if !changed {
+		return nil
+	}
+
+	p.change("wg set %s peer %s allowed-ips %s", plan.InterfaceName, peer, strings.Join(plan.allowedIPs, ","))
+	for _, ip := range sortedKeys(desired) {
+		if !actual[ip] {
+			p.note("+ %s", ip)
+		}
+	}
+	for _, ip := range sortedKeys(actual) {
+		if !desired[ip] {
+			p.note("- %s", ip)
+		}
+	}
+
+	return nil
+}
+
+// planVM asks the helper in check mode, which changes nothing, how the VM side
+// differs from the desired forwarding rules, routes, shims and hosts entry and
+// lists what setting it up again would fix.
+func (p *Planner) planVM(plan *planProfile) {
+	current, err := plan.docker.SetupImageVersion()
+	if err != nil || current != helperVersion {
+		p.add("docker pull %s", version.SetupImage)
+		p.add("run %s to set up the VM side", version.SetupImage)
+		return
+	}
+
+	policy, err := plan.wireguard.policy.Env(plan.docker, plan.wireguard.hostServices, plan.wireguard.log)
+	if err != nil {
+		p.note("the VM side could not be checked: failed to resolve access policy: %s", err)
+		return
+	}
+
+	routes, err := plan.wireguard.getVMRoutes()
+	if err != nil {
+		p.note("the VM side could not be checked: %s", err)
+		return
+	}
+
+	shims, err := plan.wireguard.getShimNetworks()
+	if err != nil {
+		p.note("the VM side could not be checked: failed to list shim networks: %s", err)
+		return
+	}
+
+	output, err := plan.docker.RunHelper(logger, []string{
+		"MODE=check",
+		"HOST_PEER_IP=" + plan.HostPeerIp,
+		"VM_PEER_IP=" + plan.VmPeerIp,
+		"PRESERVE_SOURCE_IP=" + strconv.FormatBool(plan.PreserveSourceIp),
+		"ACCESS_POLICY=" + policy,
+		"VM_ROUTES=" + routes,
+		"SHIM_NETWORKS=" + shims,
+		"HOST_NAME=" + plan.wireguard.hostServices.GetHostname(),
+	}, plan.wireguard.hostServices.helperBinds())
+	if err != nil {
+		p.note("the VM side could not be checked: %s", err)
+		return
+	}
+
+	var differences []string
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.SplitN(strings.TrimSpace(line), "\t", 4)
+		if len(fields) == 4 && fields[0] == "CHECK" && fields[2] != "ok" {
+			differences = append(differences, fields[1]+": "+fields[3])
+		}
+	}
+
+	if len(differences) == 0 {
+		return
+	}
+
+	p.change("run %s to set up the VM side again", version.SetupImage)
+	for _, difference := range differences {
+		p.note("%s", difference)
+	}
+}
+
+// routeArgs turns a CIDR into the destination and MASK arguments of route.
+func routeArgs(cidr string) string {
+	_, ipNet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		return cidr
+	}
+
+	return ipNet.IP.String() + " MASK " + net.IP(ipNet.Mask).String()
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRouteArgs(t *testing.T) {
+	tests := []struct {
+		cidr string
+		want string
+	}{
+		{cidr: "172.17.0.0/16", want: "172.17.0.0 MASK 255.255.0.0"},
+		{cidr: "172.17.5.9/24", want: "172.17.5.0 MASK 255.255.255.0"},
+		{cidr: "10.20.30.2/32", want: "10.20.30.2 MASK 255.255.255.255"},
+		{cidr: "not-a-cidr", want: "not-a-cidr"},
+	}
+
+	for _, test := range tests {
+		if args := routeArgs(test.cidr); args != test.want {
+			t.Errorf("routeArgs(%q) = %q, want %q", test.cidr, args, test.want)
+		}
+	}
+}
+
+func TestSortedKeys(t *testing.T) {
+	keys := sortedKeys(map[string]bool{"172.18.0.0/16": true, "10.0.0.0/8": false, "172.17.0.0/16": true})
+	want := []string{"10.0.0.0/8", "172.17.0.0/16", "172.18.0.0/16"}
+	if !reflect.DeepEqual(keys, want) {
+		t.Errorf("sortedKeys = %q, want %q", keys, want)
+	}
+
+	if keys := sortedKeys(nil); len(keys) != 0 {
+		t.Errorf("sortedKeys(nil) = %q, want none", keys)
+	}
+}
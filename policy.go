@@ -0,0 +1,175 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// AccessPolicy limits what the host may reach through the tunnel and whether
+// containers may open connections back to the host. The VM helper enforces it
+// with its own forwarding chain.
+type AccessPolicy struct {
+	// Networks the host may reach, anything not listed is dropped.
+	Networks []NetworkPolicy `json:"networks"`
+	// AllowContainersToHost lets containers initiate connections to the host
+	// tunnel address.
+	AllowContainersToHost bool `json:"allowContainersToHost"`
+}
+
+// NetworkPolicy selects a Docker network by name or a subnet, and optionally
+// the ports the host may reach on it. Ports are written as "80", "8000-8100"
+// or "53/udp", an empty list allows every port.
+type NetworkPolicy struct {
+	Name   string   `json:"name"`
+	Subnet string   `json:"subnet"`
+	Ports  []string `json:"ports"`
+}
+
+// vmAccessPolicy is the resolved policy handed to the VM helper, network names
+// are replaced by their current subnets.
+type vmAccessPolicy struct {
+	Rules                 []vmAccessRule `json:"rules"`
+	AllowContainersToHost bool           `json:"allowContainersToHost"`
+	// HostPorts are the ports of the host services, allowed to containers
+	// without AllowContainersToHost.
+	HostPorts []string `json:"hostPorts,omitempty"`
+}
+
+type vmAccessRule struct {
+	Subnet string   `json:"subnet"`
+	Ports  []string `json:"ports"`
+}
+
+func (p *AccessPolicy) Validate() error {
+	for _, network := range p.Networks {
+		if network.Name == "" && network.Subnet == "" {
+			return errors.New("policy network needs a name or a subnet")
+		}
+
+		if network.Subnet != "" {
+			ip, _, err := net.ParseCIDR(network.Subnet)
+			if err != nil {
+				return fmt.Errorf("invalid policy subnet %s: %w", network.Subnet, err)
+			}
+			// the VM chain is built with iptables, which only filters IPv4
+			if ip.To4() == nil {
+				return fmt.Errorf("invalid policy subnet %s: only IPv4 subnets are supported", network.Subnet)
+			}
+		}
+
+		for _, port := range network.Ports {
+			err := validatePort(port)
+			if err != nil {
+				return fmt.Errorf("invalid policy port %s: %w", port, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func validatePort(port string) error {
+	port, proto, found := strings.Cut(port, "/")
+	if found && proto != "tcp" && proto != "udp" {
+		return errors.New("protocol must be tcp or udp")
+	}
+
+	from, to, found := strings.Cut(port, "-")
+	if !found {
+		to = from
+	}
+
+	for _, p := range []string{from, to} {
+		n, err := strconv.Atoi(p)
+		if err != nil || n < 1 || n > 65535 {
+			return errors.New("port must be between 1 and 65535")
+		}
+	}
+
+	return nil
+}
+
+// Matches reports whether a network with the given name is selected by the
+// policy, so changes to it require the policy to be applied again.
+func (p *AccessPolicy) Matches(name string) bool {
+	if p == nil {
+		return false
+	}
+
+	for _, network := range p.Networks {
+		if network.Name != "" && network.Name == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// resolve replaces the network names of the policy by their IPv4 subnets,
+// looked up with getSubnets. A named network that doesn't exist yet gets no
+// rule, so the chain drops traffic to it until it is created and the policy
+// is applied again.
+func (p *AccessPolicy) resolve(getSubnets func(name string) ([]string, error), hostServices *HostServices, log *Logger) (*vmAccessPolicy, error) {
+	policy := &vmAccessPolicy{
+		AllowContainersToHost: p.AllowContainersToHost,
+	}
+	if hostServices != nil {
+		policy.HostPorts = hostServices.Ports
+	}
+
+	for _, network := range p.Networks {
+		subnets := []string{network.Subnet}
+		if network.Name != "" {
+			var err error
+			subnets, err = getSubnets(network.Name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get subnets of network %s: %w", network.Name, err)
+			}
+		}
+
+		added := 0
+		for _, subnet := range subnets {
+			ip, _, err := net.ParseCIDR(subnet)
+			if err != nil || ip.To4() == nil {
+				continue
+			}
+
+			policy.Rules = append(policy.Rules, vmAccessRule{
+				Subnet: subnet,
+				Ports:  network.Ports,
+			})
+			added++
+		}
+
+		if added == 0 && network.Name != "" {
+			log.Warning(EventPolicyNetworkMissing, "Policy network has no IPv4 subnet, traffic to it is dropped until it has one", "network", network.Name)
+		}
+	}
+
+	return policy, nil
+}
+
+// Env returns the policy as the value of the helper's ACCESS_POLICY variable,
+// empty when no policy is configured. The ports of hostServices stay open to
+// containers.
+func (p *AccessPolicy) Env(docker *Docker, hostServices *HostServices, log *Logger) (string, error) {
+	if p == nil {
+		return "", nil
+	}
+
+	policy, err := p.resolve(docker.GetNetworkSubnets, hostServices, log)
+	if err != nil {
+		return "", err
+	}
+
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return "", errors.New("failed to encode access policy: " + err.Error())
+	}
+
+	return string(data), nil
+}
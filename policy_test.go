@@ -0,0 +1,159 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestValidatePort(t *testing.T) {
+	tests := []struct {
+		port    string
+		wantErr bool
+	}{
+		{port: "80"},
+		{port: "1"},
+		{port: "65535"},
+		{port: "8000-8100"},
+		{port: "53/udp"},
+		{port: "443/tcp"},
+		{port: "5000-5010/udp"},
+		{port: "0", wantErr: true},
+		{port: "65536", wantErr: true},
+		{port: "http", wantErr: true},
+		{port: "", wantErr: true},
+		{port: "8000-", wantErr: true},
+		{port: "-8100", wantErr: true},
+		{port: "53/icmp", wantErr: true},
+		{port: "80/", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.port, func(t *testing.T) {
+			err := validatePort(test.port)
+			if (err != nil) != test.wantErr {
+				t.Errorf("validatePort(%q) = %v, want error %t", test.port, err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestAccessPolicyValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  AccessPolicy
+		wantErr bool
+	}{
+		{name: "empty", policy: AccessPolicy{}},
+		{
+			name: "names and subnets",
+			policy: AccessPolicy{Networks: []NetworkPolicy{
+				{Name: "web", Ports: []string{"80", "443"}},
+				{Subnet: "172.30.0.0/16"},
+			}},
+		},
+		{name: "neither name nor subnet", policy: AccessPolicy{Networks: []NetworkPolicy{{Ports: []string{"80"}}}}, wantErr: true},
+		{name: "invalid subnet", policy: AccessPolicy{Networks: []NetworkPolicy{{Subnet: "172.30.0.0"}}}, wantErr: true},
+		{name: "IPv6 subnet", policy: AccessPolicy{Networks: []NetworkPolicy{{Subnet: "fd00::/64"}}}, wantErr: true},
+		{name: "invalid port", policy: AccessPolicy{Networks: []NetworkPolicy{{Name: "web", Ports: []string{"80/sctp"}}}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := test.policy.Validate()
+			if (err != nil) != test.wantErr {
+				t.Errorf("Validate = %v, want error %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestAccessPolicyMatches(t *testing.T) {
+	policy := &AccessPolicy{Networks: []NetworkPolicy{
+		{Name: "web"},
+		{Subnet: "172.30.0.0/16"},
+	}}
+
+	tests := []struct {
+		policy *AccessPolicy
+		name   string
+		want   bool
+	}{
+		{policy: policy, name: "web", want: true},
+		{policy: policy, name: "db"},
+		{policy: policy, name: ""},
+		{policy: nil, name: "web"},
+	}
+
+	for _, test := range tests {
+		if matches := test.policy.Matches(test.name); matches != test.want {
+			t.Errorf("Matches(%q) = %t, want %t", test.name, matches, test.want)
+		}
+	}
+}
+
+func TestAccessPolicyResolve(t *testing.T) {
+	getSubnets := func(name string) ([]string, error) {
+		switch name {
+		case "web":
+			return []string{"172.18.0.0/16", "fd00:18::/64"}, nil
+		case "v6only":
+			return []string{"fd00:19::/64"}, nil
+		case "broken":
+			return nil, errors.New("docker is not running")
+		}
+		return nil, nil
+	}
+
+	tests := []struct {
+		name        string
+		networks    []NetworkPolicy
+		want        []vmAccessRule
+		wantWarning bool
+		wantErr     bool
+	}{
+		{
+			name:     "subnet",
+			networks: []NetworkPolicy{{Subnet: "172.30.0.0/16", Ports: []string{"80"}}},
+			want:     []vmAccessRule{{Subnet: "172.30.0.0/16", Ports: []string{"80"}}},
+		},
+		{
+			name:     "IPv6 subnets of a network are skipped",
+			networks: []NetworkPolicy{{Name: "web", Ports: []string{"443"}}},
+			want:     []vmAccessRule{{Subnet: "172.18.0.0/16", Ports: []string{"443"}}},
+		},
+		{name: "missing network", networks: []NetworkPolicy{{Name: "db"}}, wantWarning: true},
+		{name: "network without IPv4 subnet", networks: []NetworkPolicy{{Name: "v6only"}}, wantWarning: true},
+		{name: "lookup fails", networks: []NetworkPolicy{{Name: "broken"}}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			sink := &memorySink{}
+			policy := &AccessPolicy{Networks: test.networks}
+
+			resolved, err := policy.resolve(getSubnets, &HostServices{Ports: []string{"5432"}}, NewLogger(LevelInfo, sink))
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("resolve = %+v, want an error", resolved)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("resolve failed: %v", err)
+			}
+			if !reflect.DeepEqual(resolved.Rules, test.want) {
+				t.Errorf("rules = %+v, want %+v", resolved.Rules, test.want)
+			}
+			if !reflect.DeepEqual(resolved.HostPorts, []string{"5432"}) {
+				t.Errorf("HostPorts = %q, want the host service ports", resolved.HostPorts)
+			}
+
+			warned := len(sink.entries) == 1 && sink.entries[0].Event == EventPolicyNetworkMissing
+			if warned != test.wantWarning || (!test.wantWarning && len(sink.entries) != 0) {
+				t.Errorf("log entries = %d, want a missing network warning %t", len(sink.entries), test.wantWarning)
+			}
+		})
+	}
+}
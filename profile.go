@@ -0,0 +1,478 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"net"
+	"sync"
+	"time"
+)
+
+const defaultProfileName = "default"
+
+// Profile describes one Docker engine connected through its own tunnel. The
+// default profile is configured at the top level of the config file, further
+// engines are listed under "profiles".
+type Profile struct {
+	Name string `json:"name"`
+	// DockerHost is the engine endpoint, like "npipe:////./pipe/podman-machine-default"
+	// or "tcp://devbox:2376". Empty uses DOCKER_HOST or Docker Desktop.
+	DockerHost    string `json:"dockerHost"`
+	InterfaceName string `json:"interfaceName"`
+	// HostPeerIp, VmPeerIp and Port are picked from the peer pool and the
+	// free UDP ports when left empty.
+	HostPeerIp string `json:"hostPeerIp"`
+	VmPeerIp   string `json:"vmPeerIp"`
+	Port       int    `json:"port"`
+
+	// PreserveSourceIp skips masquerading on the VM so containers see the
+	// host tunnel address as the client instead of the bridge gateway.
+	PreserveSourceIp bool `json:"preserveSourceIp"`
+	// Policy restricts traffic between the host and containers, nil leaves
+	// every routed network open.
+	Policy *AccessPolicy `json:"policy"`
+	// HostServices lets containers reach selected ports on the host, nil
+	// keeps the host closed.
+	HostServices *HostServices `json:"hostServices"`
+	// ListenerSources are the networks allowed to reach the WireGuard port,
+	// by default those of the WSL and Hyper-V virtual switches.
+	ListenerSources []string `json:"listenerSources"`
+	// RouteAddressPools routes the engine's default address pools as a whole
+	// instead of every network on its own. AddressPools replaces the pools the
+	// engine reports.
+	RouteAddressPools bool     `json:"routeAddressPools"`
+	AddressPools      []string `json:"addressPools"`
+	// Kubernetes routes the ranges of local Kubernetes clusters, nil routes
+	// Docker networks only.
+	Kubernetes *KubernetesSource `json:"kubernetes"`
+	// ExtraRoutes are ranges behind the Docker VM that aren't Docker
+	// networks, "<cidr>" or "<cidr> via <gateway>".
+	ExtraRoutes []string `json:"extraRoutes"`
+}
+
+// withDefaults fills the unset names, index 0 is the default profile.
+func (p Profile) withDefaults(index int) *Profile {
+	if p.Name == "" {
+		p.Name = defaultProfileName
+	}
+	if p.InterfaceName == "" {
+		p.InterfaceName = "docker-win-net-connect"
+		if index > 0 {
+			// WireGuard limits tunnel names to 32 characters
+			p.InterfaceName = "dwnc-" + p.Name
+		}
+	}
+	return &p
+}
+
+func (p *Profile) Validate() error {
+	if len(p.InterfaceName) > 32 {
+		return fmt.Errorf("interface name %s is longer than 32 characters", p.InterfaceName)
+	}
+
+	if (p.HostPeerIp == "") != (p.VmPeerIp == "") {
+		return errors.New("hostPeerIp and vmPeerIp must be set together")
+	}
+
+	if p.HostPeerIp != "" {
+		for _, ip := range []string{p.HostPeerIp, p.VmPeerIp} {
+			if net.ParseIP(ip).To4() == nil {
+				return fmt.Errorf("invalid peer IP %s", ip)
+			}
+		}
+	}
+
+	if p.Port < 0 || p.Port > 65535 {
+		return fmt.Errorf("invalid port %d", p.Port)
+	}
+
+	if p.Policy != nil {
+		err := p.Policy.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, source := range p.ListenerSources {
+		_, _, err := net.ParseCIDR(source)
+		if err != nil {
+			return fmt.Errorf("invalid listener source %s: %w", source, err)
+		}
+	}
+
+	for _, pool := range p.AddressPools {
+		ip, _, err := net.ParseCIDR(pool)
+		if err != nil || ip.To4() == nil {
+			return fmt.Errorf("invalid address pool %s", pool)
+		}
+	}
+
+	for _, route := range p.ExtraRoutes {
+		_, err := parseExtraRoute(route)
+		if err != nil {
+			return fmt.Errorf("invalid extra route %s: %w", route, err)
+		}
+	}
+
+	if p.Kubernetes != nil {
+		err := p.Kubernetes.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	if p.HostServices != nil {
+		err := p.HostServices.Validate()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (p *Profile) wireguardOptions() *WireguardOptions {
+	// the routes are validated with the config
+	var extraRoutes []VMRoute
+	for _, value := range p.ExtraRoutes {
+		route, err := parseExtraRoute(value)
+		if err == nil {
+			extraRoutes = append(extraRoutes, route)
+		}
+	}
+
+	return &WireguardOptions{
+		Name:          p.Name,
+		InterfaceName: p.InterfaceName,
+		HostPeerIp:    p.HostPeerIp,
+		VmPeerIp:      p.VmPeerIp,
+		Port:          p.Port,
+
+		PreserveSourceIp: p.PreserveSourceIp,
+		Policy:           p.Policy,
+		HostServices:     p.HostServices,
+		ListenerSources:  p.ListenerSources,
+
+		RouteAddressPools: p.RouteAddressPools,
+		AddressPools:      p.AddressPools,
+		Kubernetes:        p.Kubernetes,
+		ExtraRoutes:       extraRoutes,
+	}
+}
+
+// ProfileRunner owns the Docker client and the tunnel of one profile.
+type ProfileRunner struct {
+	log       *Logger
+	profile   *Profile
+	allocator *Allocator
+	journal   *Journal
+	dataDir   string
+	docker    *Docker
+
+	mu        sync.Mutex
+	allocated *Profile
+	wireguard *Wireguard
+	suspended bool
+	state     string
+	lastError string
+}
+
+// ProfileStatus is the state of a profile as reported by the control API.
+type ProfileStatus struct {
+	Name          string         `json:"name"`
+	DockerHost    string         `json:"dockerHost"`
+	InterfaceName string         `json:"interfaceName"`
+	HostPeerIp    string         `json:"hostPeerIp"`
+	VmPeerIp      string         `json:"vmPeerIp"`
+	Port          int            `json:"port"`
+	State         string         `json:"state"`
+	LastError     string         `json:"lastError,omitempty"`
+	Networks      int            `json:"networks"`
+	RouteFailures []RouteFailure `json:"routeFailures,omitempty"`
+	AddressPools  []string       `json:"addressPools,omitempty"`
+	HostServices  *HostServices  `json:"hostServices,omitempty"`
+}
+
+func NewProfileRunner(ctx context.Context, profile *Profile, allocator *Allocator, journal *Journal, dataDir string) (*ProfileRunner, error) {
+	docker, err := NewDocker(ctx, profile.DockerHost)
+	if err != nil {
+		return nil, errors.New("failed to create Docker client: " + err.Error())
+	}
+
+	return &ProfileRunner{
+		log:       logger.With("profile", profile.Name),
+		profile:   profile,
+		allocator: allocator,
+		journal:   journal,
+		dataDir:   dataDir,
+		docker:    docker,
+		allocated: profile,
+		state:     "starting",
+	}, nil
+}
+
+func (p *ProfileRunner) setState(state string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.state = state
+	p.lastError = ""
+	if err != nil {
+		p.lastError = err.Error()
+	}
+}
+
+func (p *ProfileRunner) getWireguard() (*Wireguard, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.wireguard == nil {
+		return nil, fmt.Errorf("profile %s is not set up yet", p.profile.Name)
+	}
+
+	return p.wireguard, nil
+}
+
+// allocate waits for the engine and picks the tunnel addressing, Docker
+// networks have to be known to avoid them.
+func (p *ProfileRunner) allocate() error {
+	err := p.docker.WaitRunning()
+	if err != nil {
+		return err
+	}
+
+	profile, err := p.allocator.Allocate(p.profile, p.docker)
+	if err != nil {
+		return err
+	}
+
+	opts := profile.wireguardOptions()
+	opts.DataDir = p.dataDir
+
+	wireguard, err := NewWireguard(p.docker, opts, p.journal)
+	if err != nil {
+		return errors.New("failed to create Wireguard: " + err.Error())
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.allocated = profile
+	p.wireguard = wireguard
+
+	p.log.Info(EventAllocated, "Allocated tunnel addresses", "hostPeerIp", profile.HostPeerIp, "vmPeerIp", profile.VmPeerIp, "port", profile.Port)
+
+	return nil
+}
+
+// Run sets up the tunnel and keeps the VM side and routes in sync until ctx
+// is cancelled.
+func (p *ProfileRunner) Run(ctx context.Context) {
+	name := p.profile.Name
+	defer p.setState("stopped", nil)
+
+	p.mu.Lock()
+	p.suspended = false
+	allocated := p.wireguard != nil
+	p.mu.Unlock()
+
+	for !allocated {
+		p.setState("allocating addresses", nil)
+		err := p.allocate()
+		if err != nil {
+			p.setState("allocating addresses", err)
+			p.log.Error(EventAllocationFailed, "Failed to allocate tunnel addresses", "error", err)
+			timer := time.NewTimer(5 * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				continue
+			}
+		}
+
+		allocated = true
+	}
+
+	for {
+		p.setState("setting up tunnel", nil)
+		err := p.wireguard.Setup()
+		if err != nil {
+			p.setState("setting up tunnel", err)
+			p.log.Error(EventTunnelSetupFailed, "Failed to setup Wireguard", "error", err)
+			// break out if we are shutting down
+			timer := time.NewTimer(5 * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-timer.C:
+				continue
+			}
+		}
+
+		break
+	}
+
+	p.log.Info(EventTunnelListening, "Wireguard server listening")
+
+	for ctx.Err() == nil {
+		p.setState("setting up VM", nil)
+		p.log.Info(EventSettingUpVM, "Setting up Wireguard on Docker VM")
+		started := time.Now()
+		err := p.wireguard.SetupVM()
+		metrics.Observe("dwnc_setup_vm_duration_seconds", time.Since(started), "profile", name)
+		if err != nil {
+			metrics.Inc("dwnc_setup_vm_attempts_total", "profile", name, "result", "failure")
+			p.setState("setting up VM", err)
+			p.log.Error(EventSetupVMFailed, "Failed to setup VM", "error", err)
+			time.Sleep(1 * time.Second)
+			continue
+		}
+
+		metrics.Inc("dwnc_setup_vm_attempts_total", "profile", name, "result", "success")
+		p.setState("connected", nil)
+		p.log.Info(EventWatchingEvents, "Watching Docker events")
+		stop := p.wireguard.Start(ctx)
+		if stop {
+			return
+		}
+
+		time.Sleep(1 * time.Second)
+	}
+}
+
+// Pause brings the tunnel down after Run has returned, Run brings it back.
+// Without keepKeys the VM side is torn down as well and the keys and
+// addresses are dropped and picked again.
+func (p *ProfileRunner) Pause(keepKeys bool) error {
+	// the state changes under the lock, the slow helper and route work runs
+	// without it so Status and the control requests aren't held up
+	p.mu.Lock()
+	p.suspended = true
+	p.state = "paused"
+	p.lastError = ""
+	wireguard := p.wireguard
+	if !keepKeys {
+		p.wireguard = nil
+		p.allocated = p.profile
+	}
+	p.mu.Unlock()
+
+	if wireguard == nil {
+		return nil
+	}
+
+	err := wireguard.Suspend()
+	if err != nil {
+		p.setState("paused", err)
+	}
+
+	if !keepKeys {
+		// Close can't tear the VM side down once the tunnel state is gone
+		p.log.Info(EventTearingDownVM, "Tearing down Docker VM side")
+		vmErr := wireguard.TeardownVM()
+		if vmErr != nil {
+			p.log.Warning(EventVMTeardownFailed, "Failed to teardown Docker VM side", "error", vmErr)
+		}
+	}
+
+	return err
+}
+
+func (p *ProfileRunner) Status() ProfileStatus {
+	p.mu.Lock()
+	profile, wireguard := p.allocated, p.wireguard
+	status := ProfileStatus{
+		Name:          profile.Name,
+		DockerHost:    profile.DockerHost,
+		InterfaceName: profile.InterfaceName,
+		HostPeerIp:    profile.HostPeerIp,
+		VmPeerIp:      profile.VmPeerIp,
+		Port:          profile.Port,
+		State:         p.state,
+		LastError:     p.lastError,
+		HostServices:  profile.HostServices,
+	}
+	p.mu.Unlock()
+
+	if wireguard != nil && status.State == "connected" {
+		networks, err := wireguard.Networks()
+		if err == nil {
+			status.Networks = len(networks)
+		}
+	}
+	if wireguard != nil {
+		status.RouteFailures = wireguard.RouteFailures()
+		for _, pool := range wireguard.networkManager.Pools() {
+			status.AddressPools = append(status.AddressPools, pool.String())
+		}
+	}
+
+	return status
+}
+
+func (p *ProfileRunner) Networks() ([]types.NetworkResource, error) {
+	wireguard, err := p.getWireguard()
+	if err != nil {
+		return nil, err
+	}
+
+	return wireguard.Networks()
+}
+
+func (p *ProfileRunner) Reconcile() error {
+	wireguard, err := p.getWireguard()
+	if err != nil {
+		return err
+	}
+
+	return wireguard.Reconcile()
+}
+
+func (p *ProfileRunner) Reprovision() error {
+	wireguard, err := p.getWireguard()
+	if err != nil {
+		return err
+	}
+
+	wireguard.Reprovision()
+
+	return nil
+}
+
+// Close tears the tunnel down after Run has returned and closes the Docker
+// client.
+func (p *ProfileRunner) Close() {
+	p.mu.Lock()
+	wireguard, suspended := p.wireguard, p.suspended
+	p.mu.Unlock()
+
+	// routes first so nothing is sent into a half removed tunnel, then the VM
+	// side while the tunnel still exists, then the host side
+	if wireguard != nil {
+		if !suspended {
+			p.log.Info(EventWithdrawingRoutes, "Removing routes")
+			wireguard.withdrawRoutes()
+		}
+
+		p.log.Info(EventTearingDownVM, "Tearing down Docker VM side")
+		err := wireguard.TeardownVM()
+		if err != nil {
+			p.log.Warning(EventVMTeardownFailed, "Failed to teardown Docker VM side", "error", err)
+		}
+
+		if !suspended {
+			p.log.Info(EventTearingDownHost, "Tearing down host side")
+			err = wireguard.Teardown()
+			if err != nil {
+				p.log.Error(EventTeardownFailed, "Failed to teardown Wireguard", "error", err)
+			}
+		}
+	}
+
+	err := p.docker.Close()
+	if err != nil {
+		p.log.Error(EventDockerCloseFailed, "Failed to close Docker client", "error", err)
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/network"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"time"
+)
+
+const (
+	selfTestPort    = 8080
+	selfTestTimeout = 60 * time.Second
+)
+
+// SelfTest proves the whole path works: it creates a throwaway network with a
+// small HTTP responder from the setup image, waits for the service to route
+// the network and fetches a random token from the host.
+type SelfTest struct {
+	Utils
+	name string
+}
+
+func NewSelfTest(name string) *SelfTest {
+	return &SelfTest{name: name}
+}
+
+func (t *SelfTest) step(format string, args ...any) {
+	fmt.Printf("  "+format+"\n", args...)
+}
+
+// Run tests the named profile, the default one when name is empty. The
+// network and the container are removed whatever happens.
+func (t *SelfTest) Run(profileName string) error {
+	config, err := loadConfig(t.name)
+	if err != nil {
+		return err
+	}
+
+	profile, err := config.GetProfile(profileName)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*selfTestTimeout)
+	defer cancel()
+
+	docker, err := NewDocker(ctx, profile.DockerHost)
+	if err != nil {
+		return errors.New("failed to create Docker client: " + err.Error())
+	}
+	defer docker.Close()
+
+	fmt.Printf("Self test of profile %s\n", profile.Name)
+
+	token, err := newSelfTestToken()
+	if err != nil {
+		return err
+	}
+
+	name := fmt.Sprintf("dwnc-selftest-%d", time.Now().UnixNano())
+	started := time.Now()
+
+	created, err := docker.cli.NetworkCreate(ctx, name, types.NetworkCreate{
+		Driver: "bridge",
+		Labels: map[string]string{"docker-win-net-connect.selftest": "true"},
+	})
+	if err != nil {
+		return errors.New("failed to create network: " + err.Error())
+	}
+	defer t.cleanup(docker, name, created.ID)
+
+	inspected, err := docker.cli.NetworkInspect(ctx, created.ID, types.NetworkInspectOptions{})
+	if err != nil {
+		return errors.New("failed to inspect network: " + err.Error())
+	}
+	if len(inspected.IPAM.Config) == 0 {
+		return errors.New("network " + name + " has no subnet")
+	}
+	subnet := inspected.IPAM.Config[0].Subnet
+	t.step("created network %s with subnet %s", name, subnet)
+
+	resp, err := docker.cli.ContainerCreate(ctx, &container.Config{
+		Image: version.SetupImage,
+		Env:   []string{"MODE=serve", "SELFTEST_TOKEN=" + token},
+	}, &container.HostConfig{}, &network.NetworkingConfig{
+		EndpointsConfig: map[string]*network.EndpointSettings{name: {}},
+	}, nil, name)
+	if err != nil {
+		return errors.New("failed to create responder: " + err.Error())
+	}
+
+	err = docker.cli.ContainerStart(ctx, resp.ID, types.ContainerStartOptions{})
+	if err != nil {
+		return errors.New("failed to start responder: " + err.Error())
+	}
+
+	info, err := docker.cli.ContainerInspect(ctx, resp.ID)
+	if err != nil {
+		return errors.New("failed to inspect responder: " + err.Error())
+	}
+	endpoint := info.NetworkSettings.Networks[name]
+	if endpoint == nil || endpoint.IPAddress == "" {
+		return errors.New("responder has no address on " + name)
+	}
+	t.step("started responder at %s:%d", endpoint.IPAddress, selfTestPort)
+
+	err = t.waitForRoute(profile.InterfaceName, subnet)
+	if err != nil {
+		return err
+	}
+	routed := time.Since(started)
+	t.step("route through %s appeared after %s", profile.InterfaceName, routed.Round(time.Millisecond))
+
+	firstByte, err := t.fetch(fmt.Sprintf("http://%s:%d/", endpoint.IPAddress, selfTestPort), token)
+	if err != nil {
+		return err
+	}
+	t.step("fetched the token, first byte after %s", firstByte.Round(time.Millisecond))
+
+	fmt.Println()
+	fmt.Printf("Route propagation:  %s\n", routed.Round(time.Millisecond))
+	fmt.Printf("First byte:         %s\n", firstByte.Round(time.Millisecond))
+	fmt.Println("Self test passed")
+
+	return nil
+}
+
+func newSelfTestToken() (string, error) {
+	data := make([]byte, 16)
+	_, err := rand.Read(data)
+	if err != nil {
+		return "", errors.New("failed to generate token: " + err.Error())
+	}
+
+	return hex.EncodeToString(data), nil
+}
+
+// waitForRoute polls until a route through the tunnel interface covers
+// subnet, its own or that of a routed address pool.
+func (t *SelfTest) waitForRoute(interfaceName, subnet string) error {
+	_, target, err := net.ParseCIDR(subnet)
+	if err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(selfTestTimeout)
+	for {
+		routes, err := t.getRoutes()
+		if err == nil {
+			for _, route := range routes {
+				_, ipNet, err := net.ParseCIDR(route[1])
+				if err == nil && route[0] == interfaceName && !strings.HasSuffix(route[1], "/0") && coveredBy(target, []*net.IPNet{ipNet}) {
+					return nil
+				}
+			}
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("no route for %s through %s after %s, is the service running?", subnet, interfaceName, selfTestTimeout)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// fetch requests url until it answers with token and returns the time to the
+// first byte of the successful request. AllowedIPs may be updated a little
+// after the route.
+func (t *SelfTest) fetch(url, token string) (time.Duration, error) {
+	client := &http.Client{Timeout: 5 * time.Second}
+	deadline := time.Now().Add(selfTestTimeout)
+
+	for {
+		firstByte, body, err := t.get(client, url)
+		if err == nil && body == token {
+			return firstByte, nil
+		}
+		if err == nil {
+			err = errors.New("unexpected response " + body)
+		}
+
+		if time.Now().After(deadline) {
+			return 0, fmt.Errorf("failed to fetch %s: %w", url, err)
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+func (t *SelfTest) get(client *http.Client, url string) (time.Duration, string, error) {
+	var firstByte time.Duration
+	started := time.Now()
+	trace := &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			firstByte = time.Since(started)
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req = req.WithContext(httptrace.WithClientTrace(req.Context(), trace))
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, "", err
+	}
+
+	return firstByte, string(body), nil
+}
+
+// cleanup removes the responder and the network with a fresh context, the
+// test's own may have run out.
+func (t *SelfTest) cleanup(docker *Docker, name, networkID string) {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	err := docker.cli.ContainerRemove(ctx, name, types.ContainerRemoveOptions{Force: true})
+	if err != nil && !strings.Contains(err.Error(), "No such container") {
+		t.step("failed to remove responder %s: %v", name, err)
+	}
+
+	err = docker.cli.NetworkRemove(ctx, networkID)
+	if err != nil {
+		t.step("failed to remove network %s: %v", name, err)
+		return
+	}
+	t.step("removed network %s", name)
+}
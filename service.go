@@ -1,37 +1,63 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"golang.org/x/sys/windows/svc"
 	"golang.org/x/sys/windows/svc/debug"
 	"golang.org/x/sys/windows/svc/eventlog"
 	"golang.org/x/sys/windows/svc/mgr"
+	"os"
+	"path/filepath"
+	"strings"
 	"time"
 )
 
 func runService(name string, isDebug bool) {
-	var err error
+	var sinks []Sink
 	if isDebug {
-		elog = debug.New(name)
+		sinks = append(sinks, NewStdoutSink())
 	} else {
-		elog, err = eventlog.Open(name)
+		elog, err := eventlog.Open(name)
 		if err != nil {
 			return
 		}
+		sinks = append(sinks, NewEventLogSink(elog))
 	}
-	defer elog.Close()
 
-	_ = elog.Info(2, fmt.Sprintf("starting %s service", name))
+	// a broken config is reported by the service itself once it starts
+	level := LevelInfo
+	var fileErr error
+	config, err := loadConfig(name)
+	if err == nil {
+		level, _ = ParseLevel(config.Log.Level)
+
+		var sink *FileSink
+		sink, fileErr = newLogFileSink(name, config.Log)
+		if sink != nil {
+			sinks = append(sinks, sink)
+		}
+	}
+
+	logger = NewLogger(level, sinks...)
+	defer logger.Close()
+
+	if fileErr != nil {
+		logger.Warning(EventLogFileFailed, "Failed to open log file", "error", fileErr)
+	}
+
+	logger.Info(EventServiceStarting, "Starting service", "service", name)
 	run := svc.Run
 	if isDebug {
 		run = debug.Run
 	}
-	err = run(name, &VPNService{})
+	err = run(name, &VPNService{name: name})
 	if err != nil {
-		_ = elog.Error(4, fmt.Sprintf("%s service failed: %v", name, err))
+		logger.Error(EventServiceFailed, "Service failed", "service", name, "error", err)
 		return
 	}
-	_ = elog.Info(3, fmt.Sprintf("%s service stopped", name))
+	logger.Info(EventServiceStopped, "Service stopped", "service", name)
 }
 
 type Manager struct {
@@ -75,7 +101,8 @@ func (m *Manager) ControlService(c svc.Cmd, to svc.State) error {
 	if err != nil {
 		return fmt.Errorf("could not send control=%d: %v", c, err)
 	}
-	timeout := time.Now().Add(10 * time.Second)
+	// stopping waits for the profiles and tears every tunnel down
+	timeout := time.Now().Add(2 * time.Minute)
 	for status.State != to {
 		if timeout.Before(time.Now()) {
 			return fmt.Errorf("timeout waiting for service to go to state=%d", to)
@@ -89,6 +116,95 @@ func (m *Manager) ControlService(c svc.Cmd, to svc.State) error {
 	return nil
 }
 
+func (m *Manager) QueryService() (svc.State, error) {
+	_m, err := mgr.Connect()
+	if err != nil {
+		return 0, err
+	}
+	defer _m.Disconnect()
+	s, err := _m.OpenService(m.name)
+	if err != nil {
+		return 0, fmt.Errorf("could not access service: %v", err)
+	}
+	defer s.Close()
+	status, err := s.Query()
+	if err != nil {
+		return 0, fmt.Errorf("could not retrieve service status: %v", err)
+	}
+	return status.State, nil
+}
+
+// InstallOptions are the service settings given to the install command.
+type InstallOptions struct {
+	// StartType is one of auto, delayed, manual and disabled.
+	StartType string
+	// RestartDelays are the waits before the service is restarted after its
+	// first, second and later failures, empty disables recovery.
+	RestartDelays []time.Duration
+	// ResetPeriod is the time without failures after which the failure count
+	// starts over.
+	ResetPeriod  time.Duration
+	Dependencies []string
+	// Account runs the service under this account instead of LocalSystem.
+	Account     string
+	Password    string
+	Description string
+}
+
+var startTypes = map[string]uint32{
+	"auto":     mgr.StartAutomatic,
+	"delayed":  mgr.StartAutomatic,
+	"manual":   mgr.StartManual,
+	"disabled": mgr.StartDisabled,
+}
+
+// parseInstallOptions reads the flags following the install command.
+func parseInstallOptions(args []string) (*InstallOptions, error) {
+	flags := flag.NewFlagSet("install", flag.ContinueOnError)
+	startType := flags.String("start", "auto", "start type: auto, delayed, manual or disabled")
+	restart := flags.String("restart", "5s,30s,1m", "comma separated restart delays after failures, or none")
+	resetPeriod := flags.Duration("reset", 24*time.Hour, "time without failures after which the failure count is reset")
+	depends := flags.String("depends", "", "comma separated services to start first, like com.docker.service")
+	account := flags.String("account", "", "account to run the service as, LocalSystem by default")
+	password := flags.String("password", "", "password of the account")
+	description := flags.String("description", "Routes Docker container networks to Windows through a WireGuard tunnel", "service description")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, ok := startTypes[*startType]; !ok {
+		return nil, fmt.Errorf("invalid start type %s", *startType)
+	}
+
+	opts := &InstallOptions{
+		StartType:   *startType,
+		ResetPeriod: *resetPeriod,
+		Account:     *account,
+		Password:    *password,
+		Description: *description,
+	}
+
+	if *restart != "none" && *restart != "" {
+		for _, value := range strings.Split(*restart, ",") {
+			delay, err := time.ParseDuration(strings.TrimSpace(value))
+			if err != nil {
+				return nil, fmt.Errorf("invalid restart delay %s: %w", value, err)
+			}
+			opts.RestartDelays = append(opts.RestartDelays, delay)
+		}
+	}
+
+	for _, dependency := range strings.Split(*depends, ",") {
+		if dependency = strings.TrimSpace(dependency); dependency != "" {
+			opts.Dependencies = append(opts.Dependencies, dependency)
+		}
+	}
+
+	return opts, nil
+}
+
 type Installer struct {
 	path string
 	name string
@@ -103,7 +219,7 @@ func NewInstaller(path, name, desc string) *Installer {
 	}
 }
 
-func (i *Installer) InstallService() error {
+func (i *Installer) InstallService(opts *InstallOptions) error {
 	m, err := mgr.Connect()
 	if err != nil {
 		return err
@@ -115,13 +231,23 @@ func (i *Installer) InstallService() error {
 		return fmt.Errorf("service %s already exists", i.name)
 	}
 	s, err = m.CreateService(i.name, i.path, mgr.Config{
-		DisplayName: i.desc,
-		StartType:   mgr.StartAutomatic,
+		DisplayName:      i.desc,
+		Description:      opts.Description,
+		StartType:        startTypes[opts.StartType],
+		DelayedAutoStart: opts.StartType == "delayed",
+		Dependencies:     opts.Dependencies,
+		ServiceStartName: opts.Account,
+		Password:         opts.Password,
 	}, "is", "auto-started")
 	if err != nil {
 		return err
 	}
 	defer s.Close()
+	err = i.setRecoveryActions(s, opts)
+	if err != nil {
+		_ = s.Delete()
+		return err
+	}
 	err = eventlog.InstallAsEventCreate(i.name, eventlog.Error|eventlog.Warning|eventlog.Info)
 	if err != nil {
 		_ = s.Delete()
@@ -130,6 +256,34 @@ func (i *Installer) InstallService() error {
 	return nil
 }
 
+// setRecoveryActions restarts the service after failures, including a start
+// that returns an exit code rather than crashing.
+func (i *Installer) setRecoveryActions(s *mgr.Service, opts *InstallOptions) error {
+	if len(opts.RestartDelays) == 0 {
+		return nil
+	}
+
+	var actions []mgr.RecoveryAction
+	for _, delay := range opts.RestartDelays {
+		actions = append(actions, mgr.RecoveryAction{Type: mgr.ServiceRestart, Delay: delay})
+	}
+
+	err := s.SetRecoveryActions(actions, uint32(opts.ResetPeriod.Seconds()))
+	if err != nil {
+		return fmt.Errorf("failed to set recovery actions: %s", err)
+	}
+
+	err = s.SetRecoveryActionsOnNonCrashFailures(true)
+	if err != nil {
+		return fmt.Errorf("failed to set recovery actions: %s", err)
+	}
+
+	return nil
+}
+
+// RemoveService stops the service, deletes it and purges everything it
+// created: firewall rules, leftovers recorded in the journal, the extracted
+// binaries and the generated files. The config file is kept.
 func (i *Installer) RemoveService() error {
 	m, err := mgr.Connect()
 	if err != nil {
@@ -141,6 +295,26 @@ func (i *Installer) RemoveService() error {
 		return fmt.Errorf("service %s is not installed", i.name)
 	}
 	defer s.Close()
+	// an invalid config must not leave an uninstalled service with its rules
+	// and leftovers still in place
+	config, err := loadConfig(i.name)
+	if err != nil {
+		return err
+	}
+	journal, err := loadJournal(i.name)
+	if err != nil {
+		return err
+	}
+	status, err := s.Query()
+	if err != nil {
+		return fmt.Errorf("could not retrieve service status: %v", err)
+	}
+	if status.State != svc.Stopped {
+		err = NewManager(i.name).ControlService(svc.Stop, svc.Stopped)
+		if err != nil {
+			return err
+		}
+	}
 	err = s.Delete()
 	if err != nil {
 		return err
@@ -149,5 +323,48 @@ func (i *Installer) RemoveService() error {
 	if err != nil {
 		return fmt.Errorf("RemoveEventLogSource() failed: %s", err)
 	}
+	for _, profile := range config.GetProfiles() {
+		err = newListenerFirewall(profile.InterfaceName).Clear()
+		if err != nil {
+			return fmt.Errorf("failed to remove listener firewall rules: %s", err)
+		}
+	}
+	err = journal.Replay()
+	if err != nil {
+		return fmt.Errorf("failed to clean up: %s", err)
+	}
+	return i.purgeFiles()
+}
+
+// purgeFiles removes the data directory and the files the service generated
+// next to the executable.
+func (i *Installer) purgeFiles() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return errors.New("failed to get executable path: " + err.Error())
+	}
+	dir := filepath.Dir(exe)
+
+	paths := []string{
+		getDataDir(i.name),
+		// allocations and journal written by older versions
+		filepath.Join(dir, i.name+".allocations.json"),
+		filepath.Join(dir, i.name+".state.json"),
+	}
+	// binaries extracted by older versions, in a checkout they are the
+	// sources of the embedded ones
+	_, err = os.Stat(filepath.Join(dir, "go.mod"))
+	if err != nil {
+		paths = append(paths, filepath.Join(dir, "bin", "wg.exe"), filepath.Join(dir, "bin", "wireguard.exe"))
+	}
+	logs, _ := filepath.Glob(filepath.Join(dir, i.name+".log*"))
+	paths = append(paths, logs...)
+
+	for _, path := range paths {
+		err = os.RemoveAll(path)
+		if err != nil {
+			return fmt.Errorf("failed to remove %s: %s", path, err)
+		}
+	}
 	return nil
 }
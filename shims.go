@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"net"
+	"sort"
+)
+
+// ShimNetwork is a macvlan or ipvlan network the helper sets a shim up for,
+// sent in SHIM_NETWORKS. The VM can't reach the containers of such networks
+// through the parent interface.
+type ShimNetwork struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Driver  string `json:"driver"`
+	Mode    string `json:"mode,omitempty"`
+	Parent  string `json:"parent"`
+	Subnet  string `json:"subnet"`
+	Address string `json:"address"`
+}
+
+func needsShim(driver string) bool {
+	return driver == "macvlan" || driver == "ipvlan"
+}
+
+// shimNetwork describes the shim of a network, nil for other drivers or
+// networks without an IPv4 subnet. It fails for networks a shim can't serve.
+func shimNetwork(network types.NetworkResource) (*ShimNetwork, error) {
+	if !needsShim(network.Driver) {
+		return nil, nil
+	}
+
+	mode := network.Options[network.Driver+"_mode"]
+	if network.Driver == "macvlan" && mode == "private" {
+		// private children don't talk to each other, the shim included
+		return nil, errors.New("macvlan mode private keeps the shim from reaching the containers")
+	}
+
+	// without a parent Docker creates a dummy link named after the network
+	parent := network.Options["parent"]
+	if parent == "" && len(network.ID) >= 12 {
+		parent = "dm-" + network.ID[:12]
+	}
+
+	for _, config := range network.IPAM.Config {
+		_, ipNet, err := net.ParseCIDR(config.Subnet)
+		if err != nil || ipNet.IP.To4() == nil {
+			continue
+		}
+
+		// containers are only given addresses of the range when one is set
+		subnet := ipNet
+		if _, ipRange, err := net.ParseCIDR(config.IPRange); err == nil {
+			subnet = ipRange
+		}
+
+		address, err := shimAddress(ipNet, config.AuxAddress)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ShimNetwork{
+			ID:      network.ID,
+			Name:    network.Name,
+			Driver:  network.Driver,
+			Mode:    mode,
+			Parent:  parent,
+			Subnet:  subnet.String(),
+			Address: address,
+		}, nil
+	}
+
+	return nil, nil
+}
+
+// shimAddress returns the auxiliary address named shim or host, reserved with
+// --aux-address. Any other address of the subnet may belong to a container or,
+// on a network bridged to the LAN, to another machine.
+func shimAddress(subnet *net.IPNet, auxAddresses map[string]string) (string, error) {
+	for _, key := range []string{"shim", "host"} {
+		address, ok := auxAddresses[key]
+		if !ok {
+			continue
+		}
+
+		ip := net.ParseIP(address).To4()
+		if ip == nil || !subnet.Contains(ip) {
+			return "", fmt.Errorf("auxiliary address %s=%s is not an address of %s", key, address, subnet)
+		}
+
+		return ip.String(), nil
+	}
+
+	return "", errors.New("no auxiliary address named shim or host, create the network with --aux-address shim=<ip>")
+}
+
+// getShimNetworks returns the SHIM_NETWORKS value for the helper.
+func (w *Wireguard) getShimNetworks() (string, error) {
+	networks, err := w.docker.cli.NetworkList(w.docker.ctx, types.NetworkListOptions{})
+	if err != nil {
+		return "", err
+	}
+
+	shims := []ShimNetwork{}
+	for _, network := range networks {
+		shim, err := shimNetwork(network)
+		if err != nil {
+			w.log.Warning(EventShimSkipped, "No shim for network, the VM can't reach its containers", "network", network.Name, "driver", network.Driver, "error", err)
+			continue
+		}
+		if shim != nil {
+			shims = append(shims, *shim)
+		}
+	}
+	sort.Slice(shims, func(i, j int) bool {
+		return shims[i].ID < shims[j].ID
+	})
+
+	data, err := json.Marshal(shims)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// applyShims re-runs the helper to create and remove the shims of macvlan and
+// ipvlan networks.
+func (w *Wireguard) applyShims() error {
+	shims, err := w.getShimNetworks()
+	if err != nil {
+		return err
+	}
+
+	return w.runHelper([]string{
+		"MODE=shims",
+		"SHIM_NETWORKS=" + shims,
+	})
+}
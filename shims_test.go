@@ -0,0 +1,149 @@
+package main
+
+import (
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestShimAddress(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("192.168.1.0/24")
+
+	tests := []struct {
+		name         string
+		auxAddresses map[string]string
+		want         string
+		wantErr      bool
+	}{
+		{name: "shim", auxAddresses: map[string]string{"shim": "192.168.1.250"}, want: "192.168.1.250"},
+		{name: "host", auxAddresses: map[string]string{"host": "192.168.1.251"}, want: "192.168.1.251"},
+		{name: "shim before host", auxAddresses: map[string]string{"host": "192.168.1.251", "shim": "192.168.1.250"}, want: "192.168.1.250"},
+		{name: "other names", auxAddresses: map[string]string{"router": "192.168.1.1"}, wantErr: true},
+		{name: "none", wantErr: true},
+		{name: "outside the subnet", auxAddresses: map[string]string{"shim": "192.168.2.250"}, wantErr: true},
+		{name: "invalid", auxAddresses: map[string]string{"shim": "shim"}, wantErr: true},
+		{name: "IPv6", auxAddresses: map[string]string{"shim": "fd00::1"}, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			address, err := shimAddress(subnet, test.auxAddresses)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("shimAddress = %s, want an error", address)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("shimAddress failed: %v", err)
+			}
+			if address != test.want {
+				t.Errorf("shimAddress = %s, want %s", address, test.want)
+			}
+		})
+	}
+}
+
+func TestShimNetwork(t *testing.T) {
+	const id = "0123456789abcdef0123456789abcdef"
+	config := network.IPAMConfig{
+		Subnet:     "192.168.1.0/24",
+		IPRange:    "192.168.1.128/25",
+		AuxAddress: map[string]string{"shim": "192.168.1.250"},
+	}
+
+	tests := []struct {
+		name    string
+		network types.NetworkResource
+		want    *ShimNetwork
+		wantErr bool
+	}{
+		{
+			name:    "bridge",
+			network: types.NetworkResource{ID: id, Name: "lan", Driver: "bridge", IPAM: network.IPAM{Config: []network.IPAMConfig{config}}},
+		},
+		{
+			name: "macvlan",
+			network: types.NetworkResource{
+				ID:      id,
+				Name:    "lan",
+				Driver:  "macvlan",
+				Options: map[string]string{"parent": "eth0", "macvlan_mode": "bridge"},
+				IPAM:    network.IPAM{Config: []network.IPAMConfig{config}},
+			},
+			want: &ShimNetwork{ID: id, Name: "lan", Driver: "macvlan", Mode: "bridge", Parent: "eth0", Subnet: "192.168.1.128/25", Address: "192.168.1.250"},
+		},
+		{
+			name: "ipvlan without parent",
+			network: types.NetworkResource{
+				ID:     id,
+				Name:   "lan",
+				Driver: "ipvlan",
+				IPAM:   network.IPAM{Config: []network.IPAMConfig{{Subnet: "192.168.1.0/24", AuxAddress: map[string]string{"host": "192.168.1.2"}}}},
+			},
+			want: &ShimNetwork{ID: id, Name: "lan", Driver: "ipvlan", Parent: "dm-0123456789ab", Subnet: "192.168.1.0/24", Address: "192.168.1.2"},
+		},
+		{
+			name: "IPv6 subnets are skipped",
+			network: types.NetworkResource{
+				ID:     id,
+				Name:   "lan",
+				Driver: "macvlan",
+				IPAM:   network.IPAM{Config: []network.IPAMConfig{{Subnet: "fd00::/64"}, config}},
+			},
+			want: &ShimNetwork{ID: id, Name: "lan", Driver: "macvlan", Parent: "dm-0123456789ab", Subnet: "192.168.1.128/25", Address: "192.168.1.250"},
+		},
+		{
+			name: "IPv6 only",
+			network: types.NetworkResource{
+				ID:     id,
+				Name:   "lan",
+				Driver: "macvlan",
+				IPAM:   network.IPAM{Config: []network.IPAMConfig{{Subnet: "fd00::/64"}}},
+			},
+		},
+		{
+			name: "macvlan private",
+			network: types.NetworkResource{
+				ID:      id,
+				Name:    "lan",
+				Driver:  "macvlan",
+				Options: map[string]string{"macvlan_mode": "private"},
+				IPAM:    network.IPAM{Config: []network.IPAMConfig{config}},
+			},
+			wantErr: true,
+		},
+		{
+			name: "no auxiliary address",
+			network: types.NetworkResource{
+				ID:     id,
+				Name:   "lan",
+				Driver: "macvlan",
+				IPAM:   network.IPAM{Config: []network.IPAMConfig{{Subnet: "192.168.1.0/24"}}},
+			},
+			wantErr: true,
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			shim, err := shimNetwork(test.network)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("shimNetwork = %+v, want an error", shim)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("shimNetwork failed: %v", err)
+			}
+			if !reflect.DeepEqual(shim, test.want) {
+				t.Errorf("shimNetwork = %+v, want %+v", shim, test.want)
+			}
+		})
+	}
+}
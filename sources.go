@@ -0,0 +1,344 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Ranges that aren't Docker networks are routed like them, as networks with an
+// ID of the form <source>/<name>. They share the queue, the retries and the
+// status reporting, the VM reaches them through the gateways in VM_ROUTES.
+
+const (
+	kubernetesSource = "kubernetes"
+	// staticSource holds the extraRoutes of the config under one network
+	staticSource = "static"
+	staticName   = "extra"
+)
+
+// parseExtraRoute reads an extraRoutes entry, a CIDR reached from the VM as
+// it is or "<CIDR> via <gateway>".
+func parseExtraRoute(value string) (VMRoute, error) {
+	fields := strings.Fields(value)
+	if len(fields) != 1 && (len(fields) != 3 || fields[1] != "via") {
+		return VMRoute{}, errors.New("expected <cidr> or <cidr> via <gateway>")
+	}
+
+	ip, ipNet, err := net.ParseCIDR(fields[0])
+	if err != nil || ip.To4() == nil {
+		return VMRoute{}, errors.New("invalid IPv4 CIDR " + fields[0])
+	}
+	if ones, _ := ipNet.Mask.Size(); ones == 0 {
+		return VMRoute{}, errors.New("the default route can't be routed through the tunnel")
+	}
+
+	route := VMRoute{Subnet: ipNet.String()}
+	if len(fields) == 3 {
+		if net.ParseIP(fields[2]).To4() == nil {
+			return VMRoute{}, errors.New("invalid gateway " + fields[2])
+		}
+		route.Via = fields[2]
+	}
+
+	return route, nil
+}
+
+// setStaticRoutes records the extra routes before the tunnel is installed, so
+// its AllowedIPs and the VM setup include them. Ranges overlapping the tunnel
+// addresses or a route of another interface, like the LAN or the switch the
+// VM reaches the listener through, are skipped, they would cut the host off.
+func (w *Wireguard) setStaticRoutes() error {
+	if len(w.extraRoutes) == 0 {
+		return nil
+	}
+
+	others, err := w.hostRanges()
+	if err != nil {
+		return err
+	}
+
+	var routes []VMRoute
+	for _, route := range w.extraRoutes {
+		_, ipNet, err := net.ParseCIDR(route.Subnet)
+		if err != nil {
+			continue
+		}
+		if overlapsAny(ipNet, others) {
+			w.log.Error(EventExtraRouteSkipped, "Extra route overlaps the tunnel or a route of another interface, skipping it", "subnet", route.Subnet)
+			continue
+		}
+		routes = append(routes, route)
+	}
+	if len(routes) == 0 {
+		return nil
+	}
+
+	if w.sourceRoutes == nil {
+		w.sourceRoutes = make(map[string][]VMRoute)
+	}
+	w.sourceRoutes[staticSource+"/"+staticName] = routes
+
+	return nil
+}
+
+// hostRanges returns the routes of other interfaces and the tunnel addresses.
+// A range routed through the tunnel that overlaps one of them would cut the
+// host off the LAN, the VM or the tunnel itself.
+func (w *Wireguard) hostRanges() ([]*net.IPNet, error) {
+	ranges, err := w.otherRoutes()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, ip := range []string{w.hostPeerIp, w.vmPeerIp} {
+		peer := net.ParseIP(ip).To4()
+		if peer != nil {
+			ranges = append(ranges, &net.IPNet{IP: peer, Mask: net.CIDRMask(32, 32)})
+		}
+	}
+
+	return ranges, nil
+}
+
+// clearRanges drops the ranges of a source that overlap the host's ranges or
+// a Docker network, like setStaticRoutes does for the extra routes. It runs
+// outside the event loop, the lookups take a while.
+func (w *Wireguard) clearRanges(source string, next map[string][]VMRoute) (map[string][]VMRoute, error) {
+	host, err := w.hostRanges()
+	if err != nil {
+		return nil, err
+	}
+
+	subnets, err := w.docker.GetSubnets()
+	if err != nil {
+		return nil, errors.New("failed to get docker subnets: " + err.Error())
+	}
+
+	var networks []*net.IPNet
+	for _, subnet := range subnets {
+		_, ipNet, err := net.ParseCIDR(subnet)
+		if err == nil {
+			networks = append(networks, ipNet)
+		}
+	}
+
+	return w.filterRanges(source, next, host, networks), nil
+}
+
+// filterRanges keeps the ranges of next clear of host and networks. Ranges
+// inside a Docker network are routed with it already, like the load balancer
+// addresses MetalLB hands out from kind's network.
+func (w *Wireguard) filterRanges(source string, next map[string][]VMRoute, host, networks []*net.IPNet) map[string][]VMRoute {
+	result := make(map[string][]VMRoute, len(next))
+	for name, routes := range next {
+		var kept []VMRoute
+		for _, route := range routes {
+			_, ipNet, err := net.ParseCIDR(route.Subnet)
+			if err != nil {
+				continue
+			}
+			if coveredBy(ipNet, networks) {
+				w.log.Debug(EventSourceRangeOverlap, "Range is inside a Docker network and routed with it", "source", source+"/"+name, "subnet", route.Subnet)
+				continue
+			}
+			if overlapsAny(ipNet, host) || overlapsAny(ipNet, networks) {
+				w.log.Warning(EventSourceRangeOverlap, "Range overlaps the tunnel, a route of another interface or a Docker network, skipping it", "source", source+"/"+name, "subnet", route.Subnet)
+				continue
+			}
+			kept = append(kept, route)
+		}
+		result[name] = kept
+	}
+
+	return result
+}
+
+// addStaticRoutes routes the extra routes once the interface is up, failures
+// show in status like those of Docker networks.
+func (w *Wireguard) addStaticRoutes() {
+	id := staticSource + "/" + staticName
+	routes, ok := w.sourceRoutes[id]
+	if !ok {
+		return
+	}
+
+	w.networkManager.QueueAdd(sourceNetwork(id, routes))
+}
+
+func sourceNetwork(id string, routes []VMRoute) types.NetworkResource {
+	source, _, _ := strings.Cut(id, "/")
+	resource := types.NetworkResource{ID: id, Name: id, Driver: source}
+	for _, route := range routes {
+		resource.IPAM.Config = append(resource.IPAM.Config, network.IPAMConfig{Subnet: route.Subnet})
+	}
+
+	return resource
+}
+
+// updateSources replaces the ranges of one source, keyed by name, and applies
+// the difference to the routes, the peer's AllowedIPs and the VM.
+func (w *Wireguard) updateSources(source string, next map[string][]VMRoute) {
+	if w.sourceRoutes == nil {
+		w.sourceRoutes = make(map[string][]VMRoute)
+	}
+	next = w.claimRanges(source, next)
+
+	changed := false
+	for id := range w.sourceRoutes {
+		name, found := strings.CutPrefix(id, source+"/")
+		if _, ok := next[name]; found && !ok {
+			w.networkManager.QueueRemove(id, id)
+			delete(w.sourceRoutes, id)
+			changed = true
+		}
+	}
+
+	for name, routes := range next {
+		id := source + "/" + name
+		previous, ok := w.sourceRoutes[id]
+		if ok && equalRoutes(previous, routes) {
+			continue
+		}
+
+		if ok {
+			w.networkManager.QueueRemove(id, id)
+		}
+		w.networkManager.QueueAdd(sourceNetwork(id, routes))
+		w.sourceRoutes[id] = routes
+		changed = true
+	}
+
+	if !changed {
+		return
+	}
+
+	w.log.Info(EventSourcesUpdated, "Routed ranges changed", "source", source, "entries", len(next))
+
+	// the peer's AllowedIPs follow once the queued routes have run
+	err := w.applyVMRoutes()
+	if err != nil {
+		w.log.Error(EventVMRoutesFailed, "Failed to update routes on the VM", "error", err)
+	}
+}
+
+// claimRanges drops the ranges of next that overlap those of other sources or
+// of another entry of the same source. Docker Desktop and kind clusters all
+// default to the same pod and service ranges, a route can only lead to one of
+// them. Entries routed already keep their ranges, the others are taken by
+// name.
+func (w *Wireguard) claimRanges(source string, next map[string][]VMRoute) map[string][]VMRoute {
+	var claimed []*net.IPNet
+	for id, routes := range w.sourceRoutes {
+		if strings.HasPrefix(id, source+"/") {
+			continue
+		}
+		claimed = appendSubnets(claimed, routes)
+	}
+
+	names := make([]string, 0, len(next))
+	for name := range next {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		_, iRouted := w.sourceRoutes[source+"/"+names[i]]
+		_, jRouted := w.sourceRoutes[source+"/"+names[j]]
+		if iRouted != jRouted {
+			return iRouted
+		}
+		return names[i] < names[j]
+	})
+
+	result := make(map[string][]VMRoute, len(next))
+	for _, name := range names {
+		var kept []VMRoute
+		for _, route := range next[name] {
+			_, ipNet, err := net.ParseCIDR(route.Subnet)
+			if err != nil {
+				continue
+			}
+			if overlapsAny(ipNet, claimed) {
+				w.log.Warning(EventSourceRangeOverlap, "Range overlaps one routed for another entry, skipping it", "source", source+"/"+name, "subnet", route.Subnet)
+				continue
+			}
+			kept = append(kept, route)
+		}
+		// the ranges of one entry may overlap each other
+		claimed = appendSubnets(claimed, kept)
+		result[name] = kept
+	}
+
+	return result
+}
+
+func appendSubnets(subnets []*net.IPNet, routes []VMRoute) []*net.IPNet {
+	for _, route := range routes {
+		_, ipNet, err := net.ParseCIDR(route.Subnet)
+		if err == nil {
+			subnets = append(subnets, ipNet)
+		}
+	}
+
+	return subnets
+}
+
+// sourceSubnets returns the ranges of every source, outside the routed
+// address pools.
+func (w *Wireguard) sourceSubnets() []string {
+	pools := w.networkManager.Pools()
+
+	var subnets []string
+	for _, id := range w.sourceIds() {
+		for _, route := range w.sourceRoutes[id] {
+			_, ipNet, err := net.ParseCIDR(route.Subnet)
+			if err == nil && coveredBy(ipNet, pools) {
+				continue
+			}
+			subnets = append(subnets, route.Subnet)
+		}
+	}
+
+	return subnets
+}
+
+func (w *Wireguard) sourceIds() []string {
+	ids := make([]string, 0, len(w.sourceRoutes))
+	for id := range w.sourceRoutes {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return ids
+}
+
+// getVMRoutes returns the VM_ROUTES value for the helper.
+func (w *Wireguard) getVMRoutes() (string, error) {
+	routes := []VMRoute{}
+	for _, id := range w.sourceIds() {
+		routes = append(routes, w.sourceRoutes[id]...)
+	}
+
+	data, err := json.Marshal(routes)
+	if err != nil {
+		return "", err
+	}
+
+	return string(data), nil
+}
+
+// applyVMRoutes re-runs the helper to update the routes of the VM.
+func (w *Wireguard) applyVMRoutes() error {
+	routes, err := w.getVMRoutes()
+	if err != nil {
+		return err
+	}
+
+	return w.runHelper([]string{
+		"MODE=routes",
+		"VM_ROUTES=" + routes,
+	})
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestClaimRanges(t *testing.T) {
+	tests := []struct {
+		name   string
+		routed map[string][]VMRoute
+		next   map[string][]VMRoute
+		want   map[string][]VMRoute
+	}{
+		{
+			name: "disjoint clusters",
+			next: map[string][]VMRoute{
+				"a": {{Subnet: "10.1.0.0/16"}},
+				"b": {{Subnet: "10.2.0.0/16"}},
+			},
+			want: map[string][]VMRoute{
+				"a": {{Subnet: "10.1.0.0/16"}},
+				"b": {{Subnet: "10.2.0.0/16"}},
+			},
+		},
+		{
+			name: "same default ranges go to the first by name",
+			next: map[string][]VMRoute{
+				"kind-b": {{Subnet: "10.96.0.0/12"}, {Subnet: "10.244.0.0/16"}},
+				"kind-a": {{Subnet: "10.96.0.0/12"}, {Subnet: "10.244.0.0/16"}},
+			},
+			want: map[string][]VMRoute{
+				"kind-a": {{Subnet: "10.96.0.0/12"}, {Subnet: "10.244.0.0/16"}},
+				"kind-b": nil,
+			},
+		},
+		{
+			name: "routed cluster keeps its ranges",
+			routed: map[string][]VMRoute{
+				"kubernetes/kind-b": {{Subnet: "10.96.0.0/12"}},
+			},
+			next: map[string][]VMRoute{
+				"kind-a": {{Subnet: "10.96.0.0/12"}, {Subnet: "10.244.0.0/16"}},
+				"kind-b": {{Subnet: "10.96.0.0/12"}},
+			},
+			want: map[string][]VMRoute{
+				"kind-a": {{Subnet: "10.244.0.0/16"}},
+				"kind-b": {{Subnet: "10.96.0.0/12"}},
+			},
+		},
+		{
+			name: "other sources come first",
+			routed: map[string][]VMRoute{
+				"static/extra": {{Subnet: "10.96.0.0/16"}},
+			},
+			next: map[string][]VMRoute{
+				"kind-a": {{Subnet: "10.96.0.0/12"}, {Subnet: "10.244.0.0/16"}},
+			},
+			want: map[string][]VMRoute{
+				"kind-a": {{Subnet: "10.244.0.0/16"}},
+			},
+		},
+		{
+			name: "overlaps within an entry are kept",
+			next: map[string][]VMRoute{
+				"a": {{Subnet: "10.96.0.0/12"}, {Subnet: "10.96.1.0/24"}},
+				"b": {{Subnet: "10.96.1.0/24"}},
+			},
+			want: map[string][]VMRoute{
+				"a": {{Subnet: "10.96.0.0/12"}, {Subnet: "10.96.1.0/24"}},
+				"b": nil,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &Wireguard{log: logger, sourceRoutes: test.routed}
+
+			result := w.claimRanges(kubernetesSource, test.next)
+			if !reflect.DeepEqual(result, test.want) {
+				t.Errorf("claimRanges = %v, want %v", result, test.want)
+			}
+		})
+	}
+}
+
+func TestFilterRanges(t *testing.T) {
+	w := &Wireguard{log: logger}
+	host := parseCIDRs(t, "192.168.1.0/24", "10.0.100.1/32")
+	networks := parseCIDRs(t, "172.18.0.0/16", "10.200.0.0/24")
+
+	next := map[string][]VMRoute{
+		"kind-a": {
+			{Subnet: "10.244.0.0/24", Via: "172.18.0.2"},
+			{Subnet: "10.96.0.0/12", Via: "172.18.0.2"},
+			{Subnet: "172.18.255.200/32", Via: "172.18.0.2"},
+			{Subnet: "10.200.0.0/16", Via: "172.18.0.2"},
+		},
+		"docker-desktop": {
+			{Subnet: "192.168.0.0/16", Via: "192.168.65.3"},
+			{Subnet: "10.0.100.0/24", Via: "192.168.65.3"},
+			{Subnet: "10.1.0.0/16", Via: "192.168.65.3"},
+		},
+	}
+	want := map[string][]VMRoute{
+		"kind-a": {
+			{Subnet: "10.244.0.0/24", Via: "172.18.0.2"},
+			{Subnet: "10.96.0.0/12", Via: "172.18.0.2"},
+		},
+		"docker-desktop": {
+			{Subnet: "10.1.0.0/16", Via: "192.168.65.3"},
+		},
+	}
+
+	result := w.filterRanges(kubernetesSource, next, host, networks)
+	if !reflect.DeepEqual(result, want) {
+		t.Errorf("filterRanges = %v, want %v", result, want)
+	}
+}
+
+func TestParseExtraRoute(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    VMRoute
+		wantErr bool
+	}{
+		{value: "10.20.0.0/16", want: VMRoute{Subnet: "10.20.0.0/16"}},
+		{value: "10.20.1.5/16", want: VMRoute{Subnet: "10.20.0.0/16"}},
+		{value: "10.20.0.0/16 via 172.17.0.5", want: VMRoute{Subnet: "10.20.0.0/16", Via: "172.17.0.5"}},
+		{value: "  10.20.0.0/16   via   172.17.0.5 ", want: VMRoute{Subnet: "10.20.0.0/16", Via: "172.17.0.5"}},
+		{value: "10.20.0.5/32", want: VMRoute{Subnet: "10.20.0.5/32"}},
+		{value: "0.0.0.0/0", wantErr: true},
+		{value: "10.0.0.0/0", wantErr: true},
+		{value: "10.20.0.0", wantErr: true},
+		{value: "fd00::/64", wantErr: true},
+		{value: "10.20.0.0/16 via", wantErr: true},
+		{value: "10.20.0.0/16 through 172.17.0.5", wantErr: true},
+		{value: "10.20.0.0/16 via fd00::1", wantErr: true},
+		{value: "10.20.0.0/16 via gateway", wantErr: true},
+		{value: "", wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.value, func(t *testing.T) {
+			route, err := parseExtraRoute(test.value)
+			if test.wantErr {
+				if err == nil {
+					t.Errorf("parseExtraRoute(%q) = %v, want an error", test.value, route)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("parseExtraRoute(%q) failed: %v", test.value, err)
+			}
+			if route != test.want {
+				t.Errorf("parseExtraRoute(%q) = %v, want %v", test.value, route, test.want)
+			}
+		})
+	}
+}
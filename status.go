@@ -0,0 +1,167 @@
+package main
+
+import (
+	"fmt"
+	"golang.org/x/sys/windows/svc"
+	"net"
+	"strings"
+	"time"
+)
+
+var stateNames = map[svc.State]string{
+	svc.Stopped:         "stopped",
+	svc.StartPending:    "start pending",
+	svc.StopPending:     "stop pending",
+	svc.Running:         "running",
+	svc.ContinuePending: "continue pending",
+	svc.PausePending:    "pause pending",
+	svc.Paused:          "paused",
+}
+
+func printStatus(name string, manager *Manager) error {
+	state, err := manager.QueryService()
+	if err != nil {
+		fmt.Printf("Service:        not installed (%v)\n", err)
+	} else {
+		fmt.Printf("Service:        %s\n", stateNames[state])
+	}
+
+	statuses, err := NewControlClient(name).Status()
+	if err != nil {
+		// the service isn't running, report what the config and the system say
+		statuses, err = getOfflineStatus(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, status := range statuses {
+		fmt.Println()
+		printProfileStatus(status)
+	}
+
+	return nil
+}
+
+func getOfflineStatus(name string) ([]ProfileStatus, error) {
+	config, err := loadConfig(name)
+	if err != nil {
+		return nil, err
+	}
+
+	allocations, err := LoadAllocations(getAllocationsPath(name))
+	if err != nil {
+		return nil, err
+	}
+
+	var statuses []ProfileStatus
+	for _, profile := range config.GetProfiles() {
+		status := ProfileStatus{
+			Name:          profile.Name,
+			DockerHost:    profile.DockerHost,
+			InterfaceName: profile.InterfaceName,
+			HostPeerIp:    profile.HostPeerIp,
+			VmPeerIp:      profile.VmPeerIp,
+			Port:          profile.Port,
+			State:         "tunnel down",
+			HostServices:  profile.HostServices,
+		}
+
+		allocation := allocations.Profiles[profile.Name]
+		if status.HostPeerIp == "" {
+			status.HostPeerIp = allocation.HostPeerIp
+			status.VmPeerIp = allocation.VmPeerIp
+		}
+		if status.Port == 0 {
+			status.Port = allocation.Port
+		}
+
+		if _, err := net.InterfaceByName(profile.InterfaceName); err == nil {
+			status.State = "tunnel up"
+		}
+
+		statuses = append(statuses, status)
+	}
+
+	return statuses, nil
+}
+
+func printProfileStatus(status ProfileStatus) {
+	dockerHost := status.DockerHost
+	if dockerHost == "" {
+		dockerHost = "default"
+	}
+
+	fmt.Printf("Profile:        %s\n", status.Name)
+	fmt.Printf("State:          %s\n", status.State)
+	if status.LastError != "" {
+		fmt.Printf("  last error    %s\n", status.LastError)
+	}
+	fmt.Printf("Docker host:    %s\n", dockerHost)
+	fmt.Printf("Interface:      %s\n", status.InterfaceName)
+
+	if status.HostPeerIp == "" || status.Port == 0 {
+		fmt.Println("Addresses:      not allocated yet")
+		return
+	}
+
+	fmt.Printf("Host peer IP:   %s\n", status.HostPeerIp)
+	fmt.Printf("VM peer IP:     %s\n", status.VmPeerIp)
+	fmt.Printf("Networks:       %d\n", status.Networks)
+	if len(status.AddressPools) > 0 {
+		fmt.Printf("Address pools:  %s\n", strings.Join(status.AddressPools, ", "))
+	}
+	for _, failure := range status.RouteFailures {
+		fmt.Printf("  WARNING: failed to %s routes of %s after %d attempts at %s: %s\n", failure.Operation, failure.Network, failure.Attempts, failure.Time.Format(time.RFC3339), failure.Error)
+	}
+	fmt.Printf("Listen port:    %d\n", status.Port)
+
+	rules, err := newListenerFirewall(status.InterfaceName).Rules()
+	if err != nil {
+		fmt.Printf("  WARNING: could not read listener firewall rules: %v\n", err)
+	} else if len(rules) < listenerRuleCount {
+		fmt.Printf("  WARNING: listener firewall rules are missing, UDP port %d is reachable from every network\n", status.Port)
+	} else {
+		fmt.Println("                restricted to the Docker VM")
+	}
+
+	if status.HostServices == nil {
+		fmt.Println("Host services:  disabled")
+		return
+	}
+
+	hostname := status.HostServices.GetHostname()
+	fmt.Printf("Host services:  %s -> %s\n", hostname, status.HostPeerIp)
+	fmt.Printf("                the name is only in the VM's hosts file, containers need --add-host %s:%s\n", hostname, status.HostPeerIp)
+	for _, port := range status.HostServices.Ports {
+		fmt.Printf("  allowed port  %s\n", port)
+	}
+
+	rules, err = newHostServicesFirewall(status.InterfaceName).Rules()
+	if err != nil {
+		fmt.Printf("  WARNING: could not read firewall rules: %v\n", err)
+		return
+	}
+	if len(rules) != len(status.HostServices.Ports) {
+		fmt.Printf("  WARNING: %d of %d firewall rules are in place, the service applies them while running\n", len(rules), len(status.HostServices.Ports))
+	}
+}
+
+func printNetworks(name, profile string) error {
+	networks, err := NewControlClient(name).Networks(profile)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("%-10s %-12s %-30s %-10s %s\n", "PROFILE", "ID", "NAME", "DRIVER", "SUBNETS")
+	for _, network := range networks {
+		id := network.ID
+		// ranges of other sources have readable IDs like kubernetes/kind-kind
+		if len(id) > 12 && !strings.Contains(id, "/") {
+			id = id[:12]
+		}
+		fmt.Printf("%-10s %-12s %-30s %-10s %s\n", network.Profile, id, network.Name, network.Driver, strings.Join(network.Subnets, ", "))
+	}
+
+	return nil
+}
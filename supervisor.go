@@ -0,0 +1,302 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// stopTimeout bounds the wait for the runners, a runner stuck in a Docker or
+// route command must not keep the tunnels up.
+const stopTimeout = 20 * time.Second
+
+// Supervisor runs one ProfileRunner per configured profile and restarts them
+// all when the config is reloaded.
+type Supervisor struct {
+	name string
+
+	mu sync.Mutex
+	// config is the config the runners were started with, Reload falls back
+	// to it when the new one fails to start
+	config *Config
+	cancel context.CancelFunc
+	// clientCancel ends the context of the Docker clients
+	clientCancel context.CancelFunc
+	wg           sync.WaitGroup
+	runners      []*ProfileRunner
+	metrics      *MetricsServer
+	keepKeys     bool
+	paused       bool
+}
+
+func NewSupervisor(name string) *Supervisor {
+	return &Supervisor{name: name}
+}
+
+func (s *Supervisor) Start() error {
+	config, err := loadConfig(s.name)
+	if err != nil {
+		return err
+	}
+
+	return s.start(config)
+}
+
+func (s *Supervisor) start(config *Config) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	level, _ := ParseLevel(config.Log.Level)
+	logger.SetLevel(level)
+
+	// the allocations and the journal live in the data directory, it is
+	// locked down before they are read
+	dataDir, err := prepareDataDir(s.name)
+	if err != nil {
+		return err
+	}
+
+	allocations, err := LoadAllocations(getAllocationsPath(s.name))
+	if err != nil {
+		return err
+	}
+
+	// undo what a crashed run left behind before setting up again
+	journal, err := loadJournal(s.name)
+	if err != nil {
+		return err
+	}
+
+	err = journal.Replay()
+	if err != nil {
+		logger.Warning(EventCleanupFailed, "Failed to clean up after the previous run", "error", err)
+	}
+
+	profiles := config.GetProfiles()
+	allocator, err := NewAllocator(config.PeerPool, allocations, profiles)
+	if err != nil {
+		return err
+	}
+
+	// the Docker clients live until Stop, Pause only cancels the runs
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var runners []*ProfileRunner
+	for _, profile := range profiles {
+		runner, err := NewProfileRunner(ctx, profile, allocator, journal, dataDir)
+		if err != nil {
+			cancel()
+			for _, runner := range runners {
+				runner.Close()
+			}
+			return fmt.Errorf("failed to create profile %s: %w", profile.Name, err)
+		}
+		runners = append(runners, runner)
+	}
+
+	logger.Info(EventProfilesStarting, "Starting profiles", "profiles", len(runners))
+
+	s.runners = runners
+	s.config = config
+	s.keepKeys = config.KeepKeysOnPause
+	s.paused = false
+	s.clientCancel = cancel
+	s.run()
+
+	if config.MetricsListen != "" {
+		s.metrics = NewMetricsServer(config.MetricsListen, s)
+		go s.metrics.Serve()
+	}
+
+	return nil
+}
+
+// run starts a Run of every runner, cancelled by Pause and Stop.
+func (s *Supervisor) run() {
+	ctx, cancel := context.WithCancel(context.Background())
+	for _, runner := range s.runners {
+		s.wg.Add(1)
+		go func(runner *ProfileRunner) {
+			defer s.wg.Done()
+			runner.Run(ctx)
+		}(runner)
+	}
+
+	s.cancel = cancel
+}
+
+// Pause cancels the runners and brings their tunnels down, Continue sets them
+// up again from the current Docker state.
+func (s *Supervisor) Pause() error {
+	s.mu.Lock()
+	if s.cancel == nil || s.paused {
+		s.mu.Unlock()
+		return nil
+	}
+
+	// paused is set first so Reload is refused while the tunnels come down,
+	// Status and the control requests are served meanwhile
+	s.cancel()
+	s.paused = true
+	runners, keepKeys := s.runners, s.keepKeys
+	s.mu.Unlock()
+
+	s.wait()
+
+	var errs []error
+	for _, runner := range runners {
+		err := runner.Pause(keepKeys)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("profile %s: %w", runner.profile.Name, err))
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+func (s *Supervisor) Continue() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.paused {
+		return
+	}
+
+	s.paused = false
+	s.run()
+}
+
+// wait waits for the runners to return, at most stopTimeout.
+func (s *Supervisor) wait() {
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(stopTimeout):
+		logger.Warning(EventStopTimeout, "Profiles did not stop in time, tearing down anyway", "timeout", stopTimeout)
+	}
+}
+
+// Stop cancels the runners, waits for them to return and tears their tunnels
+// down one after the other. progress, when set, is called before every step
+// so the caller can report it.
+func (s *Supervisor) Stop(progress func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.clientCancel == nil {
+		return
+	}
+
+	if s.metrics != nil {
+		_ = s.metrics.Close()
+		s.metrics = nil
+	}
+
+	step := func() {
+		if progress != nil {
+			progress()
+		}
+	}
+
+	step()
+	s.cancel()
+	s.wait()
+
+	for _, runner := range s.runners {
+		step()
+		runner.Close()
+	}
+	s.clientCancel()
+
+	s.cancel = nil
+	s.clientCancel = nil
+	s.runners = nil
+}
+
+func (s *Supervisor) Reload() error {
+	if s.isPaused() {
+		return errors.New("service is paused")
+	}
+
+	logger.Info(EventConfigReloading, "Reloading config")
+
+	// an invalid config keeps the running profiles
+	config, err := loadConfig(s.name)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	previous := s.config
+	s.mu.Unlock()
+
+	s.Stop(nil)
+
+	err = s.start(config)
+	if err == nil || previous == nil {
+		return err
+	}
+
+	// a config that passed validation can still fail to start, like with a
+	// peer pool that is used up, the previous one keeps the tunnels up
+	logger.Error(EventReloadFailed, "Failed to start the reloaded config, starting the previous one", "error", err)
+	restartErr := s.start(previous)
+	if restartErr != nil {
+		return fmt.Errorf("failed to start the reloaded config: %w, the previous config failed as well: %v", err, restartErr)
+	}
+
+	return fmt.Errorf("failed to start the reloaded config, the previous one is running again: %w", err)
+}
+
+func (s *Supervisor) isPaused() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.paused
+}
+
+func (s *Supervisor) Status() []ProfileStatus {
+	var statuses []ProfileStatus
+	for _, runner := range s.getRunners() {
+		statuses = append(statuses, runner.Status())
+	}
+
+	return statuses
+}
+
+func (s *Supervisor) getRunners() []*ProfileRunner {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]*ProfileRunner(nil), s.runners...)
+}
+
+// forEach runs f for the named profile, or for every profile when name is
+// empty.
+func (s *Supervisor) forEach(name string, f func(runner *ProfileRunner) error) error {
+	found := false
+	for _, runner := range s.getRunners() {
+		if name != "" && runner.profile.Name != name {
+			continue
+		}
+		found = true
+
+		err := f(runner)
+		if err != nil {
+			return fmt.Errorf("profile %s: %w", runner.profile.Name, err)
+		}
+	}
+
+	if !found {
+		return errors.New("unknown profile " + name)
+	}
+
+	return nil
+}
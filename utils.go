@@ -7,19 +7,50 @@ import (
 	"strings"
 )
 
+// execCommand creates the commands run by Utils, tests replace it.
+var execCommand = exec.Command
+
 type Utils struct {
 }
 
 func (u *Utils) runCommand(command string, args ...string) error {
-	cmd := exec.Command(command, args...)
+	_, err := u.runCommandOutput(command, args...)
+
+	return err
+}
+
+func (u *Utils) runCommandOutput(command string, args ...string) (string, error) {
+	cmd := execCommand(command, args...)
 
 	stdoutStderr, err := cmd.CombinedOutput()
 	if err != nil {
 		commandWithArgs := []string{command}
 		commandWithArgs = append(commandWithArgs, args...)
 
-		return errors.New(fmt.Sprintf("error running command: %v, err: %v, output: %v", strings.Join(commandWithArgs, " "), err, string(stdoutStderr)))
+		return "", errors.New(fmt.Sprintf("error running command: %v, err: %v, output: %v", strings.Join(commandWithArgs, " "), err, string(stdoutStderr)))
+	}
+
+	return string(stdoutStderr), nil
+}
+
+func (u *Utils) runPowerShell(script string) (string, error) {
+	return u.runCommandOutput("powershell", "-NoProfile", "-NonInteractive", "-Command", script)
+}
+
+// getRoutes lists the IPv4 routes as interface alias and destination prefix.
+func (u *Utils) getRoutes() ([][2]string, error) {
+	output, err := u.runPowerShell("Get-NetRoute -AddressFamily IPv4 | ForEach-Object { $_.InterfaceAlias + '|' + $_.DestinationPrefix }")
+	if err != nil {
+		return nil, err
+	}
+
+	var routes [][2]string
+	for _, line := range strings.Split(output, "\n") {
+		alias, prefix, found := strings.Cut(strings.TrimSpace(line), "|")
+		if found {
+			routes = append(routes, [2]string{alias, prefix})
+		}
 	}
 
-	return nil
+	return routes, nil
 }
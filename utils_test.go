@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeCommands records the commands run through Utils instead of running them.
+// A command fails when fail returns true for it.
+type fakeCommands struct {
+	mu       sync.Mutex
+	commands []string
+	fail     func(command string) bool
+}
+
+func newFakeCommands(t *testing.T, fail func(command string) bool) *fakeCommands {
+	fake := &fakeCommands{fail: fail}
+
+	previous := execCommand
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		command := strings.Join(append([]string{name}, args...), " ")
+
+		fake.mu.Lock()
+		fake.commands = append(fake.commands, command)
+		failed := fake.fail != nil && fake.fail(command)
+		fake.mu.Unlock()
+
+		cmd := exec.Command(os.Args[0], "-test.run=TestHelperProcess")
+		cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1", fmt.Sprintf("HELPER_FAIL=%t", failed))
+		return cmd
+	}
+	t.Cleanup(func() {
+		execCommand = previous
+	})
+
+	return fake
+}
+
+func (f *fakeCommands) Commands() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return append([]string(nil), f.commands...)
+}
+
+// TestHelperProcess is the process the fake commands run.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+
+	if os.Getenv("HELPER_FAIL") == "true" {
+		fmt.Print("The operation failed")
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
+func TestRunCommandOutput(t *testing.T) {
+	newFakeCommands(t, func(command string) bool {
+		return strings.HasPrefix(command, "route DELETE")
+	})
+	u := &Utils{}
+
+	_, err := u.runCommandOutput("route", "ADD", "172.17.0.0")
+	if err != nil {
+		t.Errorf("runCommandOutput failed: %v", err)
+	}
+
+	_, err = u.runCommandOutput("route", "DELETE", "172.17.0.0")
+	if err == nil {
+		t.Fatal("runCommandOutput succeeded for a failing command")
+	}
+	if !strings.Contains(err.Error(), "route DELETE 172.17.0.0") || !strings.Contains(err.Error(), "The operation failed") {
+		t.Errorf("error = %q, want the command and its output", err)
+	}
+}
@@ -2,15 +2,12 @@ package main
 
 import (
 	"context"
-	"embed"
 	"errors"
 	"fmt"
 	"github.com/docker/docker/api/types"
-	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
 	"github.com/docker/docker/api/types/filters"
 	"golang.zx2c4.com/wireguard/wgctrl/wgtypes"
-	"io"
-	"log"
 	"net"
 	"os"
 	"path/filepath"
@@ -31,44 +28,96 @@ AllowedIPs = %s
 PersistentKeepalive = 25
 `
 
+// helperVersion is the version of the client/ helper the service expects, the
+// tag and the helperVersionLabel of the setup image. It has to match
+// helperVersion in client/version.go.
+const helperVersion = "2"
+
 type Version struct {
 	SetupImage string
 }
 
 var version = Version{
-	SetupImage: "wpkpda/docker-win-net-setup",
+	SetupImage: "wpkpda/docker-win-net-setup:" + helperVersion,
 }
 
 type Wireguard struct {
-	docker            *Docker
-	interfaceName     string
-	interfaceIndex    int
-	hostPeerIp        string
-	vmPeerIp          string
-	hostPrivateKey    *wgtypes.Key
-	vmPrivateKey      *wgtypes.Key
-	vmIpNet           *net.IPNet
-	port              int
+	log              *Logger
+	name             string
+	docker           *Docker
+	interfaceName    string
+	interfaceIndex   int
+	hostPeerIp       string
+	vmPeerIp         string
+	hostPrivateKey   *wgtypes.Key
+	vmPrivateKey     *wgtypes.Key
+	vmIpNet          *net.IPNet
+	port             int
+	preserveSourceIp bool
+	policy           *AccessPolicy
+	hostServices     *HostServices
+	firewall         *Firewall
+	listenerSources  []string
+	listenerFirewall *Firewall
+	// listenerRanges are the VM source ranges the listener rules were last
+	// applied for
+	listenerRanges    string
+	routeAddressPools bool
+	addressPools      []string
+	kubernetes        *KubernetesSource
+	extraRoutes       []VMRoute
+	// sourceRoutes are the ranges routed besides the Docker networks, keyed
+	// by network ID, see sources.go
+	sourceRoutes      map[string][]VMRoute
 	networkManager    *NetworkManager
-	exePath           string
+	dataDir           string
 	binDirWg          string
 	exBinDirWg        string
 	binDirWireguard   string
 	exBinDirWireguard string
+	requests          chan func()
+	reprovision       chan struct{}
+	// routesDone is signalled when the queued route operations of a network
+	// have run, the event loop then updates the peer's AllowedIPs
+	routesDone chan struct{}
+	journal    *Journal
+	// eventsSince is the time of the last processed Docker event, the stream
+	// resumes from it. eventsLost is when the stream went down and seenEvents
+	// holds the events processed at or after eventsSince.
+	eventsSince time.Time
+	eventsLost  time.Time
+	seenEvents  map[string]int64
 	Utils
 }
 
+// eventsMaxGap is how long the Docker events stream may be down before it is
+// no longer resumed. The engine only keeps its most recent events, so the
+// networks are resynced instead.
+const eventsMaxGap = 5 * time.Minute
+
 type WireguardOptions struct {
+	Name          string
 	InterfaceName string
 	HostPeerIp    string
 	VmPeerIp      string
 	Port          int
-}
 
-//go:embed bin/wg.exe bin/wireguard.exe
-var binaries embed.FS
+	PreserveSourceIp bool
+	Policy           *AccessPolicy
+	HostServices     *HostServices
+	ListenerSources  []string
 
-func NewWireguard(docker *Docker, opts *WireguardOptions) (*Wireguard, error) {
+	RouteAddressPools bool
+	AddressPools      []string
+	Kubernetes        *KubernetesSource
+	ExtraRoutes       []VMRoute
+
+	// DataDir is the locked down directory for the binaries and the tunnel
+	// config.
+	DataDir string
+}
+
+func NewWireguard(docker *Docker, opts *WireguardOptions, journal *Journal) (*Wireguard, error) {
 	hostPrivateKey, err := wgtypes.GeneratePrivateKey()
 	if err != nil {
 		return nil, errors.New("failed to generate host private key: " + err.Error())
@@ -84,44 +133,73 @@ func NewWireguard(docker *Docker, opts *WireguardOptions) (*Wireguard, error) {
 		return nil, errors.New("failed to parse VM peer CIDR: " + err.Error())
 	}
 
-	// get the directory where the executable is located
-	exe, err := os.Executable()
-	if err != nil {
-		return nil, errors.New("failed to get executable path: " + err.Error())
-	}
-
-	exePath := filepath.Dir(exe)
-
-	return &Wireguard{
-		docker:          docker,
-		interfaceName:   opts.InterfaceName,
-		hostPrivateKey:  &hostPrivateKey,
-		vmPrivateKey:    &vmPrivateKey,
-		hostPeerIp:      opts.HostPeerIp,
-		vmPeerIp:        opts.VmPeerIp,
-		vmIpNet:         vmIpNet,
-		port:            opts.Port,
-		networkManager:  NewNetworkManager(opts.InterfaceName),
-		exePath:         exePath,
-		binDirWg:        "bin/wg.exe",
-		binDirWireguard: "bin/wireguard.exe",
-	}, nil
+	w := &Wireguard{
+		log:               logger.With("profile", opts.Name),
+		name:              opts.Name,
+		docker:            docker,
+		interfaceName:     opts.InterfaceName,
+		hostPrivateKey:    &hostPrivateKey,
+		vmPrivateKey:      &vmPrivateKey,
+		hostPeerIp:        opts.HostPeerIp,
+		vmPeerIp:          opts.VmPeerIp,
+		vmIpNet:           vmIpNet,
+		port:              opts.Port,
+		preserveSourceIp:  opts.PreserveSourceIp,
+		policy:            opts.Policy,
+		hostServices:      opts.HostServices,
+		firewall:          newHostServicesFirewall(opts.InterfaceName),
+		listenerSources:   opts.ListenerSources,
+		listenerFirewall:  newListenerFirewall(opts.InterfaceName),
+		routeAddressPools: opts.RouteAddressPools,
+		addressPools:      opts.AddressPools,
+		kubernetes:        opts.Kubernetes,
+		extraRoutes:       opts.ExtraRoutes,
+		networkManager:    NewNetworkManager(opts.Name, opts.InterfaceName, journal),
+		dataDir:           opts.DataDir,
+		binDirWg:          "bin/wg.exe",
+		binDirWireguard:   "bin/wireguard.exe",
+		requests:          make(chan func()),
+		reprovision:       make(chan struct{}, 1),
+		routesDone:        make(chan struct{}, 1),
+		journal:           journal,
+		seenEvents:        make(map[string]int64),
+	}
+	w.networkManager.SetOnDone(w.signalRoutesDone)
+
+	return w, nil
 }
 
 func (w *Wireguard) Setup() error {
-	_ = elog.Info(36, "Extracting binaries")
+	w.log.Info(EventExtractingBinaries, "Extracting binaries")
 	err := w.extractBinaries()
 	if err != nil {
 		return errors.New("failed to extract binaries: " + err.Error())
 	}
 
-	_ = elog.Info(37, "Downloading setup image")
+	w.log.Info(EventDownloadingImage, "Downloading setup image")
 	err = w.downloadSetup()
 	if err != nil {
 		return errors.New("failed to download setup: " + err.Error())
 	}
 
-	_ = elog.Info(38, "Installing tunnel")
+	pools, err := w.resolveAddressPools()
+	if err != nil {
+		return errors.New("failed to resolve address pools: " + err.Error())
+	}
+	w.networkManager.SetPools(pools)
+	err = w.setStaticRoutes()
+	if err != nil {
+		return errors.New("failed to set extra routes: " + err.Error())
+	}
+
+	w.log.Info(EventRestrictingListener, "Restricting WireGuard listener to the Docker VM")
+	err = w.lockDownListener()
+	if err != nil {
+		// the tunnel still works, status reports the missing rules
+		w.log.Warning(EventListenerRestrictFailed, "Failed to restrict WireGuard listener, the port is reachable from every network", "port", w.port, "error", err)
+	}
+
+	w.log.Info(EventInstallingTunnel, "Installing tunnel")
 	err = w.installTunnel(true)
 	if err != nil {
 		return errors.New("failed to install tunnel: " + err.Error())
@@ -129,18 +207,39 @@ func (w *Wireguard) Setup() error {
 
 	time.Sleep(1 * time.Second)
 
-	_ = elog.Info(39, "Updating interface")
+	w.log.Info(EventUpdatingInterface, "Updating interface")
 	err = w.networkManager.UpdateInterface(w.hostPeerIp, w.vmPeerIp)
 	if err != nil {
 		return errors.New("failed to update interface: " + err.Error())
 	}
 
-	_ = elog.Info(41, "Deleting wireguard route")
+	err = w.removeTunnelConf()
+	if err != nil {
+		return err
+	}
+
+	w.log.Info(EventDeletingDefaultRoute, "Deleting wireguard route")
 	err = w.networkManager.DeleteRoute("0.0.0.0")
 	if err != nil {
 		return errors.New("failed to delete wireguard route: " + err.Error())
 	}
 
+	if len(pools) > 0 {
+		w.log.Info(EventRoutingAddressPools, "Routing Docker address pools", "pools", len(pools))
+		err = w.networkManager.AddPoolRoutes()
+		if err != nil {
+			return errors.New("failed to route address pools: " + err.Error())
+		}
+	}
+
+	w.addStaticRoutes()
+
+	w.log.Info(EventUpdatingHostServices, "Updating host service firewall rules")
+	err = w.applyHostServices()
+	if err != nil {
+		return errors.New("failed to update host service firewall rules: " + err.Error())
+	}
+
 	return nil
 }
 
@@ -150,65 +249,146 @@ func (w *Wireguard) Teardown() error {
 		return errors.New("failed to uninstall tunnel: " + err.Error())
 	}
 
+	err = w.firewall.Clear()
+	if err != nil {
+		return errors.New("failed to remove host service firewall rules: " + err.Error())
+	}
+	w.journal.RemoveFirewallGroup(w.name, w.firewall.group)
+
 	return nil
 }
 
-func (w *Wireguard) extractBinaries() error {
-	files := 0
+// Suspend withdraws the routes of the tracked networks and brings the tunnel
+// down, Setup brings it back with the same keys.
+func (w *Wireguard) Suspend() error {
+	w.withdrawRoutes()
 
-	w.exBinDirWg = filepath.Join(w.exePath, w.binDirWg)
-	w.exBinDirWireguard = filepath.Join(w.exePath, w.binDirWireguard)
+	return w.Teardown()
+}
 
-	_, err := os.Stat(w.exBinDirWg)
-	if err == nil {
-		files++
+// withdrawRoutes deletes the routes of every tracked network once the queued
+// operations are done. Failures are only logged, the routes go away with the
+// interface anyway.
+func (w *Wireguard) withdrawRoutes() {
+	w.networkManager.Stop()
+	for _, network := range w.networkManager.Networks() {
+		err := w.networkManager.RemoveNetwork(network.ID)
+		if err != nil {
+			w.log.Warning(EventRouteDeleteFailed, "Failed to delete network routes", "network", network.Name, "error", err)
+		}
+	}
+	err := w.networkManager.RemovePoolRoutes()
+	if err != nil {
+		w.log.Warning(EventRouteDeleteFailed, "Failed to delete address pool routes", "error", err)
 	}
+	// the sources are looked up again once the tunnel is back
+	w.sourceRoutes = nil
+	w.networkManager.Reset()
+}
 
-	_, err = os.Stat(w.exBinDirWireguard)
-	if err == nil {
-		files++
+func (w *Wireguard) applyHostServices() error {
+	err := w.firewall.Clear()
+	if err != nil {
+		return err
 	}
 
-	if files == 2 {
+	if w.hostServices == nil {
+		w.journal.RemoveFirewallGroup(w.name, w.firewall.group)
 		return nil
 	}
 
-	err = os.MkdirAll(filepath.Dir(w.exBinDirWg), 0755)
-	if err != nil {
-		return errors.New("failed to create bin directory: " + err.Error())
+	w.journal.AddFirewallGroup(w.name, w.firewall.group)
+	for _, rule := range w.hostServices.firewallRules(w.interfaceName) {
+		err = w.firewall.AddRule(rule)
+		if err != nil {
+			return err
+		}
 	}
 
-	wg, err := binaries.ReadFile(w.binDirWg)
+	return nil
+}
+
+func (w *Wireguard) extractBinaries() error {
+	w.exBinDirWg = filepath.Join(w.dataDir, w.binDirWg)
+	w.exBinDirWireguard = filepath.Join(w.dataDir, w.binDirWireguard)
+
+	err := ensureBinary(w.exBinDirWg, "wg.exe")
 	if err != nil {
-		return errors.New("failed to open wg.exe: " + err.Error())
+		return err
 	}
 
-	err = os.WriteFile(w.exBinDirWg, wg, 0755)
+	return ensureBinary(w.exBinDirWireguard, "wireguard.exe")
+}
+
+// runWg runs wg.exe after checking it against the embedded copy.
+func (w *Wireguard) runWg(args ...string) (string, error) {
+	err := ensureBinary(w.exBinDirWg, "wg.exe")
 	if err != nil {
-		return errors.New("failed to write wg.exe: " + err.Error())
+		return "", err
 	}
 
-	wireguard, err := binaries.ReadFile(w.binDirWireguard)
+	return w.runCommandOutput(w.exBinDirWg, args...)
+}
+
+// runWireguard runs wireguard.exe after checking it against the embedded copy.
+func (w *Wireguard) runWireguard(args ...string) error {
+	err := ensureBinary(w.exBinDirWireguard, "wireguard.exe")
 	if err != nil {
-		return errors.New("failed to open wireguard.exe: " + err.Error())
+		return err
 	}
 
-	err = os.WriteFile(w.exBinDirWireguard, wireguard, 0755)
+	return w.runCommand(w.exBinDirWireguard, args...)
+}
+
+// getAllowedIPs returns the routed address pools, the Docker subnets and the
+// ranges of other sources outside them and the VM peer address.
+func (w *Wireguard) getAllowedIPs() ([]string, error) {
+	subnets, err := w.docker.GetSubnets()
 	if err != nil {
-		return errors.New("failed to write wireguard.exe: " + err.Error())
+		return nil, errors.New("failed to get docker subnets: " + err.Error())
 	}
 
-	return nil
+	pools := w.networkManager.Pools()
+
+	var allowedIPs []string
+	for _, pool := range pools {
+		allowedIPs = append(allowedIPs, pool.String())
+	}
+	for _, subnet := range subnets {
+		_, ipNet, err := net.ParseCIDR(subnet)
+		if err == nil && coveredBy(ipNet, pools) {
+			continue
+		}
+		allowedIPs = append(allowedIPs, subnet)
+	}
+	allowedIPs = append(allowedIPs, w.sourceSubnets()...)
+
+	return append(allowedIPs, w.vmIpNet.String()), nil
 }
 
 func (w *Wireguard) getDockerNetworks() (string, error) {
-	subnets, err := w.docker.GetSubnets()
+	allowedIPs, err := w.getAllowedIPs()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join(allowedIPs, ", "), nil
+}
+
+// updateAllowedIPs sets the peer's AllowedIPs of the running tunnel to the
+// current Docker subnets.
+func (w *Wireguard) updateAllowedIPs() error {
+	allowedIPs, err := w.getAllowedIPs()
 	if err != nil {
-		return "", errors.New("failed to get docker subnets: " + err.Error())
+		return err
 	}
-	subnets = append(subnets, w.vmIpNet.String())
 
-	return strings.Join(subnets, ", "), nil
+	_, err = w.runWg("set", w.interfaceName, "peer", w.vmPrivateKey.PublicKey().String(), "allowed-ips", strings.Join(allowedIPs, ","))
+	if err != nil {
+		return errors.New("failed to update allowed IPs: " + err.Error())
+	}
+
+	return nil
 }
 
 func (w *Wireguard) getTunnelConf() (string, error) {
@@ -226,9 +406,10 @@ func (w *Wireguard) getTunnelPath() (string, error) {
 		return "", errors.New("failed to get tunnel config: " + err.Error())
 	}
 
-	tunnelPath := filepath.Join(w.exePath, fmt.Sprintf("%s.conf", w.interfaceName))
+	tunnelPath := w.getTunnelConfPath()
 
-	err = os.WriteFile(tunnelPath, []byte(tunnelConf), 0644)
+	// the config holds the host private key
+	err = os.WriteFile(tunnelPath, []byte(tunnelConf), 0600)
 	if err != nil {
 		return "", errors.New("failed to write tunnel config: " + err.Error())
 	}
@@ -242,7 +423,10 @@ func (w *Wireguard) installTunnel(first bool) error {
 		return errors.New("failed to get tunnel path: " + err.Error())
 	}
 
-	err = w.runCommand(w.exBinDirWireguard, "/installtunnelservice", tunnelPath)
+	// recorded first, a crash during the install may leave the service behind
+	w.journal.AddTunnel(w.name, w.interfaceName, w.exBinDirWireguard, tunnelPath)
+
+	err = w.runWireguard("/installtunnelservice", tunnelPath)
 	if err != nil {
 		if first && strings.Contains(err.Error(), "Tunnel already installed and running") {
 			if err := w.uninstallTunnel(); err != nil {
@@ -252,6 +436,8 @@ func (w *Wireguard) installTunnel(first bool) error {
 			if err := w.installTunnel(false); err != nil {
 				return errors.New("tunnel was running, stopped but failed to install tunnel: " + err.Error())
 			}
+
+			return nil
 		}
 		return errors.New("failed to install tunnel: " + err.Error())
 	}
@@ -260,10 +446,27 @@ func (w *Wireguard) installTunnel(first bool) error {
 }
 
 func (w *Wireguard) uninstallTunnel() error {
-	err := w.runCommand(w.exBinDirWireguard, "/uninstalltunnelservice", w.interfaceName)
+	err := w.runWireguard("/uninstalltunnelservice", w.interfaceName)
 	if err != nil {
 		return errors.New("failed to uninstall tunnel: " + err.Error())
 	}
+	w.journal.RemoveTunnel(w.name)
+
+	return w.removeTunnelConf()
+}
+
+func (w *Wireguard) getTunnelConfPath() string {
+	return filepath.Join(w.dataDir, fmt.Sprintf("%s.conf", w.interfaceName))
+}
+
+// removeTunnelConf deletes the tunnel config, the running tunnel service has
+// read it already and the private key shouldn't stay on disk.
+func (w *Wireguard) removeTunnelConf() error {
+	err := os.Remove(w.getTunnelConfPath())
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.New("failed to remove tunnel config: " + err.Error())
+	}
+	w.journal.RemoveConf(w.name)
 
 	return nil
 }
@@ -274,120 +477,547 @@ func (w *Wireguard) downloadSetup() error {
 		return err
 	}
 
-	_, _, err = w.docker.cli.ImageInspectWithRaw(w.docker.ctx, version.SetupImage)
+	current, err := w.docker.SetupImageVersion()
+	if err == nil && current == helperVersion {
+		return nil
+	}
+
 	if err != nil {
-		_ = elog.Info(17, "Setup image doesn't exist locally. Pulling...\n")
+		w.log.Info(EventPullingImage, "Setup image doesn't exist locally, pulling", "image", version.SetupImage)
+	} else {
+		w.log.Info(EventPullingImage, "Setup image is outdated, pulling", "image", version.SetupImage, "version", current, "expected", helperVersion)
+	}
 
-		_, err := w.docker.cli.ImagePull(w.docker.ctx, version.SetupImage, types.ImagePullOptions{})
-		if err != nil {
-			return fmt.Errorf("failed to pull setup image: %w", err)
-		}
+	err = w.docker.PullSetupImage()
+	if err != nil {
+		return fmt.Errorf("failed to pull setup image: %w", err)
+	}
+
+	current, err = w.docker.SetupImageVersion()
+	if err != nil {
+		return fmt.Errorf("failed to inspect setup image: %w", err)
+	}
+	if current != helperVersion {
+		return fmt.Errorf("setup image %s is helper version %q, expected %s", version.SetupImage, current, helperVersion)
 	}
 
 	return nil
 }
 
 func (w *Wireguard) SetupVM() error {
-	err := w.docker.WaitRunning()
+	policy, err := w.policy.Env(w.docker, w.hostServices, w.log)
+	if err != nil {
+		return fmt.Errorf("failed to resolve access policy: %w", err)
+	}
+
+	routes, err := w.getVMRoutes()
 	if err != nil {
 		return err
 	}
 
-	resp, err := w.docker.cli.ContainerCreate(w.docker.ctx, &container.Config{
-		Image: version.SetupImage,
-		Env: []string{
-			"SERVER_PORT=" + strconv.Itoa(w.port),
-			"HOST_PEER_IP=" + w.hostPeerIp,
-			"VM_PEER_IP=" + w.vmPeerIp,
-			"HOST_PUBLIC_KEY=" + w.hostPrivateKey.PublicKey().String(),
-			"VM_PRIVATE_KEY=" + w.vmPrivateKey.String(),
-		},
-	}, &container.HostConfig{
-		AutoRemove:  true,
-		NetworkMode: "host",
-		CapAdd:      []string{"NET_ADMIN"},
-	}, nil, nil, fmt.Sprintf("wireguard-setup-%d", time.Now().Unix()))
+	shims, err := w.getShimNetworks()
+	if err != nil {
+		return fmt.Errorf("failed to list shim networks: %w", err)
+	}
+
+	err = w.runHelper([]string{
+		"SERVER_PORT=" + strconv.Itoa(w.port),
+		"HOST_PEER_IP=" + w.hostPeerIp,
+		"VM_PEER_IP=" + w.vmPeerIp,
+		"HOST_PUBLIC_KEY=" + w.hostPrivateKey.PublicKey().String(),
+		"VM_PRIVATE_KEY=" + w.vmPrivateKey.String(),
+		"PRESERVE_SOURCE_IP=" + strconv.FormatBool(w.preserveSourceIp),
+		"ACCESS_POLICY=" + policy,
+		"HOST_NAME=" + w.hostServices.GetHostname(),
+		"VM_ROUTES=" + routes,
+		"SHIM_NETWORKS=" + shims,
+	})
 	if err != nil {
-		return fmt.Errorf("failed to create container: %w", err)
+		return err
 	}
 
-	err = w.docker.cli.ContainerStart(w.docker.ctx, resp.ID, types.ContainerStartOptions{})
+	w.log.Info(EventSetupVMComplete, "Setup container complete")
+
+	return nil
+}
+
+// applyPolicy re-runs the helper to rebuild the VM forwarding chain, used when
+// a network selected by the policy is created or destroyed.
+func (w *Wireguard) applyPolicy() error {
+	policy, err := w.policy.Env(w.docker, w.hostServices, w.log)
 	if err != nil {
-		return fmt.Errorf("failed to start container: %w", err)
+		return fmt.Errorf("failed to resolve access policy: %w", err)
 	}
 
-	err = func() error {
-		reader, err := w.docker.cli.ContainerLogs(w.docker.ctx, resp.ID, types.ContainerLogsOptions{
-			ShowStdout: true,
-			ShowStderr: true,
-			Follow:     true,
-		})
-		if err != nil {
-			return fmt.Errorf("failed to get logs for container %s: %w", resp.ID, err)
-		}
+	return w.runHelper([]string{
+		"MODE=policy",
+		"ACCESS_POLICY=" + policy,
+	})
+}
 
-		defer func(reader io.ReadCloser) {
-			err := reader.Close()
-			if err != nil {
-				_ = elog.Info(18, fmt.Sprintf("Failed to close reader: %v", err))
-			}
-		}(reader)
+// TeardownVM removes the WireGuard interface, the NAT and policy rules and the
+// hosts entry from the VM. It gives up at once when the engine doesn't answer
+// instead of waiting for it.
+func (w *Wireguard) TeardownVM() error {
+	ctx, cancel := context.WithTimeout(w.docker.ctx, 5*time.Second)
+	_, err := w.docker.cli.Ping(ctx)
+	cancel()
+	if err != nil {
+		return errors.New("docker is not running: " + err.Error())
+	}
 
-		return nil
-	}()
+	return w.startHelper([]string{
+		"MODE=teardown",
+		"HOST_PEER_IP=" + w.hostPeerIp,
+	})
+}
+
+func (w *Wireguard) runHelper(env []string) error {
+	err := w.docker.WaitRunning()
 	if err != nil {
 		return err
 	}
 
-	log.Println("Setup container complete")
+	return w.startHelper(env)
+}
 
-	return nil
+// startHelper runs the helper container with env and waits for it to exit.
+func (w *Wireguard) startHelper(env []string) error {
+	_, err := w.docker.RunHelper(w.log, env, w.hostServices.helperBinds())
+
+	return err
 }
 
 func (w *Wireguard) Start(ctx context.Context) (stop bool) {
-	msgs, errsChan := w.docker.cli.Events(w.docker.ctx, types.EventsOptions{
-		Filters: filters.NewArgs(
-			filters.Arg("type", "network"),
-			filters.Arg("event", "create"),
-			filters.Arg("event", "destroy"),
-		),
-	})
+	msgs, errsChan := w.subscribeEvents()
+	defer func() {
+		if stop {
+			// the tunnel is set up again from the current networks
+			w.resetEvents()
+		} else {
+			w.eventsLost = time.Now()
+		}
+	}()
+
+	// network events are collected into a batch and applied once no further
+	// event came in for eventBatchWindow
+	var kubernetes chan map[string][]VMRoute
+	if w.kubernetes != nil {
+		kubernetes = make(chan map[string][]VMRoute)
+		watchCtx, cancel := context.WithCancel(ctx)
+		defer cancel()
+		go w.watchKubernetes(watchCtx, kubernetes)
+	}
+
+	var batch *networkBatch
+	var batchTimer *time.Timer
+	var batchC <-chan time.Time
+	flush := func() {
+		if batch == nil {
+			return
+		}
+		batchTimer.Stop()
+		w.applyBatch(ctx, batch)
+		batch, batchC = nil, nil
+	}
 
-	for loop := true; loop; {
+	for {
 		select {
 		case err := <-errsChan:
-			_ = elog.Info(19, fmt.Sprintf("Error: %v\n", err))
-			loop = false
+			w.log.Error(EventEventsError, "Docker events stream failed", "error", err)
+			// the events are processed already, the stream resumes after them
+			flush()
+
+			return false
 		case msg := <-msgs:
-			if msg.Type == "network" && msg.Action == "create" {
-				_ = elog.Info(20, fmt.Sprintf("Network created: %s\n", msg.Actor.Attributes["name"]))
-				network, err := w.docker.cli.NetworkInspect(ctx, msg.Actor.ID, types.NetworkInspectOptions{})
-				if err != nil {
-					_ = elog.Error(21, fmt.Sprintf("Failed to inspect new Docker network: %v", err))
-					continue
-				}
-				err = w.networkManager.AddNetwork(network.ID, network)
-				if err != nil {
-					_ = elog.Info(1, fmt.Sprintf("Error restarting tunnel: %v\n", err))
-				}
+			if !w.markEvent(msg) {
+				continue
+			}
+			metrics.Inc("dwnc_docker_events_total", "profile", w.name, "action", msg.Action)
+			if msg.Type != "network" || (msg.Action != "create" && msg.Action != "destroy") {
 				continue
 			}
 
-			if msg.Type == "network" && msg.Action == "destroy" {
-				_ = elog.Info(22, fmt.Sprintf("Network destroyed: %s\n", msg.Actor.Attributes["name"]))
-				err := w.networkManager.RemoveNetwork(msg.Actor.ID)
-				if err != nil {
-					_ = elog.Info(24, fmt.Sprintf("Error restarting tunnel: %v\n", err))
+			name := msg.Actor.Attributes["name"]
+			if msg.Action == "create" {
+				w.log.Info(EventNetworkCreated, "Network created", "network", name)
+			} else {
+				w.log.Info(EventNetworkDestroyed, "Network destroyed", "network", name)
+			}
+
+			if batch == nil {
+				batch = newNetworkBatch()
+				batchTimer = time.NewTimer(eventBatchWindow)
+				batchC = batchTimer.C
+			} else {
+				if !batchTimer.Stop() {
+					<-batchTimer.C
 				}
-				continue
+				batchTimer.Reset(batch.wait())
+			}
+			batch.add(msg.Action == "create", msg.Actor.ID, name)
+		case <-batchC:
+			w.applyBatch(ctx, batch)
+			batch, batchC = nil, nil
+		case clusters := <-kubernetes:
+			flush()
+			w.updateSources(kubernetesSource, clusters)
+		case f := <-w.requests:
+			flush()
+			f()
+		case <-w.routesDone:
+			// the routes are applied in the background, the peer follows
+			// once a network's operations have run
+			err := w.updateAllowedIPs()
+			if err != nil {
+				w.log.Error(EventAllowedIPsFailed, "Failed to update allowed IPs", "error", err)
 			}
+		case <-w.reprovision:
+			w.log.Info(EventReprovisioning, "Re-provisioning VM")
+			flush()
+
+			return false
 		case <-ctx.Done():
-			_ = elog.Info(25, "Context cancelled\n")
-			loop = false
+			w.log.Info(EventEventsStopped, "Context cancelled")
 
 			return true
 		}
 	}
+}
+
+const (
+	// eventBatchWindow is how long a batch waits for further network events,
+	// eventBatchMaxDelay caps the wait during a steady stream of them.
+	eventBatchWindow   = 500 * time.Millisecond
+	eventBatchMaxDelay = 3 * time.Second
+)
+
+// networkBatch holds the network events that came in a burst, the latest per
+// network.
+type networkBatch struct {
+	started  time.Time
+	creates  map[string]string
+	destroys map[string]string
+}
+
+func newNetworkBatch() *networkBatch {
+	return &networkBatch{
+		started:  time.Now(),
+		creates:  make(map[string]string),
+		destroys: make(map[string]string),
+	}
+}
+
+func (b *networkBatch) add(create bool, id, name string) {
+	if create {
+		b.creates[id] = name
+		return
+	}
+
+	if _, ok := b.creates[id]; ok {
+		// created and destroyed in the same burst, like by network prune
+		delete(b.creates, id)
+		return
+	}
+	b.destroys[id] = name
+}
+
+// wait returns how long the batch waits for the next event.
+func (b *networkBatch) wait() time.Duration {
+	left := eventBatchMaxDelay - time.Since(b.started)
+	if left < 0 {
+		return 0
+	}
+	if left < eventBatchWindow {
+		return left
+	}
+
+	return eventBatchWindow
+}
+
+func (b *networkBatch) size() int {
+	return len(b.creates) + len(b.destroys)
+}
+
+// applyBatch queues the route changes of a batch in one pass and applies the
+// access policy and the shims once. The queued operations of the networks run
+// side by side in the background, the peer's AllowedIPs follow from
+// routesDone.
+func (w *Wireguard) applyBatch(ctx context.Context, batch *networkBatch) {
+	started := time.Now()
+	applyPolicy := false
+	applyShims := false
+
+	for id, name := range batch.destroys {
+		if network, ok := w.networkManager.Get(id); ok && needsShim(network.Driver) {
+			applyShims = true
+		}
+		w.networkManager.QueueRemove(id, name)
+		applyPolicy = applyPolicy || w.policy.Matches(name)
+	}
+
+	for id, name := range batch.creates {
+		network, err := w.docker.cli.NetworkInspect(ctx, id, types.NetworkInspectOptions{})
+		if err != nil {
+			w.log.Error(EventNetworkInspectFailed, "Failed to inspect new Docker network", "network", name, "error", err)
+			continue
+		}
+		if needsShim(network.Driver) {
+			w.log.Info(EventShimAdding, network.Driver+" network, adding shim on the VM", "network", network.Name)
+			applyShims = true
+		}
+		w.networkManager.QueueAdd(network)
+		applyPolicy = applyPolicy || w.policy.Matches(network.Name)
+	}
+
+	if applyPolicy {
+		err := w.applyPolicy()
+		if err != nil {
+			w.log.Error(EventPolicyFailed, "Failed to apply access policy", "error", err)
+		}
+	}
+
+	if applyShims {
+		err := w.applyShims()
+		if err != nil {
+			w.log.Error(EventShimsFailed, "Failed to update shims on the VM", "error", err)
+		}
+	}
+
+	duration := time.Since(started)
+	metrics.ObserveValue("dwnc_route_batch_size", float64(batch.size()), "profile", w.name)
+	metrics.Observe("dwnc_route_batch_apply_seconds", duration, "profile", w.name)
+	w.log.Debug(EventBatchApplied, "Applied network changes", "networks", batch.size(), "duration", duration)
+}
+
+// subscribeEvents subscribes to network events. After a short outage it
+// resumes from the last processed event, after a long one it resyncs the
+// networks with the engine and starts from the beginning of the resync, so
+// changes made while it runs still come in.
+func (w *Wireguard) subscribeEvents() (<-chan events.Message, <-chan error) {
+	options := types.EventsOptions{
+		Filters: filters.NewArgs(
+			filters.Arg("type", "network"),
+			filters.Arg("event", "create"),
+			filters.Arg("event", "destroy"),
+		),
+	}
+
+	if !w.eventsSince.IsZero() {
+		gap := time.Since(w.eventsLost)
+		if gap > eventsMaxGap {
+			w.log.Warning(EventEventsResync, "Docker events stream was down too long, resyncing networks", "gap", gap.Round(time.Second))
+			metrics.Inc("dwnc_docker_event_resyncs_total", "profile", w.name)
+			w.resetEvents()
+			w.eventsSince = time.Now()
+			options.Since = fmt.Sprintf("%d.%09d", w.eventsSince.Unix(), w.eventsSince.Nanosecond())
+			err := w.reconcile()
+			if err != nil {
+				w.log.Error(EventEventsResyncFailed, "Failed to resync networks", "error", err)
+			}
+		} else {
+			w.log.Info(EventEventsResumed, "Resuming Docker events stream", "since", w.eventsSince.Format(time.RFC3339Nano))
+			options.Since = fmt.Sprintf("%d.%09d", w.eventsSince.Unix(), w.eventsSince.Nanosecond())
+		}
+	}
+
+	if w.eventsSince.IsZero() {
+		w.eventsSince = time.Now()
+	}
+
+	return w.docker.cli.Events(w.docker.ctx, options)
+}
+
+// markEvent records msg as processed and reports whether it is new. A resumed
+// stream repeats the events at its start.
+func (w *Wireguard) markEvent(msg events.Message) bool {
+	key := fmt.Sprintf("%s/%s/%d", msg.Actor.ID, msg.Action, msg.TimeNano)
+	if _, ok := w.seenEvents[key]; ok {
+		return false
+	}
+
+	at := time.Unix(0, msg.TimeNano)
+	if at.After(w.eventsSince) {
+		w.eventsSince = at
+		for seen, timeNano := range w.seenEvents {
+			if timeNano < msg.TimeNano {
+				delete(w.seenEvents, seen)
+			}
+		}
+	}
+	w.seenEvents[key] = msg.TimeNano
+
+	return true
+}
+
+func (w *Wireguard) resetEvents() {
+	w.eventsSince = time.Time{}
+	w.seenEvents = make(map[string]int64)
+}
+
+// do runs f inside the event loop of Start, so it never races with event
+// handling. It fails when the loop isn't running.
+func (w *Wireguard) do(f func()) error {
+	done := make(chan struct{})
+	timer := time.NewTimer(10 * time.Second)
+	defer timer.Stop()
+
+	select {
+	case w.requests <- func() { f(); close(done) }:
+	case <-timer.C:
+		return errors.New("not watching Docker events")
+	}
+	<-done
+
+	return nil
+}
+
+// Reprovision makes Start return so the VM side is set up again.
+func (w *Wireguard) Reprovision() {
+	select {
+	case w.reprovision <- struct{}{}:
+	default:
+	}
+}
+
+// Networks returns the Docker networks currently routed.
+func (w *Wireguard) Networks() ([]types.NetworkResource, error) {
+	return w.networkManager.Networks(), nil
+}
+
+// RouteFailures returns the route operations that were given up.
+func (w *Wireguard) RouteFailures() []RouteFailure {
+	return w.networkManager.Failures()
+}
+
+// Reconcile adds the routes of networks missed by the event stream, removes
+// those of vanished networks and updates AllowedIPs to match. It waits for the
+// queued route operations outside the event loop and returns their failures.
+func (w *Wireguard) Reconcile() error {
+	var result error
+	err := w.do(func() {
+		result = w.reconcile()
+	})
+	if err != nil {
+		return err
+	}
+
+	// a network that can't be routed must not hold the others back, the
+	// failures are returned after everything else is applied
+	errs := []error{result}
+	w.networkManager.Wait()
+	for _, failure := range w.networkManager.Failures() {
+		errs = append(errs, fmt.Errorf("failed to %s routes of %s: %s", failure.Operation, failure.Network, failure.Error))
+	}
+
+	return errors.Join(errs...)
+}
+
+// signalRoutesDone is the completion callback of the network manager. It
+// never blocks, a pending signal covers every network done meanwhile.
+func (w *Wireguard) signalRoutesDone() {
+	select {
+	case w.routesDone <- struct{}{}:
+	default:
+	}
+}
+
+func (w *Wireguard) reconcile() error {
+	networks, err := w.docker.cli.NetworkList(w.docker.ctx, types.NetworkListOptions{})
+	if err != nil {
+		return errors.New("failed to list docker networks: " + err.Error())
+	}
+
+	var errs []error
+	err = w.checkListener()
+	if err != nil {
+		// the tunnel still works, doctor and status report the missing rules
+		w.log.Warning(EventListenerRestrictFailed, "Failed to restrict WireGuard listener, the port is reachable from every network", "port", w.port, "error", err)
+		errs = append(errs, errors.New("failed to restrict WireGuard listener: "+err.Error()))
+	}
+
+	current := make(map[string]bool)
+	shims := false
+	for _, network := range networks {
+		current[network.ID] = true
+		shims = shims || needsShim(network.Driver)
+		if !w.networkManager.Has(network.ID) {
+			w.networkManager.QueueAdd(network)
+		}
+	}
+
+	for id, routes := range w.sourceRoutes {
+		current[id] = true
+		if !w.networkManager.Has(id) {
+			w.networkManager.QueueAdd(sourceNetwork(id, routes))
+		}
+	}
+
+	for _, network := range w.networkManager.Networks() {
+		if !current[network.ID] {
+			shims = shims || needsShim(network.Driver)
+			w.networkManager.QueueRemove(network.ID, network.Name)
+		}
+	}
+
+	// the queued routes are applied in the background, AllowedIPs are set
+	// now for a peer that drifted and again from routesDone
+	err = w.updateAllowedIPs()
+	if err != nil {
+		errs = append(errs, err)
+	}
+
+	if shims {
+		err = w.applyShims()
+		if err != nil {
+			errs = append(errs, errors.New("failed to update shims: "+err.Error()))
+		}
+	}
+
+	if w.policy != nil {
+		err = w.applyPolicy()
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+type peerStats struct {
+	latestHandshake time.Time
+	receiveBytes    int64
+	transmitBytes   int64
+}
+
+// getPeerStats reads the VM peer's handshake time and transfer counters from
+// `wg show <interface> dump`.
+func (w *Wireguard) getPeerStats() (*peerStats, error) {
+	output, err := w.runWg("show", w.interfaceName, "dump")
+	if err != nil {
+		return nil, err
+	}
+
+	// the first line describes the interface, the peers follow with
+	// public-key preshared-key endpoint allowed-ips latest-handshake rx tx keepalive
+	lines := strings.Split(strings.TrimSpace(output), "\n")
+	for _, line := range lines[1:] {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 7 {
+			continue
+		}
+
+		handshake, _ := strconv.ParseInt(fields[4], 10, 64)
+		rx, _ := strconv.ParseInt(fields[5], 10, 64)
+		tx, _ := strconv.ParseInt(fields[6], 10, 64)
+
+		stats := &peerStats{receiveBytes: rx, transmitBytes: tx}
+		if handshake > 0 {
+			stats.latestHandshake = time.Unix(handshake, 0)
+		}
+
+		return stats, nil
+	}
 
-	return false
+	return nil, errors.New("no peer on " + w.interfaceName)
 }
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"github.com/docker/docker/api/types/events"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+type batchEvent struct {
+	create bool
+	id     string
+}
+
+func TestNetworkBatchAdd(t *testing.T) {
+	tests := []struct {
+		name         string
+		events       []batchEvent
+		wantCreates  []string
+		wantDestroys []string
+	}{
+		{
+			name:        "creates",
+			events:      []batchEvent{{true, "a"}, {true, "b"}},
+			wantCreates: []string{"a", "b"},
+		},
+		{
+			name:         "destroys",
+			events:       []batchEvent{{false, "a"}},
+			wantDestroys: []string{"a"},
+		},
+		{
+			name:   "created and destroyed",
+			events: []batchEvent{{true, "a"}, {false, "a"}},
+		},
+		{
+			name:         "destroyed and created",
+			events:       []batchEvent{{false, "a"}, {true, "a"}},
+			wantCreates:  []string{"a"},
+			wantDestroys: []string{"a"},
+		},
+		{
+			name:        "created twice",
+			events:      []batchEvent{{true, "a"}, {true, "a"}},
+			wantCreates: []string{"a"},
+		},
+		{
+			name:         "pruned among others",
+			events:       []batchEvent{{true, "a"}, {true, "b"}, {false, "a"}, {false, "c"}},
+			wantCreates:  []string{"b"},
+			wantDestroys: []string{"c"},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			batch := newNetworkBatch()
+			for _, event := range test.events {
+				batch.add(event.create, event.id, "net-"+event.id)
+			}
+
+			creates := batchIDs(batch.creates)
+			if creates != strings.Join(test.wantCreates, ",") {
+				t.Errorf("creates = %q, want %q", creates, test.wantCreates)
+			}
+			destroys := batchIDs(batch.destroys)
+			if destroys != strings.Join(test.wantDestroys, ",") {
+				t.Errorf("destroys = %q, want %q", destroys, test.wantDestroys)
+			}
+			if size := batch.size(); size != len(test.wantCreates)+len(test.wantDestroys) {
+				t.Errorf("size = %d, want %d", size, len(test.wantCreates)+len(test.wantDestroys))
+			}
+		})
+	}
+}
+
+func batchIDs(networks map[string]string) string {
+	ids := make([]string, 0, len(networks))
+	for id := range networks {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	return strings.Join(ids, ",")
+}
+
+func TestNetworkBatchWait(t *testing.T) {
+	tests := []struct {
+		name string
+		age  time.Duration
+		want time.Duration
+	}{
+		{name: "new batch", age: 0, want: eventBatchWindow},
+		{name: "near the cap", age: eventBatchMaxDelay - eventBatchWindow/2, want: eventBatchWindow / 2},
+		{name: "past the cap", age: eventBatchMaxDelay + time.Second, want: 0},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			batch := newNetworkBatch()
+			batch.started = time.Now().Add(-test.age)
+
+			wait := batch.wait()
+			if wait > test.want || wait < test.want-100*time.Millisecond {
+				t.Errorf("wait = %s, want %s", wait, test.want)
+			}
+		})
+	}
+}
+
+func TestMarkEvent(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+	event := func(id, action string, offset time.Duration) events.Message {
+		return events.Message{
+			Action:   action,
+			Actor:    events.Actor{ID: id},
+			TimeNano: start.Add(offset).UnixNano(),
+		}
+	}
+
+	tests := []struct {
+		name   string
+		events []events.Message
+		want   []bool
+	}{
+		{
+			name:   "new events",
+			events: []events.Message{event("a", "create", 0), event("b", "create", time.Second)},
+			want:   []bool{true, true},
+		},
+		{
+			name:   "repeated event",
+			events: []events.Message{event("a", "create", 0), event("a", "create", 0)},
+			want:   []bool{true, false},
+		},
+		{
+			name:   "same time, other action",
+			events: []events.Message{event("a", "create", 0), event("a", "destroy", 0)},
+			want:   []bool{true, true},
+		},
+		{
+			name:   "same time, other network",
+			events: []events.Message{event("a", "create", 0), event("b", "create", 0)},
+			want:   []bool{true, true},
+		},
+		{
+			name: "resumed stream repeats its start",
+			events: []events.Message{
+				event("a", "create", 0),
+				event("b", "create", time.Second),
+				event("b", "create", time.Second),
+				event("c", "create", 2*time.Second),
+			},
+			want: []bool{true, true, false, true},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			w := &Wireguard{seenEvents: make(map[string]int64)}
+			for i, msg := range test.events {
+				if fresh := w.markEvent(msg); fresh != test.want[i] {
+					t.Errorf("event %d: new = %t, want %t", i, fresh, test.want[i])
+				}
+			}
+
+			last := test.events[len(test.events)-1]
+			if !w.eventsSince.Equal(time.Unix(0, last.TimeNano)) {
+				t.Errorf("eventsSince = %s, want the time of the last event", w.eventsSince)
+			}
+		})
+	}
+}
+
+func TestMarkEventForgetsOlderEvents(t *testing.T) {
+	w := &Wireguard{seenEvents: make(map[string]int64)}
+	start := time.Now().Add(-time.Minute).UnixNano()
+
+	w.markEvent(events.Message{Action: "create", Actor: events.Actor{ID: "a"}, TimeNano: start})
+	w.markEvent(events.Message{Action: "create", Actor: events.Actor{ID: "b"}, TimeNano: start + 1})
+
+	if len(w.seenEvents) != 1 {
+		t.Fatalf("seenEvents = %v, want only the latest event", w.seenEvents)
+	}
+}